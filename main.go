@@ -6,24 +6,44 @@ import (
 	"github.com/near-notfaraway/stevedore/sd_config"
 	"github.com/near-notfaraway/stevedore/sd_server"
 	"github.com/near-notfaraway/stevedore/sd_util"
+	"github.com/sirupsen/logrus"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
 	// parse option config
 	configPath := flag.String("config", "../etc/config.json", "config file path")
+	check := flag.Bool("check", false, "check config file and report all errors, then exit")
 	flag.Parse()
 
 	// parse file config
 	var config sd_config.Config
 	if err := sd_util.UnmarshalFile(*configPath, &config); err != nil {
+		if *check {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 		panic(fmt.Errorf("init config failed: %w", err))
 	}
 
+	// only check config
+	if *check {
+		os.Exit(checkConfig(&config, *configPath))
+	}
+
+	// when upgrading, old process keeps http addrs until new process has taken over
+	upgrading := os.Getenv(sd_server.UpgradeSockEnv) != ""
+
 	// init pprof
 	if config.PProf.Open {
 		go func() {
-			if err := http.ListenAndServe(config.PProf.ServerAddr, nil); err != nil {
+			if err := listenHTTP(upgrading, func() error {
+				return http.ListenAndServe(config.PProf.ServerAddr, nil)
+			}); err != nil {
 				panic(fmt.Errorf("open pprof failed: %w", err))
 			}
 		}()
@@ -34,6 +54,87 @@ func main() {
 		panic(fmt.Errorf("init logger failed: %w", err))
 	}
 
-	// listen and serve
-	panic(sd_server.NewServer(&config).ListenAndServe())
+	// reload upload config when SIGHUP
+	server, err := sd_server.NewServer(&config, *configPath)
+	if err != nil {
+		panic(fmt.Errorf("init server failed: %w", err))
+	}
+	go func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGHUP)
+		for range sigCh {
+			logrus.Info("recv SIGHUP, reload config")
+			if err := server.Reload(); err != nil {
+				logrus.Errorf("reload config failed: %v", err)
+			}
+		}
+	}()
+
+	// init admin api
+	if config.Admin != nil && config.Admin.Open {
+		go func() {
+			if err := listenHTTP(upgrading, func() error {
+				return server.ListenAndServeAdmin(config.Admin.ServerAddr)
+			}); err != nil {
+				panic(fmt.Errorf("open admin api failed: %w", err))
+			}
+		}()
+	}
+
+	// upgrade to new binary when SIGUSR2
+	go func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGUSR2)
+		for range sigCh {
+			logrus.Info("recv SIGUSR2, upgrade")
+			if err := server.Upgrade(); err != nil {
+				logrus.Errorf("upgrade failed: %v", err)
+			}
+		}
+	}()
+
+	// shutdown gracefully when SIGTERM or SIGINT
+	go func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+		sig := <-sigCh
+		logrus.Infof("recv %v, shutdown gracefully", sig)
+		server.Shutdown(time.Second * time.Duration(config.Server.ShutdownGraceSec))
+	}()
+
+	// listen and serve until shutdown
+	if err := server.ListenAndServe(); err != nil {
+		panic(err)
+	}
+	logrus.Info("server exited")
+}
+
+// Print all errors of config, returns exit code
+func checkConfig(config *sd_config.Config, configPath string) int {
+	err := sd_server.CheckConfig(config)
+	if err == nil {
+		fmt.Printf("config %s is ok\n", configPath)
+		return 0
+	}
+
+	if errs, ok := err.(sd_config.ErrorList); ok {
+		for _, e := range errs {
+			fmt.Fprintln(os.Stderr, e)
+		}
+	} else {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	fmt.Fprintf(os.Stderr, "config %s is invalid\n", configPath)
+	return 1
+}
+
+// Listen http, retry for a while if upgrading because old process may not exit yet
+func listenHTTP(upgrading bool, listen func() error) error {
+	for i := 0; ; i++ {
+		err := listen()
+		if !upgrading || i >= 30 {
+			return err
+		}
+		time.Sleep(time.Second)
+	}
 }
@@ -0,0 +1,149 @@
+package sd_config
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"net"
+)
+
+// Check fields of config which are not related to upload
+// Returns ErrorList contains all errors found
+func (c *Config) Check() error {
+	var errs ErrorList
+
+	if c.PProf != nil && c.PProf.Open && c.PProf.ServerAddr == "" {
+		errs = append(errs, NewFieldError("PProf.ServerAddr", "should not be empty when pprof is open"))
+	}
+
+	if c.Admin != nil && c.Admin.Open && c.Admin.ServerAddr == "" {
+		errs = append(errs, NewFieldError("Admin.ServerAddr", "should not be empty when admin is open"))
+	}
+
+	if c.Log == nil {
+		errs = append(errs, NewFieldError("Log", "is missing"))
+	} else {
+		errs.Add("Log", c.Log.Check())
+	}
+
+	if c.Server == nil {
+		errs = append(errs, NewFieldError("Server", "is missing"))
+	} else {
+		errs.Add("Server", c.Server.Check())
+	}
+
+	if c.Session == nil {
+		errs = append(errs, NewFieldError("Session", "is missing"))
+	} else {
+		errs.Add("Session", c.Session.Check())
+	}
+
+	if c.Upload == nil {
+		errs = append(errs, NewFieldError("Upload", "is missing"))
+	}
+
+	return errs.Err()
+}
+
+func (c *LogConfig) Check() error {
+	var errs ErrorList
+	if c.Path == "" {
+		errs = append(errs, NewFieldError("Path", "should not be empty"))
+	}
+	if _, err := logrus.ParseLevel(c.Level); err != nil {
+		errs = append(errs, &FieldError{Path: "Level", Err: err})
+	}
+	return errs.Err()
+}
+
+func (c *ServerConfig) Check() error {
+	var errs ErrorList
+	if len(c.Listeners) == 0 {
+		if _, err := net.ResolveUDPAddr("udp", c.ListenAddr); err != nil {
+			errs = append(errs, &FieldError{Path: "ListenAddr", Err: err})
+		}
+		if c.ListenParallel < 1 {
+			errs = append(errs, NewFieldError("ListenParallel", "should be greater than 0"))
+		}
+		errs = append(errs, checkSteering(&ListenerConfig{
+			Steering:         c.Steering,
+			SteeringKeyBytes: c.SteeringKeyBytes,
+		})...)
+	} else {
+		if c.ListenAddr != "" {
+			errs = append(errs, NewFieldError("ListenAddr", "should not be set with Listeners"))
+		}
+		if c.ListenParallel != 0 {
+			errs = append(errs, NewFieldError("ListenParallel", "should not be set with Listeners"))
+		}
+		if c.Steering != "" {
+			errs = append(errs, NewFieldError("Steering", "should not be set with Listeners"))
+		}
+		if c.SteeringKeyBytes != "" {
+			errs = append(errs, NewFieldError("SteeringKeyBytes", "should not be set with Listeners"))
+		}
+	}
+
+	// check listeners, routes are checked with upstreams
+	names := make(map[string]struct{})
+	for i, listener := range c.Listeners {
+		path := fmt.Sprintf("Listeners[%d]", i)
+		if _, dup := names[listener.Name]; dup {
+			errs = append(errs, NewFieldError(path+".Name", "duplicated listener %q", listener.Name))
+		}
+		names[listener.Name] = struct{}{}
+		errs.Add(path, listener.Check())
+	}
+
+	if c.MaxTryTimes < 1 {
+		errs = append(errs, NewFieldError("MaxTryTimes", "should be greater than 0"))
+	}
+	if c.ShutdownGraceSec < 0 {
+		errs = append(errs, NewFieldError("ShutdownGraceSec", "should not be negative"))
+	}
+	return errs.Err()
+}
+
+func (c *ListenerConfig) Check() error {
+	var errs ErrorList
+	if c.Name == "" {
+		errs = append(errs, NewFieldError("Name", "should not be empty"))
+	}
+	if _, err := net.ResolveUDPAddr("udp", c.ListenAddr); err != nil {
+		errs = append(errs, &FieldError{Path: "ListenAddr", Err: err})
+	}
+	if c.ListenParallel < 1 {
+		errs = append(errs, NewFieldError("ListenParallel", "should be greater than 0"))
+	}
+	errs = append(errs, checkSteering(c)...)
+	return errs.Err()
+}
+
+// Check Steering and SteeringKeyBytes of listener
+func checkSteering(c *ListenerConfig) ErrorList {
+	var errs ErrorList
+	switch c.Steering {
+	case "", SteeringClient:
+		if c.SteeringKeyBytes != "" {
+			errs = append(errs, NewFieldError("SteeringKeyBytes", "only works with payload steering"))
+		}
+	case SteeringPayload:
+		if _, _, err := c.GetSteeringKeyBytes(); err != nil {
+			errs = append(errs, &FieldError{Path: "SteeringKeyBytes", Err: err})
+		}
+	default:
+		errs = append(errs, NewFieldError("Steering", "unknown steering %q, should be %s or %s",
+			c.Steering, SteeringClient, SteeringPayload))
+	}
+	return errs
+}
+
+func (c *SessionConfig) Check() error {
+	var errs ErrorList
+	if c.RecycleIntervalSec < 1 {
+		errs = append(errs, NewFieldError("RecycleIntervalSec", "should be greater than 0"))
+	}
+	if c.TimeoutSec < 1 {
+		errs = append(errs, NewFieldError("TimeoutSec", "should be greater than 0"))
+	}
+	return errs.Err()
+}
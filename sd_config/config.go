@@ -1,7 +1,14 @@
 package sd_config
 
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
 type Config struct {
 	PProf   *PProfConfig
+	Admin   *AdminConfig
 	Log     *LogConfig
 	Server  *ServerConfig
 	Upload  *UploadConfig
@@ -13,6 +20,11 @@ type PProfConfig struct {
 	ServerAddr string
 }
 
+type AdminConfig struct {
+	Open       bool   // if open admin http api
+	ServerAddr string // listening address of admin http api
+}
+
 type LogConfig struct {
 	Path             string // log file path
 	Level            string // log level
@@ -22,29 +34,67 @@ type LogConfig struct {
 }
 
 type ServerConfig struct {
-	ListenAddr         string // listening address
-	ListenParallel     int    // number of worker listening at the same time
-	EventSize          int    // size of events polling from selector
-	EventChanSize      int    // size of events delivering to worker non-blocking
-	BatchSize          int    // size of batch read/write packets
-	BufSize            int    // size of single read/write buffer
-	TaskPoolSize       int    // capacity of task pool
-	TaskPoolTimeoutSec int    // timeout of worker in task pool
-	MaxTryTimes        int    // max try times of upload packet to upstream
+	ListenAddr         string            // listening address, used if no listeners
+	ListenParallel     int               // number of worker listening at the same time, used if no listeners
+	Steering           string            // steering scheme of workers, used if no listeners
+	SteeringKeyBytes   string            // payload bytes of payload steering, used if no listeners
+	Listeners          []*ListenerConfig // listeners with their own routes, used instead of ListenAddr
+	EventSize          int               // size of events polling from selector
+	EventChanSize      int               // size of events delivering to worker non-blocking
+	BatchSize          int               // size of batch read/write packets
+	BufSize            int               // size of single read/write buffer
+	TaskPoolSize       int               // capacity of task pool
+	TaskPoolTimeoutSec int               // timeout of worker in task pool
+	MaxTryTimes        int               // max try times of upload packet to upstream
+	ShutdownGraceSec   int               // time for sessions getting replies when shutdown
+	UpgradeSockPath    string            // unix socket path used to hand over fds when upgrade
+}
+
+// Name of listener made of ListenAddr, ListenParallel and routes of upload config
+const DefaultListenerName = "default"
+
+// Steering schemes of listener, packets of the same key are always recv by the same worker
+const (
+	SteeringClient  = "client"  // key is client address
+	SteeringPayload = "payload" // key is payload bytes, short packets are steered by client address
+
+	MaxSteeringKeyLen = 64 // max bytes of payload steering key
+)
+
+type ListenerConfig struct {
+	Name             string        // unique name, carried by sessions and metrics
+	ListenAddr       string        // listening address
+	ListenParallel   int           // number of worker listening at the same time
+	Steering         string        // steer packets to workers by client or payload, default by kernel 4-tuple hash
+	SteeringKeyBytes string        // payload bytes start:end hashed by payload steering
+	DefaultAction    string        // action when no route match, forward, drop or reject, default forward
+	DefaultUpstream  string        // use it when no route match
+	DefaultReply     string        // reply template when no route match and default action is reject
+	DNS              *DNSConfig    // parse packets as dns queries, not parsed if nil
+	Routes           []RouteConfig // routes of packets recv by this listener
 }
 
 type UploadConfig struct {
+	DefaultAction   string // action when no route match, forward, drop or reject, default forward
 	DefaultUpstream string
+	DefaultReply    string     // reply template when no route match and default action is reject
+	DNS             *DNSConfig // dns mode of listener made of upload config
 	Upstreams       []*UpstreamConfig
 	Routes          []RouteConfig
 }
 
+type DNSConfig struct {
+	Malformed string // action on packets which are not valid dns queries, drop or forward, default drop
+}
+
 type UpstreamConfig struct {
-	Name          string
-	Type          string
-	KeyBytes      string
-	Peers         []*PeerConfig
-	HealthChecker *HealthCheckerConfig
+	Name            string
+	Type            string
+	KeyBytes        string
+	KeyExtractor    string // extract key of chash upstream by protocol, such as quic-dcid, used instead of KeyBytes
+	DrainTimeoutSec int    // deadline of draining peer keeping existing flows, 0 means until they go idle
+	Peers           []*PeerConfig
+	HealthChecker   *HealthCheckerConfig
 }
 
 type PeerConfig struct {
@@ -52,6 +102,7 @@ type PeerConfig struct {
 	Port   int
 	Weight int
 	Backup bool
+	Drain  bool // peer gets no new flows if drain
 }
 
 type HealthCheckerConfig struct {
@@ -62,13 +113,100 @@ type HealthCheckerConfig struct {
 }
 
 type RouteConfig struct {
-	Operator string
-	Value    string
-	KeyBytes string
-	Upstream string
+	Operator     string
+	Value        string
+	KeyBytes     string
+	KeyExtractor string           // extract key by protocol, such as kcp-conv, used instead of KeyBytes
+	Endian       string           // byte order of key for numeric operators, big or little, default big
+	ScanLimit    int              // max bytes scanned by search operators, default 512
+	Condition    *ConditionConfig // compound condition, used instead of KeyBytes, Operator and Value
+	Match        string           // condition expression, used instead of Condition, KeyBytes, Operator and Value
+	Action       string           // action on matched packet, forward, drop or reject, default forward
+	Upstream     string           // target upstream of forward action
+	Split        []*SplitConfig   // weighted upstreams of forward action, used instead of Upstream
+	SplitKey     string           // key bytes used to choose upstream of split, packets too short are dropped, default by client address
+	Reply        string           // reply template of reject action, such as 0xff00{4:6}
+	Mirror       *MirrorConfig    // copy packets to shadow upstream, only works with forward action
+	Sticky       bool             // later packets of session reuse upstream and peer chosen for its first packet
+}
+
+type SplitConfig struct {
+	Upstream string // target upstream
+	Weight   int    // ratio of clients choosing this upstream
+}
+
+type MirrorConfig struct {
+	Upstream string // shadow upstream which packets are copied to
+	Percent  int    // percent of sessions whose packets are copied, 1 to 100
+}
+
+// Condition tree of route, only one of And, Or, Not, KeyBytes, SrcCIDR, SrcPort, Length and DNS fields should be set
+// KeyExtractor can be set instead of KeyBytes
+type ConditionConfig struct {
+	And          []*ConditionConfig // match if all sub conditions match
+	Or           []*ConditionConfig // match if any sub condition matches
+	Not          *ConditionConfig   // match if sub condition not matches
+	KeyBytes     string             // leaf condition: data[start:end] operates with value
+	KeyExtractor string             // leaf condition: key extracted by protocol, used instead of KeyBytes
+	Operator     string
+	Value        string
+	Endian       string // byte order of key for numeric operators, big or little, default big
+	ScanLimit    int    // max bytes scanned by search operators, default 512
+	SrcCIDR      string // leaf condition: source ip in any of comma separated cidrs
+	SrcPort      string // leaf condition: source port in form port or min:max
+	Length       string // leaf condition: payload length in form len, min:, :max or min:max
+	DNSSuffix    string // leaf condition: qname of dns query ends with any of comma separated domains
+	DNSQType     string // leaf condition: qtype of dns query in comma separated names or numbers
+	DNSOpcode    string // leaf condition: opcode of dns query in comma separated names or numbers
+	DNSFlags     string // leaf condition: flags of dns query set or clear with prefix !, such as rd,!cd
 }
 
 type SessionConfig struct {
 	RecycleIntervalSec int64 // time interval of recycle session
 	TimeoutSec         int64 // timeout for recycle session
 }
+
+// Return listeners of server, if Listeners is not set, returns a listener named default
+// made of ListenAddr, ListenParallel and routes of upload config
+func (c *Config) GetListeners() []*ListenerConfig {
+	if len(c.Server.Listeners) > 0 {
+		return c.Server.Listeners
+	}
+
+	listener := &ListenerConfig{
+		Name:             DefaultListenerName,
+		ListenAddr:       c.Server.ListenAddr,
+		ListenParallel:   c.Server.ListenParallel,
+		Steering:         c.Server.Steering,
+		SteeringKeyBytes: c.Server.SteeringKeyBytes,
+	}
+	if c.Upload != nil {
+		listener.DefaultAction = c.Upload.DefaultAction
+		listener.DefaultUpstream = c.Upload.DefaultUpstream
+		listener.DefaultReply = c.Upload.DefaultReply
+		listener.DNS = c.Upload.DNS
+		listener.Routes = c.Upload.Routes
+	}
+	return []*ListenerConfig{listener}
+}
+
+// Return payload bytes range of payload steering
+// Returns err if SteeringKeyBytes is not in form start:end
+func (c *ListenerConfig) GetSteeringKeyBytes() (int, int, error) {
+	parts := strings.Split(c.SteeringKeyBytes, ":")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("%q should be in form start:end", c.SteeringKeyBytes)
+	}
+	start, err := strconv.Atoi(parts[0])
+	if err != nil || start < 0 {
+		return 0, 0, fmt.Errorf("start %q should be a non-negative integer", parts[0])
+	}
+	end, err := strconv.Atoi(parts[1])
+	if err != nil || end <= start {
+		return 0, 0, fmt.Errorf("end %q should be an integer greater than start", parts[1])
+	}
+	if end-start > MaxSteeringKeyLen {
+		return 0, 0, fmt.Errorf("length %d exceeds %d", end-start, MaxSteeringKeyLen)
+	}
+	return start, end, nil
+}
@@ -0,0 +1,105 @@
+package sd_config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+//------------------------------------------------------------------------------
+// FieldError: an error of config field with its json path
+//------------------------------------------------------------------------------
+
+type FieldError struct {
+	Path string // json path of field, such as Upload.Routes[0].KeyBytes
+	Err  error  // error of field
+}
+
+func NewFieldError(path string, format string, a ...interface{}) *FieldError {
+	return &FieldError{Path: path, Err: fmt.Errorf(format, a...)}
+}
+
+func (e *FieldError) Error() string {
+	if e.Path == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s: %v", e.Path, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// Prefix json path of error with path, also apply to every error in ErrorList
+// Returns nil if err is nil
+func WithPath(path string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var list ErrorList
+	if errors.As(err, &list) {
+		rst := make(ErrorList, 0, len(list))
+		for _, e := range list {
+			rst = append(rst, WithPath(path, e))
+		}
+		return rst
+	}
+
+	var fieldErr *FieldError
+	if errors.As(err, &fieldErr) {
+		return &FieldError{Path: joinPath(path, fieldErr.Path), Err: fieldErr.Err}
+	}
+	return &FieldError{Path: path, Err: err}
+}
+
+// Join parent path and child path, child path maybe an index like [0]
+func joinPath(parent, child string) string {
+	if parent == "" {
+		return child
+	}
+	if child == "" {
+		return parent
+	}
+	if strings.HasPrefix(child, "[") {
+		return parent + child
+	}
+	return parent + "." + child
+}
+
+//------------------------------------------------------------------------------
+// ErrorList: all errors found in config
+//------------------------------------------------------------------------------
+
+type ErrorList []error
+
+func (l ErrorList) Error() string {
+	msgs := make([]string, 0, len(l))
+	for _, err := range l {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Add err with path prefixed into list, flatten it if err is a ErrorList
+// Do nothing if err is nil
+func (l *ErrorList) Add(path string, err error) {
+	err = WithPath(path, err)
+	if err == nil {
+		return
+	}
+
+	if list, ok := err.(ErrorList); ok {
+		*l = append(*l, list...)
+		return
+	}
+	*l = append(*l, err)
+}
+
+// Returns nil if list is empty, otherwise returns list itself
+func (l ErrorList) Err() error {
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
@@ -0,0 +1,272 @@
+package sd_server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/near-notfaraway/stevedore/sd_config"
+	"github.com/near-notfaraway/stevedore/sd_upstream"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//------------------------------------------------------------------------------
+// Admin: http api used to inspect and control server at runtime
+//------------------------------------------------------------------------------
+
+type adminError struct {
+	Error string
+}
+
+// Status of upstream changed by admin api, changes are kept in memory and lost after reload
+type upstreamChange struct {
+	*sd_upstream.UpstreamStatus
+	Persisted bool // always false, config file is not changed
+}
+
+// Status of route changed by admin api, changes are kept in memory and lost after reload
+type routeChange struct {
+	*sd_upstream.RouteStatus
+	Persisted bool // always false, config file is not changed
+}
+
+// Listen admin api on addr and serve, always returns non-nil error
+func (s *Server) ListenAndServeAdmin(addr string) error {
+	return http.ListenAndServe(addr, s.AdminHandler())
+}
+
+// Return handler of admin api, all responses are json
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/upstreams", s.handleUpstreams)
+	mux.HandleFunc("/peers", s.handlePeers)
+	mux.HandleFunc("/peers/drain", s.handlePeerDrain)
+	mux.HandleFunc("/routes", s.handleRoutes)
+	mux.HandleFunc("/routes/split", s.handleRouteSplit)
+	mux.HandleFunc("/listeners", s.handleListeners)
+	mux.HandleFunc("/reload", s.handleReload)
+	mux.HandleFunc("/upgrade", s.handleUpgrade)
+	return mux
+}
+
+// GET /upstreams: list all upstreams with peers, also filter by ?name=
+func (s *Server) handleUpstreams(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	upstreams := s.getUpstreamMgr().Status().Upstreams
+	if name := r.URL.Query().Get("name"); name != "" {
+		for _, upstream := range upstreams {
+			if upstream.Name == name {
+				writeJSON(w, http.StatusOK, upstream)
+				return
+			}
+		}
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("upstream %s not found", name))
+		return
+	}
+	writeJSON(w, http.StatusOK, upstreams)
+}
+
+// Change peers of upstream specified by ?upstream=, changes are lost after reload
+// - POST /peers: add peer, body is peer config
+// - PUT /peers?addr=: change weight of peer, body is like {"Weight": 2}
+// - DELETE /peers?addr=: remove peer
+func (s *Server) handlePeers(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("upstream")
+	upstream := s.getUpstreamMgr().GetUpstream(name)
+	if upstream == nil {
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("upstream %s not found", name))
+		return
+	}
+
+	var err error
+	addr := r.URL.Query().Get("addr")
+	switch r.Method {
+	case http.MethodPost:
+		var config sd_config.PeerConfig
+		if err = json.NewDecoder(r.Body).Decode(&config); err != nil {
+			writeAdminError(w, http.StatusBadRequest, fmt.Errorf("decode peer config failed: %w", err))
+			return
+		}
+		err = upstream.AddPeer(&config)
+
+	case http.MethodPut:
+		var body struct{ Weight int }
+		if err = json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeAdminError(w, http.StatusBadRequest, fmt.Errorf("decode weight failed: %w", err))
+			return
+		}
+		err = upstream.SetPeerWeight(addr, body.Weight)
+
+	case http.MethodDelete:
+		err = upstream.RemovePeer(addr)
+
+	default:
+		w.Header().Set("Allow", "POST, PUT, DELETE")
+		writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	logrus.Infof("peers of upstream %s changed by admin api: %s %s", name, r.Method, addr)
+	writeJSON(w, http.StatusOK, &upstreamChange{UpstreamStatus: upstream.Status()})
+}
+
+// PUT /peers/drain?upstream=&addr=: drain peer or not, changes are lost after reload
+// Body is like {"Drain": true, "TimeoutSec": 60}, use DrainTimeoutSec of upstream if TimeoutSec is 0
+func (s *Server) handlePeerDrain(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPut) {
+		return
+	}
+
+	name := r.URL.Query().Get("upstream")
+	upstream := s.getUpstreamMgr().GetUpstream(name)
+	if upstream == nil {
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("upstream %s not found", name))
+		return
+	}
+
+	var body struct {
+		Drain      bool
+		TimeoutSec int
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("decode drain failed: %w", err))
+		return
+	}
+
+	addr := r.URL.Query().Get("addr")
+	if err := upstream.SetPeerDrain(addr, body.Drain, time.Second*time.Duration(body.TimeoutSec)); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	logrus.Infof("peer %s of upstream %s set drain %v by admin api", addr, name, body.Drain)
+	writeJSON(w, http.StatusOK, &upstreamChange{UpstreamStatus: upstream.Status()})
+}
+
+// GET /routes: list default upstream and all routes in match order of each listener, also filter by ?listener=
+func (s *Server) handleRoutes(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	routers := s.getUpstreamMgr().Status().Routers
+	if name := r.URL.Query().Get("listener"); name != "" {
+		for _, router := range routers {
+			if router.Listener == name {
+				writeJSON(w, http.StatusOK, router)
+				return
+			}
+		}
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("listener %s not found", name))
+		return
+	}
+	writeJSON(w, http.StatusOK, routers)
+}
+
+// PUT /routes/split?listener=&route=: change weights of split route, changes are lost after reload
+// Body is like {"Weights": {"v1": 95, "v2": 5}}, weights of upstreams not given are kept
+func (s *Server) handleRouteSplit(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPut) {
+		return
+	}
+
+	name := r.URL.Query().Get("listener")
+	router := s.getUpstreamMgr().GetRouter(name)
+	if router == nil {
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("listener %s not found", name))
+		return
+	}
+	id, err := strconv.Atoi(r.URL.Query().Get("route"))
+	route := router.GetRoute(id)
+	if err != nil || route == nil {
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("route %s not found", r.URL.Query().Get("route")))
+		return
+	}
+
+	var body struct{ Weights map[string]int }
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("decode weights failed: %w", err))
+		return
+	}
+	if err := route.SetSplitWeights(body.Weights); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	logrus.Infof("split weights of route %d of listener %s changed by admin api: %v", id, name, body.Weights)
+	writeJSON(w, http.StatusOK, &routeChange{RouteStatus: route.Status()})
+}
+
+// GET /listeners: list all listeners with sessions and packet counters
+func (s *Server) handleListeners(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	sessions := s.sessionMgr.CountByListener()
+	status := make([]*ListenerStatus, 0, len(s.listeners))
+	for _, listener := range s.listeners {
+		status = append(status, listener.Status(sessions[listener.GetName()]))
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// POST /reload: re-read config file and reload upload config
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	logrus.Info("recv reload request from admin api")
+	if err := s.Reload(); err != nil {
+		logrus.Errorf("reload config failed: %v", err)
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+// POST /upgrade: start new binary and hand over to it, this process exits if succeed
+func (s *Server) handleUpgrade(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	logrus.Info("recv upgrade request from admin api")
+	if err := s.Upgrade(); err != nil {
+		logrus.Errorf("upgrade failed: %v", err)
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+// Return false and write error if request method is not allowed
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return false
+	}
+	return true
+}
+
+func writeAdminError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, &adminError{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		logrus.Errorf("write admin response failed: %v", err)
+	}
+}
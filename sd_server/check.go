@@ -0,0 +1,44 @@
+package sd_server
+
+import (
+	"fmt"
+	"github.com/near-notfaraway/stevedore/sd_config"
+	"github.com/near-notfaraway/stevedore/sd_upstream"
+)
+
+// Check the whole config without creating server
+// Returns ErrorList contains all invalid fields with json path
+func CheckConfig(config *sd_config.Config) error {
+	var errs sd_config.ErrorList
+	errs.Add("", config.Check())
+	if config.Upload != nil {
+		errs.Add("Upload", sd_upstream.CheckConfig(config.Upload))
+	}
+
+	// routes of listeners are checked with upstreams of upload config
+	if config.Server != nil && config.Upload != nil && len(config.Server.Listeners) > 0 {
+		for _, field := range []struct{ name, value string }{
+			{"DefaultAction", config.Upload.DefaultAction},
+			{"DefaultUpstream", config.Upload.DefaultUpstream},
+			{"DefaultReply", config.Upload.DefaultReply},
+		} {
+			if field.value != "" {
+				errs = append(errs, sd_config.NewFieldError("Upload."+field.name,
+					"should be set in Server.Listeners when listeners are set"))
+			}
+		}
+		if config.Upload.DNS != nil {
+			errs = append(errs, sd_config.NewFieldError("Upload.DNS",
+				"should be set in Server.Listeners when listeners are set"))
+		}
+		if len(config.Upload.Routes) > 0 {
+			errs = append(errs, sd_config.NewFieldError("Upload.Routes",
+				"should be set in Server.Listeners when listeners are set"))
+		}
+		for i, listener := range config.Server.Listeners {
+			path := fmt.Sprintf("Server.Listeners[%d]", i)
+			errs.Add(path, sd_upstream.CheckListenerConfig(listener, config.Upload))
+		}
+	}
+	return errs.Err()
+}
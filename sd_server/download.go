@@ -2,17 +2,35 @@ package sd_server
 
 import (
 	"context"
+	"fmt"
 	"github.com/near-notfaraway/stevedore/sd_session"
 	"github.com/near-notfaraway/stevedore/sd_socket"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
 	"os"
+	"sync/atomic"
 )
 
+// Register fd of session to selector and start download worker for it
+func (s *Server) registerSession(sess *sd_session.Session) error {
+	s.fdReadHandlers.Store(sess.GetFD(), func() { sess.GetCh() <- struct{}{} })
+	if err := s.selector.Add(sess.GetFD(), sd_socket.SelectorEventRead); err != nil {
+		s.fdReadHandlers.Delete(sess.GetFD())
+		return fmt.Errorf("add selector for session failed: %w", err)
+	}
+	go s.downloadWorker(sess.GetCtx(), sess)
+	return nil
+}
+
 func (s *Server) downloadWorker(ctx context.Context, sess *sd_session.Session) {
 	// init logger for download worker
-	logger := logrus.WithField("session_name", sess.GetName())
+	logger := logrus.WithFields(logrus.Fields{"session_name": sess.GetName(), "listener": sess.GetListener()})
 	logger.Debug("init download worker")
+	listener := s.getListener(sess.GetListener())
+	if listener == nil {
+		logger.Errorf("listener of session not exists")
+		return
+	}
 	mc := s.mcPool.GetMMsgContainerFromPool()
 	defer s.mcPool.PutMMsgContainerToPool(mc)
 
@@ -44,10 +62,12 @@ func (s *Server) downloadWorker(ctx context.Context, sess *sd_session.Session) {
 					logger.Debugf("packet info: data is %v", buf[:nr])
 
 					logger.Debugf("send packets to downstream")
-					err := sd_socket.SendTo(s.workers[0].fd, buf[:nr], 0, sess.GetSockaddr())
+					err := listener.sendReply(buf[:nr], sess.GetSockaddr())
 					if err != nil {
 						logrus.Errorf("write to udp fail: %v", err)
+						continue
 					}
+					atomic.AddUint64(&listener.replyPackets, 1)
 				}
 
 				break
@@ -0,0 +1,86 @@
+package sd_server
+
+import (
+	"github.com/near-notfaraway/stevedore/sd_config"
+	"github.com/near-notfaraway/stevedore/sd_socket"
+	"golang.org/x/sys/unix"
+	"sync/atomic"
+)
+
+//------------------------------------------------------------------------------
+// Listener: a listening address with its upload workers and route table
+//------------------------------------------------------------------------------
+
+type Listener struct {
+	replyPackets uint64                    // packets of upstreams sent back to clients, accessed atomically
+	config       *sd_config.ListenerConfig // listener config, routes may be outdated after reload
+	workers      []*UploadWorker           // upload workers listening on address
+	replySock    atomic.Value              // *sd_socket.ReplySocket: used to send replies after shutdown began
+}
+
+// Counters of upload worker, only written by the worker itself
+type uploadStats struct {
+	recvPackets    uint64 // packets recv from clients
+	recvBytes      uint64 // bytes recv from clients
+	drops          uint64 // packets dropped by route or because no upstream routed
+	rejects        uint64 // packets rejected by route with reply sent
+	uploadFailures uint64 // packets dropped because upload to peers failed
+	mirrorPackets  uint64 // packets copied to shadow upstream
+	mirrorDrops    uint64 // packets failed to be copied to shadow upstream
+}
+
+type ListenerStatus struct {
+	Name           string // unique name
+	ListenAddr     string // listening address
+	ListenParallel int    // number of upload workers
+	Steering       string // steering scheme of workers, empty if steered by kernel
+	Sessions       int    // number of sessions
+	RecvPackets    uint64 // packets recv from clients
+	RecvBytes      uint64 // bytes recv from clients
+	Drops          uint64 // packets dropped by route or because no upstream routed
+	Rejects        uint64 // packets rejected by route with reply sent
+	UploadFailures uint64 // packets dropped because upload to peers failed
+	MirrorPackets  uint64 // packets copied to shadow upstream
+	MirrorDrops    uint64 // packets failed to be copied to shadow upstream
+	ReplyPackets   uint64 // packets of upstreams sent back to clients
+}
+
+func (l *Listener) GetName() string {
+	return l.config.Name
+}
+
+// Return fd used to send replies to clients, which is the first listen fd
+// It is kept open until server exits
+func (l *Listener) replyFd() int {
+	return l.workers[0].fd
+}
+
+// Send reply to client from listen address
+func (l *Listener) sendReply(p []byte, to unix.Sockaddr) error {
+	if reply, ok := l.replySock.Load().(*sd_socket.ReplySocket); ok {
+		return reply.SendTo(p, to)
+	}
+	return sd_socket.SendTo(l.replyFd(), p, 0, to)
+}
+
+// Return snapshot of counters, sessions is number of sessions of listener
+func (l *Listener) Status(sessions int) *ListenerStatus {
+	status := &ListenerStatus{
+		Name:           l.config.Name,
+		ListenAddr:     l.config.ListenAddr,
+		ListenParallel: len(l.workers),
+		Steering:       l.config.Steering,
+		Sessions:       sessions,
+		ReplyPackets:   atomic.LoadUint64(&l.replyPackets),
+	}
+	for _, worker := range l.workers {
+		status.RecvPackets += atomic.LoadUint64(&worker.stats.recvPackets)
+		status.RecvBytes += atomic.LoadUint64(&worker.stats.recvBytes)
+		status.Drops += atomic.LoadUint64(&worker.stats.drops)
+		status.Rejects += atomic.LoadUint64(&worker.stats.rejects)
+		status.UploadFailures += atomic.LoadUint64(&worker.stats.uploadFailures)
+		status.MirrorPackets += atomic.LoadUint64(&worker.stats.mirrorPackets)
+		status.MirrorDrops += atomic.LoadUint64(&worker.stats.mirrorDrops)
+	}
+	return status
+}
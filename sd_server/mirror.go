@@ -0,0 +1,116 @@
+package sd_server
+
+import (
+	"context"
+	"github.com/near-notfaraway/stevedore/sd_session"
+	"github.com/near-notfaraway/stevedore/sd_socket"
+	"github.com/near-notfaraway/stevedore/sd_upstream"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"sync/atomic"
+)
+
+//------------------------------------------------------------------------------
+// Mirror: copy packets to shadow upstream without blocking upload worker
+//------------------------------------------------------------------------------
+
+// Max number of packets waiting to be mirrored by each upload worker, more are dropped
+const mirrorQueueSize = 256
+
+// Packet copied to be mirrored
+type mirrorTask struct {
+	sess     *sd_session.Session  // session which packet belongs to
+	upstream sd_upstream.Upstream // shadow upstream
+	buf      []byte               // buffer of packet
+	n        int                  // length of packet
+}
+
+// Mirror of upload worker, tasks are preallocated and reused
+type mirror struct {
+	free     chan *mirrorTask   // tasks can be used
+	queue    chan *mirrorTask   // tasks waiting to be mirrored
+	stats    *uploadStats       // counters of upload worker
+	register func(fd int) error // register shadow fd created
+}
+
+// Create mirror for upload worker and start sending until ctx canceled
+func (s *Server) startMirror(ctx context.Context, worker *UploadWorker) *mirror {
+	m := &mirror{
+		free:     make(chan *mirrorTask, mirrorQueueSize),
+		queue:    make(chan *mirrorTask, mirrorQueueSize),
+		stats:    &worker.stats,
+		register: s.registerShadow,
+	}
+	for i := 0; i < mirrorQueueSize; i++ {
+		m.free <- &mirrorTask{buf: make([]byte, s.config.Server.BufSize)}
+	}
+
+	go s.mirrorWorker(ctx, m)
+	return m
+}
+
+// Copy packet and queue it, drop it if queue is full, never blocks
+func (m *mirror) push(sess *sd_session.Session, upstream sd_upstream.Upstream, data []byte) {
+	select {
+	case task := <-m.free:
+		task.sess, task.upstream = sess, upstream
+		task.n = copy(task.buf, data)
+		m.queue <- task
+	default:
+		atomic.AddUint64(&m.stats.mirrorDrops, 1)
+	}
+}
+
+func (s *Server) mirrorWorker(ctx context.Context, m *mirror) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case task := <-m.queue:
+			if s.sendMirror(m, task) {
+				atomic.AddUint64(&m.stats.mirrorPackets, 1)
+			} else {
+				atomic.AddUint64(&m.stats.mirrorDrops, 1)
+			}
+			task.sess, task.upstream = nil, nil
+			m.free <- task
+		}
+	}
+}
+
+// Send packet to shadow peer through shadow fd of session, peer state is not changed if fails
+func (s *Server) sendMirror(m *mirror, task *mirrorTask) bool {
+	peer := task.upstream.SelectPeer(task.buf[:task.n], task.sess.GetHash(), task.sess.GetShadowPeer())
+	if peer == nil {
+		logrus.Debug("select shadow peer failed")
+		return false
+	}
+	if err := task.sess.SendShadow(peer, task.buf[:task.n], m.register); err != nil {
+		logrus.Debugf("send mirror failed: %v", err)
+		return false
+	}
+	task.sess.SetShadowPeer(peer)
+	return true
+}
+
+// Register shadow fd to selector, replies of shadow peer are read and discarded
+// Its handler is deleted with the one of session fd when session is closed
+func (s *Server) registerShadow(fd int) error {
+	s.fdReadHandlers.Store(fd, func() { discardPackets(fd) })
+	if err := s.selector.Add(fd, sd_socket.SelectorEventRead); err != nil {
+		s.fdReadHandlers.Delete(fd)
+		return err
+	}
+	return nil
+}
+
+// Read and discard all packets in socket until no packets
+func discardPackets(fd int) {
+	var buf [64]byte
+	for {
+		if _, _, err := unix.Recvfrom(fd, buf[:], unix.MSG_DONTWAIT|unix.MSG_TRUNC); err != nil {
+			return
+		}
+	}
+}
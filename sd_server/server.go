@@ -10,95 +10,238 @@ import (
 	"github.com/near-notfaraway/stevedore/sd_util"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
+	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type UploadWorker struct {
-	id int           // unique worker id
-	fd int           // fd of listened socket
-	ch chan struct{} // channel for recv upload event
+	stats    uploadStats   // counters of packets recv by worker
+	id       int           // unique worker id
+	fd       int           // fd of listened socket
+	ch       chan struct{} // channel for recv upload event
+	listener *Listener     // listener which worker belongs to
 }
 
 type Server struct {
-	config         *sd_config.Config            // global config
+	config         *sd_config.Config            // global config at start, read only, upload config is reloaded by upstreamMgr
+	configPath     string                       // config file path, used to reload
 	ctx            context.Context              // control context
-	workers        []*UploadWorker              // upload workers
+	cancel         context.CancelFunc           // stop polling
+	uploadCtx      context.Context              // control upload workers
+	uploadCancel   context.CancelFunc           // stop upload workers
+	uploadWg       sync.WaitGroup               // wait upload workers exit
+	shutdownOnce   sync.Once                    // shutdown once
+	lifecycleMu    sync.Mutex                   // serialize shutdown and upgrade
+	listeners      []*Listener                  // listeners in config order
+	workers        []*UploadWorker              // upload workers of all listeners
 	taskPool       sd_util.TaskPool             // task pool for deliver events
 	selector       sd_socket.Selector           // poll events from fds
 	fdReadHandlers sync.Map                     // map[int]func(): map fd and its read event handler
 	sessionMgr     *sd_session.Manager          // manage sessions
-	upstreamMgr    *sd_upstream.Manager         // manage upstreams
+	upstreamMgr    atomic.Value                 // *sd_upstream.Manager: manage upstreams, swapped when reload
+	reloadMu       sync.Mutex                   // serialize reload
 	mcPool         *sd_socket.MMsgContainerPool // allocate memory for recvmmsg
-	evChanPool     sync.Pool                    // allocate memory for event channel
+	evChanPool     *sync.Pool                   // allocate memory for event channel
 }
 
-func NewServer(config *sd_config.Config) *Server {
+func NewServer(config *sd_config.Config, configPath string) (*Server, error) {
+	upstreamMgr, err := newUpstreamManager(config)
+	if err != nil {
+		return nil, err
+	}
+
 	selector, err := sd_socket.NewEpoller(config.Server.EventSize, true)
 	if err != nil {
-		logrus.Panicf("create selector failed %v", err)
+		upstreamMgr.Close()
+		return nil, fmt.Errorf("create selector failed: %w", err)
 	}
 
-	evChanPool := sync.Pool{
+	evChanPool := &sync.Pool{
 		New: func() interface{} {
 			return make(chan struct{}, config.Server.EventChanSize)
 		},
 	}
 
-	return &Server{
-		config:      config,
-		workers:     make([]*UploadWorker, 0, config.Server.ListenParallel),
-		taskPool:    sd_util.NewSimpleTaskPool(config.Server.TaskPoolSize, config.Server.TaskPoolTimeoutSec),
-		selector:    selector,
-		sessionMgr:  sd_session.NewManager(config.Session, evChanPool, selector),
-		upstreamMgr: sd_upstream.NewManager(config.Upload),
-		mcPool:      sd_socket.NewMMsgContainerPool(config.Server.BatchSize, config.Server.BufSize),
-		evChanPool:  evChanPool,
+	ctx, cancel := context.WithCancel(context.Background())
+	uploadCtx, uploadCancel := context.WithCancel(ctx)
+	s := &Server{
+		ctx:          ctx,
+		cancel:       cancel,
+		uploadCtx:    uploadCtx,
+		uploadCancel: uploadCancel,
+		config:       config,
+		configPath:   configPath,
+		taskPool:     sd_util.NewSimpleTaskPool(config.Server.TaskPoolSize, config.Server.TaskPoolTimeoutSec),
+		selector:     selector,
+		mcPool:       sd_socket.NewMMsgContainerPool(config.Server.BatchSize, config.Server.BufSize),
+		evChanPool:   evChanPool,
 	}
+	s.sessionMgr = sd_session.NewManager(config.Session, evChanPool,
+		&sessionSelector{Selector: selector, handlers: &s.fdReadHandlers})
+	s.upstreamMgr.Store(upstreamMgr)
+	for _, listenerConfig := range config.GetListeners() {
+		s.listeners = append(s.listeners, &Listener{config: listenerConfig})
+	}
+
+	return s, nil
 }
 
-func (s *Server) ListenAndServe() error {
-	// build context
-	ctx, cancel := context.WithCancel(context.Background())
-	s.ctx = ctx
+// Selector used by sessions, read handlers of session fd and shadow fd are deleted when sessions are closed
+// Fds are deleted before closed, so that handlers of new fds reusing the same number are never deleted
+type sessionSelector struct {
+	sd_socket.Selector
+	handlers *sync.Map
+}
+
+func (s *sessionSelector) Del(fd int) error {
+	s.handlers.Delete(fd)
+	return s.Selector.Del(fd)
+}
 
-	// resolve addr
-	listenSa := sd_socket.ResolveUDPSockaddr(s.config.Server.ListenAddr)
-	if listenSa == nil {
-		return fmt.Errorf("resolve listen addr %s failed", s.config.Server.ListenAddr)
+// Create upstream manager with a router for each listener
+// Returns ErrorList contains all invalid fields with json path
+func newUpstreamManager(config *sd_config.Config) (*sd_upstream.Manager, error) {
+	mgr, err := sd_upstream.NewManager(config.Upload)
+	if err != nil {
+		return nil, sd_config.WithPath("Upload", err)
 	}
 
-	parallel := s.config.Server.ListenParallel
-	for i := 0; i < parallel; i++ {
-		ch := s.evChanPool.Get().(chan struct{})
-		fd, err := sd_socket.UDPBoundSocket(listenSa, true, true, true)
-		if err != nil {
-			return fmt.Errorf("create listen socket failed: %w", err)
+	for i, listenerConfig := range config.GetListeners() {
+		// routes of default listener are in upload config
+		path := "Upload"
+		if len(config.Server.Listeners) > 0 {
+			path = fmt.Sprintf("Server.Listeners[%d]", i)
+		}
+		if err = mgr.AddRouter(listenerConfig); err != nil {
+			mgr.Close()
+			return nil, sd_config.WithPath(path, err)
 		}
+	}
+	return mgr, nil
+}
 
-		logrus.Debugf("store fd %d", fd)
-		s.fdReadHandlers.Store(fd, func() { ch <- struct{}{} })
-		if err = s.selector.Add(fd, sd_socket.SelectorEventRead); err != nil {
-			s.fdReadHandlers.Delete(fd)
-			return fmt.Errorf("add listen conn to selector failed: %w", err)
+func (s *Server) getUpstreamMgr() *sd_upstream.Manager {
+	return s.upstreamMgr.Load().(*sd_upstream.Manager)
+}
+
+// Return listener by name, returns nil if not exists
+func (s *Server) getListener(name string) *Listener {
+	for _, listener := range s.listeners {
+		if listener.GetName() == name {
+			return listener
 		}
+	}
+	return nil
+}
 
-		worker := &UploadWorker{id: i, fd: fd, ch: ch}
-		s.workers = append(s.workers, worker)
-		go s.uploadWorker(ctx, worker)
+// Re-read config file and rebuild upstream manager according to upload config
+// Sessions are kept, the old manager is closed after swapped
+func (s *Server) Reload() error {
+	var config sd_config.Config
+	if err := sd_util.UnmarshalFile(s.configPath, &config); err != nil {
+		return fmt.Errorf("read config failed: %w", err)
+	}
+
+	return s.ReloadConfig(&config)
+}
+
+// Rebuild upstream manager according to upload config and routes of listeners, and swap it atomically
+// Listening addresses can not be changed by reload
+// Sessions are kept, the old manager is closed after swapped
+func (s *Server) ReloadConfig(config *sd_config.Config) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	if config.Server == nil || config.Upload == nil {
+		return fmt.Errorf("server or upload config is missing")
+	}
+	if err := s.checkListenersUnchanged(config.GetListeners()); err != nil {
+		return err
+	}
+
+	newMgr, err := newUpstreamManager(config)
+	if err != nil {
+		return fmt.Errorf("build upstream manager failed: %w", err)
+	}
+
+	// swap manager, upload workers will use new manager for next packets
+	// config is only published through manager, because config of server is read by workers without lock
+	oldMgr := s.getUpstreamMgr()
+	s.upstreamMgr.Store(newMgr)
+	oldMgr.Close()
+
+	logrus.Info("reload upload config succeed")
+	return nil
+}
+
+// Return error if listeners are added, removed, listen on other address or change steering
+func (s *Server) checkListenersUnchanged(configs []*sd_config.ListenerConfig) error {
+	if len(configs) != len(s.listeners) {
+		return fmt.Errorf("listeners can not be added or removed by reload")
+	}
+	for i, config := range configs {
+		old := s.listeners[i].config
+		if config.Name != old.Name || config.ListenAddr != old.ListenAddr {
+			return fmt.Errorf("listener %s on %s can not be changed to %s on %s by reload",
+				old.Name, old.ListenAddr, config.Name, config.ListenAddr)
+		}
+		if config.Steering != old.Steering || config.SteeringKeyBytes != old.SteeringKeyBytes {
+			return fmt.Errorf("steering of listener %s can not be changed by reload", old.Name)
+		}
+	}
+	return nil
+}
+
+func (s *Server) ListenAndServe() error {
+	defer s.cancel()
+
+	// take over listen fds and sessions from old process when upgrading
+	handoffFd := -1
+	var listenFds map[string][]int
+	if path := os.Getenv(UpgradeSockEnv); path != "" {
+		fd, fds, err := s.takeOver(path)
+		if err != nil {
+			return fmt.Errorf("take over from old process failed: %w", err)
+		}
+		handoffFd, listenFds = fd, fds
 	}
 
 	// 关闭服务
 	defer func() {
-		for i := 0; i < parallel; i++ {
-			s.evChanPool.Put(s.workers[i].ch)
-			_ = unix.Close(s.workers[i].fd)
+		for _, worker := range s.workers {
+			s.evChanPool.Put(worker.ch)
+			if worker.fd >= 0 {
+				_ = unix.Close(worker.fd)
+			}
+		}
+		if err := s.selector.Close(); err != nil {
+			logrus.Errorf("close selector failed: %v", err)
 		}
-		cancel()
 	}()
 
-	// 开始 polling
+	// start upload workers of each listener
+	for _, listener := range s.listeners {
+		inherited := listenFds[listener.GetName()]
+		delete(listenFds, listener.GetName())
+		if err := s.startListener(listener, inherited); err != nil {
+			return fmt.Errorf("start listener %s failed: %w", listener.GetName(), err)
+		}
+	}
+	for name, fds := range listenFds {
+		logrus.Warnf("close %d inherited listen fds of unknown listener %s", len(fds), name)
+		closeFds(fds)
+	}
+
+	// tell old process to exit
+	if handoffFd >= 0 {
+		s.finishTakeOver(handoffFd)
+	}
+
+	// 开始 polling, returns nil after shutdown
 	logrus.Debug("start polling...")
-	return s.selector.Polling(ctx, func(evs []unix.EpollEvent) {
+	return s.selector.Polling(s.ctx, func(evs []unix.EpollEvent) {
 		for i := 0; i < len(evs); i++ {
 			fs, ok := s.fdReadHandlers.Load(int(evs[i].Fd))
 			if !ok {
@@ -113,3 +256,160 @@ func (s *Server) ListenAndServe() error {
 		}
 	})
 }
+
+// Shutdown server gracefully, make ListenAndServe returns nil finally
+// - stop recv packets from listen sockets and stop upload workers
+// - sessions keep getting downstream replies until grace period passed or all sessions recycled
+// - close all sessions and upstreams, then stop polling
+func (s *Server) Shutdown(grace time.Duration) {
+	s.shutdownOnce.Do(func() {
+		s.shutdown(grace)
+	})
+}
+
+func (s *Server) shutdown(grace time.Duration) {
+	s.lifecycleMu.Lock()
+	defer s.lifecycleMu.Unlock()
+	if s.ctx.Err() != nil {
+		return
+	}
+
+	// stop upload
+	logrus.Info("shutdown: stop upload")
+	s.stopUpload()
+
+	// close listen sockets, the first one of each listener is kept as reply socket to send downstream replies,
+	// it gets no packets any more, so that packets of new clients go to other processes listening on the address
+	for _, listener := range s.listeners {
+		reply, err := sd_socket.NewReplySocket(listener.replyFd())
+		if err != nil {
+			logrus.Errorf("create reply socket of listener %s failed: %v", listener.GetName(), err)
+		} else {
+			listener.replySock.Store(reply)
+		}
+		for i := 1; i < len(listener.workers); i++ {
+			if err := unix.Close(listener.workers[i].fd); err != nil {
+				logrus.Errorf("close listen fd failed: %v", err)
+			}
+			listener.workers[i].fd = -1
+		}
+	}
+
+	// wait for grace period, return early if all sessions recycled
+	logrus.Infof("shutdown: wait %v for %d sessions getting replies", grace, s.sessionMgr.Count())
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+wait:
+	for s.sessionMgr.Count() > 0 {
+		select {
+		case <-timer.C:
+			break wait
+		case <-tick.C:
+		}
+	}
+
+	// close sessions and upstreams, then stop polling
+	logrus.Info("shutdown: close sessions and upstreams")
+	s.sessionMgr.Close()
+	s.getUpstreamMgr().Close()
+	s.cancel()
+	if err := s.selector.Wakeup(); err != nil {
+		logrus.Errorf("wakeup selector failed: %v", err)
+	}
+}
+
+// Start upload workers of listener, inherited listen fds are all kept, create new ones if not enough
+func (s *Server) startListener(listener *Listener, inherited []int) error {
+	parallel := listener.config.ListenParallel
+	if len(inherited) > parallel {
+		parallel = len(inherited)
+	}
+
+	// sessions of listener are split into shards as many as its workers, including restored ones
+	if err := s.sessionMgr.AddListener(listener.config.Name, parallel); err != nil {
+		return err
+	}
+	for i := 0; i < parallel; i++ {
+		var fd int
+		if i < len(inherited) {
+			fd = inherited[i]
+		} else {
+			// resolve addr
+			listenSa := sd_socket.ResolveUDPSockaddr(listener.config.ListenAddr)
+			if listenSa == nil {
+				return fmt.Errorf("resolve listen addr %s failed", listener.config.ListenAddr)
+			}
+
+			var err error
+			if fd, err = sd_socket.UDPBoundSocket(listenSa, true, true, true); err != nil {
+				return fmt.Errorf("create listen socket failed: %w", err)
+			}
+		}
+
+		worker := &UploadWorker{
+			id:       len(s.workers),
+			fd:       fd,
+			ch:       s.evChanPool.Get().(chan struct{}),
+			listener: listener,
+		}
+		s.workers = append(s.workers, worker)
+		listener.workers = append(listener.workers, worker)
+		if err := s.startUploadWorker(worker); err != nil {
+			return err
+		}
+	}
+
+	// steer packets among workers, inherited fds are in the same order as in reuseport group
+	if prog := steeringProgram(listener.config, len(listener.workers)); prog != nil {
+		if err := sd_socket.AttachReuseportProgram(listener.replyFd(), prog); err != nil {
+			return fmt.Errorf("attach %s steering failed: %w", listener.config.Steering, err)
+		}
+	}
+	return nil
+}
+
+// Return reuseport program of listener, returns nil if steering by kernel
+func steeringProgram(config *sd_config.ListenerConfig, n int) []unix.SockFilter {
+	switch config.Steering {
+	case sd_config.SteeringClient:
+		return sd_socket.ClientSteeringProgram(n)
+	case sd_config.SteeringPayload:
+		start, end, _ := config.GetSteeringKeyBytes()
+		return sd_socket.PayloadSteeringProgram(start, end, n)
+	}
+	return nil
+}
+
+// Register listen fd of worker to selector and start upload worker
+func (s *Server) startUploadWorker(worker *UploadWorker) error {
+	logrus.Debugf("store fd %d", worker.fd)
+	ch := worker.ch
+	s.fdReadHandlers.Store(worker.fd, func() { ch <- struct{}{} })
+	if err := s.selector.Add(worker.fd, sd_socket.SelectorEventRead); err != nil {
+		s.fdReadHandlers.Delete(worker.fd)
+		return fmt.Errorf("add listen conn to selector failed: %w", err)
+	}
+
+	ctx := s.uploadCtx
+	s.uploadWg.Add(1)
+	go func() {
+		defer s.uploadWg.Done()
+		s.uploadWorker(ctx, worker)
+	}()
+	return nil
+}
+
+// Unregister listen fds from selector and wait upload workers exit
+// Upload workers can be started again after upload ctx renewed
+func (s *Server) stopUpload() {
+	for _, worker := range s.workers {
+		s.fdReadHandlers.Delete(worker.fd)
+		if err := s.selector.Del(worker.fd); err != nil {
+			logrus.Errorf("delete listen fd from selector failed: %v", err)
+		}
+	}
+	s.uploadCancel()
+	s.uploadWg.Wait()
+}
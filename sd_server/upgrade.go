@@ -0,0 +1,382 @@
+package sd_server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/near-notfaraway/stevedore/sd_config"
+	"github.com/near-notfaraway/stevedore/sd_session"
+	"github.com/near-notfaraway/stevedore/sd_socket"
+	"github.com/near-notfaraway/stevedore/sd_upstream"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"os"
+	"os/exec"
+	"time"
+)
+
+//------------------------------------------------------------------------------
+// Upgrade: hand over listen fds and sessions to new process without downtime
+//------------------------------------------------------------------------------
+
+// Env var tells new process the unix socket path to take over from
+const UpgradeSockEnv = "STEVEDORE_UPGRADE_SOCK"
+
+const (
+	upgradeTimeoutSec = 10        // timeout of waiting new process and each handoff message
+	handoffBufSize    = 64 * 1024 // max size of a handoff message
+)
+
+// Session handed over, its fd is attached in the same order
+// Upstream, peer and sticky route are resolved by name in new process, which routes session again if not exists
+type handoffSession struct {
+	Listener string `json:",omitempty"` // name of listener, empty means default listener
+	Name     []byte // raw sockaddr of client, converted to sockaddr by new process
+	Upstream string `json:",omitempty"` // name of upstream of last peer
+	Peer     string `json:",omitempty"` // addr of last peer
+	Sticky   bool   `json:",omitempty"` // if session keeps route and upstream
+	Route    int    `json:",omitempty"` // id of route kept by session
+}
+
+// Message sent through unix socket, one of ListenFds, Sessions and Done is set
+// - old process sends listen fds of each listener first, then sessions in chunks, then done
+// - new process replies done after all upload workers started
+type handoffMsg struct {
+	Listener  string            `json:",omitempty"` // name of listener whose listen fds attached
+	ListenFds int               `json:",omitempty"` // number of listen fds attached
+	Sessions  []*handoffSession `json:",omitempty"` // sessions whose fds attached
+	Done      bool              `json:",omitempty"` // handoff finished
+}
+
+// Start new process of current executable, and hand over listen fds and sessions to it
+// Server keeps serving if fails, otherwise makes ListenAndServe returns nil
+func (s *Server) Upgrade() error {
+	s.lifecycleMu.Lock()
+	defer s.lifecycleMu.Unlock()
+	if s.ctx.Err() != nil {
+		return fmt.Errorf("server is closed")
+	}
+
+	path := s.config.Server.UpgradeSockPath
+	if path == "" {
+		return fmt.Errorf("upgrade sock path is not configured")
+	}
+	lfd, err := sd_socket.UnixSeqpacketListen(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = unix.Close(lfd)
+		_ = os.Remove(path)
+	}()
+
+	// start new process and wait it connecting
+	cmd, exitCh, err := startNewProcess(path)
+	if err != nil {
+		return fmt.Errorf("start new process failed: %w", err)
+	}
+	conn, err := acceptNewProcess(lfd, exitCh)
+	if err != nil {
+		killNewProcess(cmd, exitCh)
+		return fmt.Errorf("wait new process failed: %w", err)
+	}
+	defer func() { _ = unix.Close(conn) }()
+
+	// stop serving, then hand over
+	logrus.Infof("upgrade: hand over to new process %d", cmd.Process.Pid)
+	s.pauseForHandOver()
+	if err = s.handOver(conn); err == nil {
+		err = waitHandoffDone(conn)
+	}
+	if err != nil {
+		killNewProcess(cmd, exitCh)
+		s.resumeAfterHandOver()
+		return fmt.Errorf("hand over to new process failed: %w", err)
+	}
+
+	// new process has taken over, stop polling
+	logrus.Infof("upgrade: new process %d has taken over", cmd.Process.Pid)
+	s.cancel()
+	if err = s.selector.Wakeup(); err != nil {
+		logrus.Errorf("wakeup selector failed: %v", err)
+	}
+	return nil
+}
+
+// Start current executable with the same args, returns channel closed when it exits
+func startNewProcess(path string) (*exec.Cmd, <-chan struct{}, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), UpgradeSockEnv+"="+path)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err = cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+
+	exitCh := make(chan struct{})
+	go func() {
+		_ = cmd.Wait()
+		close(exitCh)
+	}()
+	return cmd, exitCh, nil
+}
+
+func killNewProcess(cmd *exec.Cmd, exitCh <-chan struct{}) {
+	_ = cmd.Process.Kill()
+	<-exitCh
+}
+
+// Accept connection from new process, returns err if timeout or new process exits
+func acceptNewProcess(lfd int, exitCh <-chan struct{}) (int, error) {
+	deadline := time.Now().Add(time.Second * upgradeTimeoutSec)
+	pfds := []unix.PollFd{{Fd: int32(lfd), Events: unix.POLLIN}}
+	for time.Now().Before(deadline) {
+		select {
+		case <-exitCh:
+			return -1, fmt.Errorf("new process exited")
+		default:
+		}
+
+		n, err := unix.Poll(pfds, 100)
+		if err == unix.EINTR || n == 0 {
+			continue
+		}
+		if err != nil {
+			return -1, err
+		}
+
+		conn, _, err := unix.Accept4(lfd, unix.SOCK_CLOEXEC)
+		if err != nil {
+			return -1, err
+		}
+		if err = sd_socket.SetSocketTimeout(conn, upgradeTimeoutSec, upgradeTimeoutSec); err != nil {
+			_ = unix.Close(conn)
+			return -1, err
+		}
+		return conn, nil
+	}
+	return -1, fmt.Errorf("timeout")
+}
+
+// Stop upload and session recycle, unregister session fds, so that fds are not used any more
+func (s *Server) pauseForHandOver() {
+	s.stopUpload()
+	s.sessionMgr.PauseRecycle()
+	for _, sess := range s.sessionMgr.Sessions() {
+		if err := s.selector.Del(sess.GetFD()); err != nil {
+			logrus.Errorf("delete session fd from selector failed: %v", err)
+		}
+	}
+}
+
+// Serve again after hand over failed
+func (s *Server) resumeAfterHandOver() {
+	for _, sess := range s.sessionMgr.Sessions() {
+		if err := s.selector.Add(sess.GetFD(), sd_socket.SelectorEventRead); err != nil {
+			logrus.Errorf("add session fd to selector failed: %v", err)
+		}
+	}
+	s.sessionMgr.ResumeRecycle()
+
+	s.uploadCtx, s.uploadCancel = context.WithCancel(s.ctx)
+	for _, worker := range s.workers {
+		if err := s.startUploadWorker(worker); err != nil {
+			logrus.Errorf("restart upload worker %d failed: %v", worker.id, err)
+		}
+	}
+}
+
+// Send listen fds and sessions to new process
+func (s *Server) handOver(conn int) error {
+	for _, listener := range s.listeners {
+		listenFds := make([]int, 0, len(listener.workers))
+		for _, worker := range listener.workers {
+			listenFds = append(listenFds, worker.fd)
+		}
+		msg := &handoffMsg{Listener: listener.GetName(), ListenFds: len(listenFds)}
+		if err := sendHandoffMsg(conn, msg, listenFds); err != nil {
+			return fmt.Errorf("send listen fds of listener %s failed: %w", listener.GetName(), err)
+		}
+	}
+
+	upstreamMgr := s.getUpstreamMgr()
+	sessions := s.sessionMgr.Sessions()
+	for i := 0; i < len(sessions); i += sd_socket.MaxFdsPerMsg {
+		chunk := sessions[i:]
+		if len(chunk) > sd_socket.MaxFdsPerMsg {
+			chunk = chunk[:sd_socket.MaxFdsPerMsg]
+		}
+
+		msg := &handoffMsg{Sessions: make([]*handoffSession, 0, len(chunk))}
+		fds := make([]int, 0, len(chunk))
+		for _, sess := range chunk {
+			msg.Sessions = append(msg.Sessions, newHandoffSession(sess, upstreamMgr))
+			fds = append(fds, sess.GetFD())
+		}
+		if err := sendHandoffMsg(conn, msg, fds); err != nil {
+			return fmt.Errorf("send sessions failed: %w", err)
+		}
+	}
+
+	logrus.Infof("upgrade: %d listen fds and %d sessions are handed over", len(s.workers), len(sessions))
+	return sendHandoffMsg(conn, &handoffMsg{Done: true}, nil)
+}
+
+// Return handoff of session, sticky route is kept only if its upstream is the same as last peer
+func newHandoffSession(sess *sd_session.Session, upstreamMgr *sd_upstream.Manager) *handoffSession {
+	hs := &handoffSession{
+		Listener: sess.GetListener(),
+		Name:     []byte(sess.GetName()),
+		Upstream: sess.GetPeerUpstream(),
+	}
+	if peer := sess.GetPeer(); peer != nil {
+		hs.Peer = peer.GetAddr()
+	}
+	if route, upstream, ok := sess.GetStickyRoute(upstreamMgr); ok && upstream.GetName() == hs.Upstream {
+		hs.Sticky, hs.Route = true, route.GetId()
+	}
+	return hs
+}
+
+func waitHandoffDone(conn int) error {
+	msg, fds, err := recvHandoffMsg(conn, make([]byte, handoffBufSize))
+	closeFds(fds)
+	if err != nil {
+		return err
+	}
+	if !msg.Done {
+		return fmt.Errorf("unexpected message from new process")
+	}
+	return nil
+}
+
+// Take over listen fds and sessions from old process listening on path
+// Returns connection used to finish take over and listen fds of each listener
+func (s *Server) takeOver(path string) (int, map[string][]int, error) {
+	conn, err := sd_socket.UnixSeqpacketDial(path)
+	if err != nil {
+		return -1, nil, err
+	}
+	if err = sd_socket.SetSocketTimeout(conn, upgradeTimeoutSec, upgradeTimeoutSec); err != nil {
+		_ = unix.Close(conn)
+		return -1, nil, err
+	}
+
+	listenFds := make(map[string][]int)
+	nListenFds, count := 0, 0
+	buf := make([]byte, handoffBufSize)
+	for {
+		msg, fds, err := recvHandoffMsg(conn, buf)
+		if err != nil {
+			_ = unix.Close(conn)
+			for _, fds := range listenFds {
+				closeFds(fds)
+			}
+			return -1, nil, err
+		}
+
+		switch {
+		case msg.Done:
+			logrus.Infof("upgrade: take over %d listen fds and %d sessions", nListenFds, count)
+			return conn, listenFds, nil
+
+		case msg.ListenFds > 0:
+			name := handoffListener(msg.Listener)
+			listenFds[name] = append(listenFds[name], fds...)
+			nListenFds += len(fds)
+
+		default:
+			if len(fds) != len(msg.Sessions) {
+				closeFds(fds)
+				logrus.Errorf("number of session fds %d mismatch with sessions %d", len(fds), len(msg.Sessions))
+				continue
+			}
+			for i, hs := range msg.Sessions {
+				if err = s.restoreSession(hs, fds[i]); err != nil {
+					logrus.Errorf("restore session failed: %v", err)
+					continue
+				}
+				count++
+			}
+		}
+	}
+}
+
+// Tell old process that take over is finished
+func (s *Server) finishTakeOver(conn int) {
+	if err := sendHandoffMsg(conn, &handoffMsg{Done: true}, nil); err != nil {
+		logrus.Errorf("finish take over failed: %v", err)
+	}
+	_ = unix.Close(conn)
+	_ = os.Unsetenv(UpgradeSockEnv)
+}
+
+// Return listener name in handoff message, old process without listeners sends empty name
+func handoffListener(name string) string {
+	if name == "" {
+		return sd_config.DefaultListenerName
+	}
+	return name
+}
+
+// Restore session with its fd handed over, closes fd if fails
+func (s *Server) restoreSession(hs *handoffSession, fd int) error {
+	listener := handoffListener(hs.Listener)
+	if s.getListener(listener) == nil {
+		_ = unix.Close(fd)
+		return fmt.Errorf("listener %s of session not exists", listener)
+	}
+	sa := sd_socket.NameBufferToSockaddr(hs.Name, uint32(len(hs.Name)))
+	if sa == nil {
+		_ = unix.Close(fd)
+		return fmt.Errorf("invalid session name %x", hs.Name)
+	}
+
+	sess, err := s.sessionMgr.RestoreSession(listener, string(hs.Name), sa, fd)
+	if err != nil {
+		_ = unix.Close(fd)
+		return err
+	}
+	sess.RestoreRoute(s.getUpstreamMgr(), hs.Upstream, hs.Peer, hs.Sticky, hs.Route)
+	return s.registerSession(sess)
+}
+
+func sendHandoffMsg(conn int, msg *handoffMsg, fds []int) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if len(data) > handoffBufSize {
+		return fmt.Errorf("handoff message is too large")
+	}
+	return sd_socket.SendFds(conn, data, fds)
+}
+
+func recvHandoffMsg(conn int, buf []byte) (*handoffMsg, []int, error) {
+	n, fds, err := sd_socket.RecvFds(conn, buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	if n == 0 {
+		closeFds(fds)
+		return nil, nil, fmt.Errorf("connection closed by peer")
+	}
+
+	msg := &handoffMsg{}
+	if err = json.Unmarshal(buf[:n], msg); err != nil {
+		closeFds(fds)
+		return nil, nil, fmt.Errorf("decode handoff message failed: %w", err)
+	}
+	return msg, fds, nil
+}
+
+func closeFds(fds []int) {
+	for _, fd := range fds {
+		_ = unix.Close(fd)
+	}
+}
@@ -7,14 +7,25 @@ import (
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
 	"os"
+	"sync/atomic"
 )
 
 func (s *Server) uploadWorker(ctx context.Context, worker *UploadWorker) {
 	// init logger for upload worker
-	logger := logrus.WithField("work_id", worker.id)
+	listener := worker.listener.GetName()
+	logger := logrus.WithFields(logrus.Fields{"work_id": worker.id, "listener": listener})
 	logger.Debug("init upload worker")
 	mc := s.mcPool.GetMMsgContainerFromPool()
 	defer s.mcPool.PutMMsgContainerToPool(mc)
+	pkt := &sd_upstream.Packet{}
+
+	// router of listener, got again when manager swapped by reload
+	// packets are routed before getting session, so that dropped packets create no session
+	var upstreamMgr *sd_upstream.Manager
+	var router *sd_upstream.Router
+
+	// created when the first packet mirrored
+	var mirror *mirror
 
 	logger.Debug("wait for read event until ctx canceled")
 	for {
@@ -43,15 +54,71 @@ func (s *Server) uploadWorker(ctx context.Context, worker *UploadWorker) {
 					buf := mc.GetBufOfMsg(i)
 					rName := mc.GetRNamesOfMsg(i)
 					rSockaddr := mc.GetRSockaddrOfMsg(i)
+					atomic.AddUint64(&worker.stats.recvPackets, 1)
+					atomic.AddUint64(&worker.stats.recvBytes, uint64(nr))
 					logger.Debugf("packet info: remote addr is %v, data is %v",
 						sd_socket.SockaddrToUDPAddr(rSockaddr).String(), buf[:nr])
 
+					// get route, manager may be swapped by reload
+					if mgr := s.getUpstreamMgr(); mgr != upstreamMgr {
+						upstreamMgr, router = mgr, mgr.GetRouter(listener)
+					}
+					if router == nil {
+						atomic.AddUint64(&worker.stats.drops, 1)
+						logger.Debug("router of listener not exists, drop packet")
+						continue
+					}
+					pkt.Set(buf[:nr], rSockaddr)
+
+					// sticky session reuses route decision of its first packet, which is resolved again after manager swapped
+					var route *sd_upstream.Route
+					var upstream sd_upstream.Upstream
+					sticky := false
+					sess := s.sessionMgr.GetSession(listener, rName, rSockaddr)
+					if sess != nil {
+						route, upstream, sticky = sess.GetStickyRoute(upstreamMgr)
+					}
+					if !sticky {
+						route = router.Match(pkt)
+					}
+
+					// drop or reject packet without creating session
+					switch route.GetAction() {
+					case sd_upstream.RouteActionDrop:
+						atomic.AddUint64(&worker.stats.drops, 1)
+						logger.Debug("drop packet by route")
+						continue
+
+					case sd_upstream.RouteActionReject:
+						reply, ok := route.Reply(pkt)
+						if !ok {
+							atomic.AddUint64(&worker.stats.drops, 1)
+							logger.Debug("build reply of rejected packet failed, drop packet")
+							continue
+						}
+						if err := sd_socket.SendTo(worker.fd, reply, 0, rSockaddr); err != nil {
+							logger.Errorf("send reply of rejected packet failed: %v", err)
+							continue
+						}
+						atomic.AddUint64(&worker.stats.rejects, 1)
+						logger.Debug("reject packet by route")
+						continue
+					}
+
+					if !sticky {
+						upstream = router.GetUpstream(route, pkt)
+					}
+					if upstream == nil {
+						atomic.AddUint64(&worker.stats.drops, 1)
+						logger.Debug("can not route upstream, drop packet")
+						continue
+					}
+
 					// get session or create session
-					sess := s.sessionMgr.GetSession(rName)
 					if sess == nil {
 						logger.Debugf("try create new session for packet")
 						var got bool
-						_sess, got, err := s.sessionMgr.GetOrCreateSession(rName, rSockaddr)
+						_sess, got, err := s.sessionMgr.GetOrCreateSession(listener, rName, rSockaddr)
 						if err != nil {
 							logger.Errorf("create session failed: %v", err)
 							continue
@@ -59,14 +126,10 @@ func (s *Server) uploadWorker(ctx context.Context, worker *UploadWorker) {
 
 						if !got {
 							logger.Debugf("init new session %p for packet", _sess)
-
-							s.fdReadHandlers.Store(_sess.GetFD(), func() { _sess.GetCh() <- struct{}{} })
-							if err = s.selector.Add(_sess.GetFD(), sd_socket.SelectorEventRead); err != nil {
-								logger.Errorf("add selector for session failed: %v", err)
-								s.fdReadHandlers.Delete(_sess.GetFD())
+							if err = s.registerSession(_sess); err != nil {
+								logger.Error(err)
 								continue
 							}
-							go s.downloadWorker(_sess.GetCtx(), _sess)
 
 						} else {
 							logger.Debugf("session %p for packet is existed", _sess)
@@ -77,17 +140,14 @@ func (s *Server) uploadWorker(ctx context.Context, worker *UploadWorker) {
 						logger.Debugf("session %p for packet is existed", sess)
 					}
 
-					// get upstream
-					upstream := s.upstreamMgr.RouteUpstream(buf[:nr])
-					if upstream == nil {
-						logger.Info("can not route upstream")
-						continue
-					}
-
 					logger.Debugf("try to get peer and send data to it")
 					succeed := false
 					for try := 0; try < s.config.Server.MaxTryTimes; try++ {
-						peer := upstream.SelectPeer(buf[:nr])
+						// sticky session skips peer selection while its peer is available
+						peer := sess.GetPeer()
+						if !sticky || try > 0 || peer == nil || !peer.IsAvailable() {
+							peer = upstream.SelectPeer(buf[:nr], sess.GetHash(), peer)
+						}
 						if peer == nil {
 							logrus.Errorf("select peer failed")
 							continue
@@ -95,22 +155,33 @@ func (s *Server) uploadWorker(ctx context.Context, worker *UploadWorker) {
 
 						err := peer.Send(sess.GetFD(), buf[:nr])
 						if err != nil {
-							logrus.Warnf("upload to peer %s succeed", peer.GetAddr())
-							if err != unix.EAGAIN && err != unix.EWOULDBLOCK {
-								peer.SetState(sd_upstream.PeerDead)
+							logrus.Warnf("upload to peer %s failed: %v", peer.GetAddr(), err)
+							if err != unix.EAGAIN && err != unix.EWOULDBLOCK && peer.MarkDead() {
 								upstream.ResetPeers()
 							}
 							continue
 						}
 
 						logrus.Debugf("upload to peer %s succeed", peer.GetAddr())
+						sess.SetPeer(upstream, peer)
 						succeed = true
 						break
 					}
 
 					// upload failed
 					if !succeed {
+						atomic.AddUint64(&worker.stats.uploadFailures, 1)
 						logrus.Error("upload packet failed, drop it")
+					} else if !sticky && route.IsSticky() {
+						sess.SetStickyRoute(upstreamMgr, route, upstream)
+					}
+
+					// copy packet to shadow upstream if session sampled, never blocks
+					if shadow := router.GetMirrorUpstream(route); shadow != nil && route.MirrorSampled(sess.GetHash()) {
+						if mirror == nil {
+							mirror = s.startMirror(ctx, worker)
+						}
+						mirror.push(sess, shadow, buf[:nr])
 					}
 				}
 			}
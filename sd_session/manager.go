@@ -6,49 +6,172 @@ import (
 	"github.com/near-notfaraway/stevedore/sd_socket"
 	"golang.org/x/sys/unix"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Manager struct {
 	recycleInterval time.Duration      // time interval of recycle session
 	timeoutSec      int64              // timeout for recycle session
-	sessions        sync.Map           // map[string]*Session
-	evChanPool      sync.Pool          // allocate event chan
+	sessions        sync.Map           // map[sessionKey]*Session, sessions of listeners not added
+	shards          atomic.Value       // map[string][]*sync.Map, session shards of each listener, copied on add
+	shardsMu        sync.Mutex         // held when adding shards
+	evChanPool      *sync.Pool         // allocate event chan
 	selector        sd_socket.Selector // unregister fd when recycle
+	stopCh          chan struct{}      // stop recycle
+	stopOnce        sync.Once          // close stop channel once
+	recycleMu       sync.Mutex         // held by recycle, used to pause recycle
 }
 
-func NewManager(config *sd_config.SessionConfig, evChanPool sync.Pool, selector sd_socket.Selector) *Manager {
+// Sessions are distinguished by listener and downstream address
+type sessionKey struct {
+	listener string
+	name     string
+}
+
+func NewManager(config *sd_config.SessionConfig, evChanPool *sync.Pool, selector sd_socket.Selector) *Manager {
 	m := &Manager{
 		recycleInterval: time.Second * time.Duration(config.RecycleIntervalSec),
 		timeoutSec:      config.TimeoutSec,
 		evChanPool:      evChanPool,
 		selector:        selector,
+		stopCh:          make(chan struct{}),
 	}
+	m.shards.Store(make(map[string][]*sync.Map))
 	go m.sessionRecycle()
 
 	return m
 }
 
+// Split sessions of listener into n shards by client address, so that each upload worker owns a shard
+// when listener steers packets by client, sessions of listener already existed are moved into shards
+// Called before upload workers of listener start, returns err if shards of listener are added
+func (m *Manager) AddListener(listener string, n int) error {
+	m.shardsMu.Lock()
+	defer m.shardsMu.Unlock()
+	old := m.shards.Load().(map[string][]*sync.Map)
+	if _, ok := old[listener]; ok {
+		return fmt.Errorf("shards of listener %s are existed", listener)
+	}
+
+	shards := make(map[string][]*sync.Map, len(old)+1)
+	for name, listenerShards := range old {
+		shards[name] = listenerShards
+	}
+	for i := 0; i < n; i++ {
+		shards[listener] = append(shards[listener], &sync.Map{})
+	}
+
+	// pause recycle, so that sessions moved are not closed
+	m.recycleMu.Lock()
+	defer m.recycleMu.Unlock()
+	m.sessions.Range(func(k, v interface{}) bool {
+		if sess := v.(*Session); sess.GetListener() == listener {
+			shards[listener][sd_socket.ClientHash(sess.GetSockaddr())%uint32(n)].Store(k, sess)
+			m.sessions.Delete(k)
+		}
+		return true
+	})
+	m.shards.Store(shards)
+	return nil
+}
+
+// Return shard which session of client belongs to
+func (m *Manager) shard(listener string, sa unix.Sockaddr) *sync.Map {
+	shards, ok := m.shards.Load().(map[string][]*sync.Map)[listener]
+	if !ok {
+		return &m.sessions
+	}
+	return shards[sd_socket.ClientHash(sa)%uint32(len(shards))]
+}
+
+// Call f with each session until f returns false
+func (m *Manager) rangeSessions(f func(shard *sync.Map, key sessionKey, sess *Session) bool) {
+	shards := []*sync.Map{&m.sessions}
+	for _, listenerShards := range m.shards.Load().(map[string][]*sync.Map) {
+		shards = append(shards, listenerShards...)
+	}
+
+	for _, shard := range shards {
+		ok := true
+		shard.Range(func(k, v interface{}) bool {
+			ok = f(shard, k.(sessionKey), v.(*Session))
+			return ok
+		})
+		if !ok {
+			return
+		}
+	}
+}
+
 func (m *Manager) sessionRecycle() {
 	tick := time.NewTicker(m.recycleInterval)
-	for range tick.C {
-		m.sessions.Range(func(k, v interface{}) bool {
-			key := k.(string)
-			sess := v.(*Session)
+	defer tick.Stop()
+	for {
+		select {
+		case <-m.stopCh:
+			return
+		case <-tick.C:
+		}
+
+		m.recycleMu.Lock()
+		m.rangeSessions(func(shard *sync.Map, key sessionKey, sess *Session) bool {
 			// delete expired session
 			if time.Now().Unix()-sess.LastActive() > m.timeoutSec {
-				m.sessions.Delete(key)
+				shard.Delete(key)
 				sess.Close(m.selector, m.evChanPool)
 			}
 			return true
 		})
+		m.recycleMu.Unlock()
 	}
 }
 
-func (m *Manager) GetOrCreateSession(name string, sa unix.Sockaddr) (*Session, bool, error) {
+// Pause recycle, so that sessions are not closed until resume
+func (m *Manager) PauseRecycle() {
+	m.recycleMu.Lock()
+}
+
+func (m *Manager) ResumeRecycle() {
+	m.recycleMu.Unlock()
+}
+
+// Return number of sessions
+func (m *Manager) Count() int {
+	count := 0
+	m.rangeSessions(func(shard *sync.Map, key sessionKey, sess *Session) bool {
+		count++
+		return true
+	})
+	return count
+}
+
+// Return number of sessions of each listener
+func (m *Manager) CountByListener() map[string]int {
+	counts := make(map[string]int)
+	m.rangeSessions(func(shard *sync.Map, key sessionKey, sess *Session) bool {
+		counts[key.listener]++
+		return true
+	})
+	return counts
+}
+
+// Stop recycle and close all sessions
+func (m *Manager) Close() {
+	m.stopOnce.Do(func() { close(m.stopCh) })
+	m.rangeSessions(func(shard *sync.Map, key sessionKey, sess *Session) bool {
+		shard.Delete(key)
+		sess.Close(m.selector, m.evChanPool)
+		return true
+	})
+}
+
+func (m *Manager) GetOrCreateSession(listener, name string, sa unix.Sockaddr) (*Session, bool, error) {
 	// try to create new session
-	sess := NewSession(name, sa)
-	actualSess, loaded := m.sessions.LoadOrStore(name, sess)
+	key := sessionKey{listener: listener, name: name}
+	shard := m.shard(listener, sa)
+	sess := NewSession(listener, name, sa)
+	actualSess, loaded := shard.LoadOrStore(key, sess)
 	_sess := actualSess.(*Session)
 
 	if loaded {
@@ -59,6 +182,7 @@ func (m *Manager) GetOrCreateSession(name string, sa unix.Sockaddr) (*Session, b
 		// actually created, init fd and ch
 		fd, err := sd_socket.UDPSocket(unix.AF_INET, true, false, false)
 		if err != nil {
+			shard.Delete(key)
 			return nil, false, fmt.Errorf("create socket failed: %w", err)
 		}
 		_sess.fd = fd
@@ -68,8 +192,8 @@ func (m *Manager) GetOrCreateSession(name string, sa unix.Sockaddr) (*Session, b
 	return _sess, loaded, nil
 }
 
-func (m *Manager) GetSession(name string) *Session {
-	v, ok := m.sessions.Load(name)
+func (m *Manager) GetSession(listener, name string, sa unix.Sockaddr) *Session {
+	v, ok := m.shard(listener, sa).Load(sessionKey{listener: listener, name: name})
 	if ok {
 		sess := v.(*Session)
 		sess.UpdateActive()
@@ -77,3 +201,26 @@ func (m *Manager) GetSession(name string) *Session {
 	}
 	return nil
 }
+
+// Return snapshot of all sessions
+func (m *Manager) Sessions() []*Session {
+	sessions := make([]*Session, 0)
+	m.rangeSessions(func(shard *sync.Map, key sessionKey, sess *Session) bool {
+		sessions = append(sessions, sess)
+		return true
+	})
+	return sessions
+}
+
+// Restore session with fd handed over from another process
+// Returns err if session with the same name exists
+func (m *Manager) RestoreSession(listener, name string, sa unix.Sockaddr, fd int) (*Session, error) {
+	sess := NewSession(listener, name, sa)
+	sess.fd = fd
+	sess.ch = m.evChanPool.Get().(chan struct{})
+	if _, loaded := m.shard(listener, sa).LoadOrStore(sessionKey{listener: listener, name: name}, sess); loaded {
+		m.evChanPool.Put(sess.ch)
+		return nil, fmt.Errorf("session %q of listener %s is existed", name, listener)
+	}
+	return sess, nil
+}
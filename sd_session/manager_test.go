@@ -0,0 +1,42 @@
+package sd_session
+
+import (
+	"fmt"
+	"github.com/near-notfaraway/stevedore/sd_config"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+	"sync"
+	"testing"
+)
+
+// Sessions restored before shards of listener are added should be moved into shards and found by client
+func TestManager_AddListener(t *testing.T) {
+	evChanPool := &sync.Pool{New: func() interface{} { return make(chan struct{}, 1) }}
+	m := NewManager(&sd_config.SessionConfig{RecycleIntervalSec: 60, TimeoutSec: 60}, evChanPool, nil)
+	defer m.stopOnce.Do(func() { close(m.stopCh) })
+
+	var clients []unix.Sockaddr
+	var names []string
+	for port := 1000; port < 1010; port++ {
+		clients = append(clients, &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}, Port: port})
+		names = append(names, fmt.Sprintf("127.0.0.1:%d", port))
+		_, err := m.RestoreSession("game", names[len(names)-1], clients[len(clients)-1], -1)
+		assert.Nil(t, err)
+	}
+	_, err := m.RestoreSession("chat", "client", clients[0], -1)
+	assert.Nil(t, err)
+
+	assert.Nil(t, m.AddListener("game", 4))
+	assert.NotNil(t, m.AddListener("game", 4))
+	assert.Equal(t, map[string]int{"game": 10, "chat": 1}, m.CountByListener())
+	for i, sa := range clients {
+		assert.NotNil(t, m.GetSession("game", names[i], sa))
+	}
+	assert.NotNil(t, m.GetSession("chat", "client", clients[0]))
+
+	// new session of listener is stored in the same shard as found
+	sess, loaded, err := m.GetOrCreateSession("game", names[0], clients[0])
+	assert.Nil(t, err)
+	assert.True(t, loaded)
+	assert.Equal(t, m.GetSession("game", names[0], clients[0]), sess)
+}
@@ -2,7 +2,10 @@ package sd_session
 
 import (
 	"context"
+	"fmt"
 	"github.com/near-notfaraway/stevedore/sd_socket"
+	"github.com/near-notfaraway/stevedore/sd_upstream"
+	"github.com/near-notfaraway/stevedore/sd_util"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
 	"sync"
@@ -13,22 +16,47 @@ import (
 type Session struct {
 	ctx        context.Context    // control download worker close
 	cancel     context.CancelFunc // ctx cancel function
+	listener   string             // name of listener which session belongs to
 	name       string             // string converted from downstream address
 	sa         unix.Sockaddr      // downstream sockaddr
 	lastActive int64              // last active timestamp base on second
 	fd         int                // fd used to upload packet
 	ch         chan struct{}      // fd used to recv download event
+	peer       atomic.Value       // *lastPeer: last peer which packet uploaded to
+	hash       uint32             // hash of name, used to sample sessions and select peer if no key
+	shadowMu   sync.Mutex         // protect shadow fd creation, sending and close
+	shadowFd   int                // fd used to mirror packet to shadow upstream, -1 if not created
+	shadowPeer atomic.Value       // *sd_upstream.Peer: last shadow peer which packet mirrored to
+	sticky     atomic.Value       // *stickyRoute: route decision of first packet if route is sticky
 }
 
-func NewSession(name string, sa unix.Sockaddr) *Session {
+// Last peer which packet uploaded to, with name of its upstream
+type lastPeer struct {
+	upstream string
+	peer     *sd_upstream.Peer
+}
+
+// Route decision kept by session, route and upstream are resolved by id and name again after manager swapped
+type stickyRoute struct {
+	manager      *sd_upstream.Manager // manager which route and upstream belong to
+	routeId      int                  // id of route
+	upstreamName string               // name of upstream
+	route        *sd_upstream.Route
+	upstream     sd_upstream.Upstream
+}
+
+func NewSession(listener, name string, sa unix.Sockaddr) *Session {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	return &Session{
 		ctx:        ctx,
 		cancel:     cancel,
+		listener:   listener,
 		name:       name,
 		sa:         sa,
 		lastActive: time.Now().Unix(),
+		hash:       sd_util.FNVHash([]byte(name)),
+		shadowFd:   -1,
 	}
 }
 
@@ -44,6 +72,10 @@ func (s *Session) GetCtx() context.Context {
 	return s.ctx
 }
 
+func (s *Session) GetListener() string {
+	return s.listener
+}
+
 func (s *Session) GetName() string {
 	return s.name
 }
@@ -60,7 +92,134 @@ func (s *Session) GetCh() chan struct{} {
 	return s.ch
 }
 
-func (s *Session) Close(selector sd_socket.Selector, evChanPool sync.Pool) {
+// Return last peer which packet uploaded to, returns nil if no packet uploaded
+func (s *Session) GetPeer() *sd_upstream.Peer {
+	last, _ := s.peer.Load().(*lastPeer)
+	if last == nil {
+		return nil
+	}
+	return last.peer
+}
+
+// Return name of upstream of last peer, returns empty if no packet uploaded
+func (s *Session) GetPeerUpstream() string {
+	last, _ := s.peer.Load().(*lastPeer)
+	if last == nil {
+		return ""
+	}
+	return last.upstream
+}
+
+func (s *Session) SetPeer(upstream sd_upstream.Upstream, peer *sd_upstream.Peer) {
+	if s.GetPeer() != peer {
+		s.peer.Store(&lastPeer{upstream: upstream.GetName(), peer: peer})
+	}
+}
+
+// Return route and upstream kept by session, ok is false if not kept
+// After manager swapped, route and upstream are resolved by id and name, and last peer by addr, against new manager
+// ok is false if route or upstream no longer exists, or route is not sticky any more, so that session is routed again
+func (s *Session) GetStickyRoute(manager *sd_upstream.Manager) (route *sd_upstream.Route,
+	upstream sd_upstream.Upstream, ok bool) {
+	sticky, _ := s.sticky.Load().(*stickyRoute)
+	if sticky == nil {
+		return nil, nil, false
+	}
+	if sticky.manager == manager {
+		return sticky.route, sticky.upstream, true
+	}
+
+	router := manager.GetRouter(s.listener)
+	if router == nil {
+		return nil, nil, false
+	}
+	route = router.GetRoute(sticky.routeId)
+	upstream = manager.GetUpstream(sticky.upstreamName)
+	if route == nil || upstream == nil || !route.IsSticky() {
+		s.sticky.Store((*stickyRoute)(nil))
+		return nil, nil, false
+	}
+	if peer := s.GetPeer(); peer != nil {
+		s.SetPeer(upstream, upstream.GetPeer(peer.GetAddr()))
+	}
+	s.SetStickyRoute(manager, route, upstream)
+	return route, upstream, true
+}
+
+// Keep route and upstream, later packets of session reuse them
+func (s *Session) SetStickyRoute(manager *sd_upstream.Manager, route *sd_upstream.Route,
+	upstream sd_upstream.Upstream) {
+	s.sticky.Store(&stickyRoute{
+		manager:      manager,
+		routeId:      route.GetId(),
+		upstreamName: upstream.GetName(),
+		route:        route,
+		upstream:     upstream,
+	})
+}
+
+// Restore last peer and sticky route of session handed over by old process, which are resolved by name against manager
+// Nothing is restored if upstream no longer exists, and session is routed again
+func (s *Session) RestoreRoute(manager *sd_upstream.Manager, upstream, peer string, sticky bool, routeId int) {
+	ups := manager.GetUpstream(upstream)
+	if ups == nil {
+		return
+	}
+	if p := ups.GetPeer(peer); p != nil {
+		s.SetPeer(ups, p)
+	}
+	if sticky {
+		s.sticky.Store(&stickyRoute{routeId: routeId, upstreamName: upstream})
+		s.GetStickyRoute(manager)
+	}
+}
+
+// Return hash of session, which is stable for the same client
+func (s *Session) GetHash() uint32 {
+	return s.hash
+}
+
+// Send data to shadow peer through fd used to mirror packets, create fd and call register with it if not exists
+// Lock is held during sending, so that fd is never closed and reused by others meanwhile
+// Returns err if session is closed, or creating, registering or sending fails
+func (s *Session) SendShadow(peer *sd_upstream.Peer, data []byte, register func(fd int) error) error {
+	s.shadowMu.Lock()
+	defer s.shadowMu.Unlock()
+	if s.ctx.Err() != nil {
+		return fmt.Errorf("session is closed")
+	}
+
+	if s.shadowFd < 0 {
+		fd, err := sd_socket.UDPSocket(unix.AF_INET, true, false, false)
+		if err != nil {
+			return fmt.Errorf("create shadow socket failed: %w", err)
+		}
+		if err = register(fd); err != nil {
+			_ = unix.Close(fd)
+			return fmt.Errorf("register shadow fd failed: %w", err)
+		}
+		s.shadowFd = fd
+	}
+
+	if err := peer.Send(s.shadowFd, data); err != nil {
+		return fmt.Errorf("mirror to peer %s failed: %w", peer.GetAddr(), err)
+	}
+	return nil
+}
+
+// Return last shadow peer which packet mirrored to, returns nil if no packet mirrored
+func (s *Session) GetShadowPeer() *sd_upstream.Peer {
+	peer, _ := s.shadowPeer.Load().(*sd_upstream.Peer)
+	return peer
+}
+
+func (s *Session) SetShadowPeer(peer *sd_upstream.Peer) {
+	if s.GetShadowPeer() != peer {
+		s.shadowPeer.Store(peer)
+	}
+}
+
+func (s *Session) Close(selector sd_socket.Selector, evChanPool *sync.Pool) {
 	if err := selector.Del(s.fd); err != nil {
 		logrus.Errorf("delete fd from selector failed: %v", err)
 	}
@@ -69,4 +228,17 @@ func (s *Session) Close(selector sd_socket.Selector, evChanPool sync.Pool) {
 	if err := unix.Close(s.fd); err != nil {
 		logrus.Errorf("close fd failed: %v", err)
 	}
+
+	// close shadow fd, session is canceled so that it is not created again
+	s.shadowMu.Lock()
+	defer s.shadowMu.Unlock()
+	if s.shadowFd >= 0 {
+		if err := selector.Del(s.shadowFd); err != nil {
+			logrus.Errorf("delete shadow fd from selector failed: %v", err)
+		}
+		if err := unix.Close(s.shadowFd); err != nil {
+			logrus.Errorf("close shadow fd failed: %v", err)
+		}
+		s.shadowFd = -1
+	}
 }
@@ -0,0 +1,170 @@
+package sd_session
+
+import (
+	"fmt"
+	"github.com/near-notfaraway/stevedore/sd_config"
+	"github.com/near-notfaraway/stevedore/sd_socket"
+	"github.com/near-notfaraway/stevedore/sd_upstream"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Create manager with upstreams of names and a router of listener "game", routes of it target upstream
+func newTestManager(t *testing.T, upstream string, names ...string) *sd_upstream.Manager {
+	config := &sd_config.UploadConfig{}
+	for _, name := range names {
+		config.Upstreams = append(config.Upstreams, &sd_config.UpstreamConfig{
+			Name: name,
+			Type: sd_upstream.UpstreamTypeRR,
+			HealthChecker: &sd_config.HealthCheckerConfig{
+				HeartbeatIntervalSec: 5,
+				HeartbeatTimeoutSec:  3,
+				SuccessTimes:         1,
+				FailedTimes:          1,
+			},
+			Peers: []*sd_config.PeerConfig{
+				{IP: "127.0.0.1", Port: 2345, Weight: 1, Backup: true},
+				{IP: "127.0.0.1", Port: 2346, Weight: 1},
+			},
+		})
+	}
+	mgr, err := sd_upstream.NewManager(config)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(mgr.Close)
+
+	assert.Nil(t, mgr.AddRouter(&sd_config.ListenerConfig{Name: "game", DefaultAction: "drop", Routes: []sd_config.RouteConfig{
+		{KeyBytes: "0:1", Operator: "==", Value: "0x01", Upstream: upstream, Sticky: true},
+	}}))
+	return mgr
+}
+
+// Sticky route should be resolved by name after reload, and dropped only if upstream no longer exists
+func TestSession_StickyRouteReload(t *testing.T) {
+	sess := NewSession("game", "client", nil)
+	mgr := newTestManager(t, "a", "a", "b")
+	_, _, ok := sess.GetStickyRoute(mgr)
+	assert.False(t, ok)
+
+	route := mgr.GetRouter("game").GetRoute(0)
+	sess.SetStickyRoute(mgr, route, mgr.GetUpstream("a"))
+	sess.SetPeer(mgr.GetUpstream("a"), mgr.GetUpstream("a").GetPeer("127.0.0.1:2346"))
+
+	// routes of new manager target another upstream, session keeps the same one of new manager
+	reloaded := newTestManager(t, "b", "a", "b")
+	route, upstream, ok := sess.GetStickyRoute(reloaded)
+	assert.True(t, ok)
+	assert.Equal(t, reloaded.GetRouter("game").GetRoute(0), route)
+	assert.Equal(t, reloaded.GetUpstream("a"), upstream)
+	assert.Equal(t, reloaded.GetUpstream("a").GetPeer("127.0.0.1:2346"), sess.GetPeer())
+
+	// upstream removed, session is routed again
+	removed := newTestManager(t, "b", "b")
+	_, _, ok = sess.GetStickyRoute(removed)
+	assert.False(t, ok)
+	_, _, ok = sess.GetStickyRoute(reloaded)
+	assert.False(t, ok)
+}
+
+// Last peer and sticky route handed over should be resolved by name, and not restored if upstream no longer exists
+func TestSession_RestoreRoute(t *testing.T) {
+	mgr := newTestManager(t, "a", "a", "b")
+	sess := NewSession("game", "client", nil)
+	sess.RestoreRoute(mgr, "a", "127.0.0.1:2346", true, 0)
+	assert.Equal(t, "a", sess.GetPeerUpstream())
+	assert.Equal(t, mgr.GetUpstream("a").GetPeer("127.0.0.1:2346"), sess.GetPeer())
+	route, upstream, ok := sess.GetStickyRoute(mgr)
+	assert.True(t, ok)
+	assert.Equal(t, mgr.GetRouter("game").GetRoute(0), route)
+	assert.Equal(t, mgr.GetUpstream("a"), upstream)
+
+	// peer removed, sticky route is kept and peer is selected again
+	sess = NewSession("game", "client", nil)
+	sess.RestoreRoute(mgr, "b", "127.0.0.1:3000", true, 0)
+	assert.Nil(t, sess.GetPeer())
+	_, upstream, ok = sess.GetStickyRoute(mgr)
+	assert.True(t, ok)
+	assert.Equal(t, mgr.GetUpstream("b"), upstream)
+
+	// upstream removed
+	sess = NewSession("game", "client", nil)
+	sess.RestoreRoute(mgr, "c", "127.0.0.1:2346", true, 0)
+	assert.Nil(t, sess.GetPeer())
+	_, _, ok = sess.GetStickyRoute(mgr)
+	assert.False(t, ok)
+}
+
+// Selector which only records fds deleted
+type testSelector struct {
+	sd_socket.Selector
+	mu      sync.Mutex
+	deleted []int
+}
+
+func (s *testSelector) Del(fd int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deleted = append(s.deleted, fd)
+	return nil
+}
+
+// Shadow fd should not be closed while mirror is sending, and mirror queued after session closed should not be sent
+func TestSession_SendShadowClose(t *testing.T) {
+	recvFd, err := sd_socket.UDPBoundSocket(&unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}, false, false, false)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	defer unix.Close(recvFd)
+	sa, _ := unix.Getsockname(recvFd)
+	peer, err := sd_upstream.NewPeer(0, fmt.Sprintf("127.0.0.1:%d", sa.(*unix.SockaddrInet4).Port),
+		&sd_config.PeerConfig{Weight: 1})
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+
+	evChanPool := &sync.Pool{New: func() interface{} { return make(chan struct{}, 1) }}
+	selector := &testSelector{}
+	m := NewManager(&sd_config.SessionConfig{RecycleIntervalSec: 60, TimeoutSec: 60}, evChanPool, selector)
+	defer m.stopOnce.Do(func() { close(m.stopCh) })
+	sess, _, err := m.GetOrCreateSession("game", "client", sa)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+
+	// session is closed while shadow fd is being registered, close waits until packet is sent
+	closed := make(chan struct{})
+	var shadowFd int
+	err = sess.SendShadow(peer, []byte("mirror"), func(fd int) error {
+		shadowFd = fd
+		go func() {
+			sess.Close(selector, evChanPool)
+			close(closed)
+		}()
+		select {
+		case <-closed:
+			t.Error("session closed while sending mirror")
+		case <-time.After(50 * time.Millisecond):
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	<-closed
+	assert.Contains(t, selector.deleted, shadowFd)
+	var buf [16]byte
+	n, _, err := unix.Recvfrom(recvFd, buf[:], unix.MSG_DONTWAIT)
+	assert.Nil(t, err)
+	assert.Equal(t, "mirror", string(buf[:n]))
+
+	// mirror queued is not sent after session closed, and shadow fd is not created again
+	err = sess.SendShadow(peer, []byte("mirror"), func(fd int) error {
+		t.Error("shadow fd created after session closed")
+		return nil
+	})
+	assert.NotNil(t, err)
+	_, _, err = unix.Recvfrom(recvFd, buf[:], unix.MSG_DONTWAIT)
+	assert.Equal(t, unix.EAGAIN, err)
+}
@@ -0,0 +1,108 @@
+package sd_socket
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"sync"
+)
+
+//------------------------------------------------------------------------------
+// ReplySocket: Used to send packets from address of reuseport group without getting packets of it
+//------------------------------------------------------------------------------
+
+// Port which reply sockets are connected to, packets are never sent from it
+const discardPort = 9
+
+// Reply socket is a socket of reuseport group connected to discard port of loopback,
+// so that the kernel never distributes packets of clients to it, and other sockets of group get them
+// Connecting binds wildcard address to loopback, so source address of each packet is set by pktinfo
+type ReplySocket struct {
+	fd       int
+	wildcard bool     // if group is bound to wildcard address
+	sources  sync.Map // map[[16]byte]*[16]byte: source address of ipv6 destination, looked up by route
+}
+
+// Turn fd of reuseport group into reply socket, fd is still owned by caller
+// Returns err if connect fails
+func NewReplySocket(fd int) (*ReplySocket, error) {
+	sa, err := unix.Getsockname(fd)
+	if err != nil {
+		return nil, fmt.Errorf("get sockname failed: %w", err)
+	}
+
+	r := &ReplySocket{fd: fd}
+	var discard unix.Sockaddr
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		r.wildcard = sa.Addr == [4]byte{}
+		discard = &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}, Port: discardPort}
+	case *unix.SockaddrInet6:
+		r.wildcard = sa.Addr == [16]byte{}
+		discard = &unix.SockaddrInet6{Addr: [16]byte{15: 1}, Port: discardPort}
+		if isV4Mapped(sa.Addr[:]) {
+			discard = &unix.SockaddrInet6{Addr: [16]byte{10: 0xff, 11: 0xff, 12: 127, 15: 1}, Port: discardPort}
+		}
+	default:
+		return nil, fmt.Errorf("sockaddr family is not inet")
+	}
+
+	if err = unix.Connect(fd, discard); err != nil {
+		return nil, fmt.Errorf("connect discard port failed: %w", err)
+	}
+	return r, nil
+}
+
+// Send packet to address, source address is the same as other sockets of group would use
+// Returns err if send fails
+func (r *ReplySocket) SendTo(p []byte, to unix.Sockaddr) error {
+	if !r.wildcard {
+		return SendTo(r.fd, p, 0, to)
+	}
+
+	// unspecified source address of pktinfo makes the kernel choose it by route, except for native ipv6
+	var oob []byte
+	switch to := to.(type) {
+	case *unix.SockaddrInet4:
+		oob = unix.PktInfo4(&unix.Inet4Pktinfo{})
+	case *unix.SockaddrInet6:
+		info := &unix.Inet6Pktinfo{}
+		if isV4Mapped(to.Addr[:]) {
+			info.Addr[10], info.Addr[11] = 0xff, 0xff
+		} else {
+			src, err := r.source6(to)
+			if err != nil {
+				return err
+			}
+			info.Addr = *src
+		}
+		oob = unix.PktInfo6(info)
+	}
+
+	_, err := unix.SendmsgN(r.fd, p, oob, to, 0)
+	return err
+}
+
+// Return source address of ipv6 destination chosen by route, which is cached
+func (r *ReplySocket) source6(to *unix.SockaddrInet6) (*[16]byte, error) {
+	if src, ok := r.sources.Load(to.Addr); ok {
+		return src.(*[16]byte), nil
+	}
+
+	// connecting udp socket looks up route without sending packet
+	probe, err := unix.Socket(unix.AF_INET6, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, unix.IPPROTO_UDP)
+	if err != nil {
+		return nil, fmt.Errorf("create socket failed: %w", err)
+	}
+	defer unix.Close(probe)
+	if err = unix.Connect(probe, &unix.SockaddrInet6{Addr: to.Addr, ZoneId: to.ZoneId, Port: discardPort}); err != nil {
+		return nil, fmt.Errorf("look up route failed: %w", err)
+	}
+	sa, err := unix.Getsockname(probe)
+	if err != nil {
+		return nil, fmt.Errorf("get sockname failed: %w", err)
+	}
+
+	src := &sa.(*unix.SockaddrInet6).Addr
+	r.sources.Store(to.Addr, src)
+	return src, nil
+}
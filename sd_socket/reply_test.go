@@ -0,0 +1,59 @@
+package sd_socket
+
+import (
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+	"testing"
+)
+
+// Reply socket should get no packets of clients, and send packets from address of group
+func TestReplySocket(t *testing.T) {
+	for _, sa := range []unix.Sockaddr{
+		&unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}},
+		&unix.SockaddrInet4{},
+		&unix.SockaddrInet6{Addr: [16]byte{15: 1}},
+		&unix.SockaddrInet6{},
+	} {
+		fds := newReuseportGroup(t, sa, 3)
+		local, _ := unix.Getsockname(fds[0])
+		reply, err := NewReplySocket(fds[0])
+		if !assert.Nil(t, err) {
+			continue
+		}
+		for i := 0; i < 32; i++ {
+			idx, _ := sendToGroup(t, fds[1:], []byte("ping"))
+			assert.True(t, idx >= 0)
+		}
+		_, _, err = unix.Recvfrom(reply.fd, make([]byte, 64), unix.MSG_DONTWAIT)
+		assert.Equal(t, unix.EAGAIN, err, "%v", sa)
+
+		// reply to client on loopback
+		client, err := UDPBoundSocket(loopbackOf(local, 0), false, false, false)
+		assert.Nil(t, err)
+		assert.Nil(t, SetSocketTimeout(client, 0, 1))
+		to, _ := unix.Getsockname(client)
+		assert.Nil(t, reply.SendTo([]byte("pong"), to))
+		_, from, err := unix.Recvfrom(client, make([]byte, 64), 0)
+		if assert.Nil(t, err, "%v", sa) {
+			assert.Equal(t, loopbackOf(local, -1), from, "%v", sa)
+		}
+		_ = unix.Close(client)
+	}
+}
+
+// Return loopback address with the same family as sa, and the same port if port is negative
+func loopbackOf(sa unix.Sockaddr, port int) unix.Sockaddr {
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		if port < 0 {
+			port = sa.Port
+		}
+		return &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}, Port: port}
+	case *unix.SockaddrInet6:
+		if port < 0 {
+			port = sa.Port
+		}
+		return &unix.SockaddrInet6{Addr: [16]byte{15: 1}, Port: port}
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package sd_socket
+
+import (
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/sys/unix"
+)
+
+//------------------------------------------------------------------------------
+// Reuseport: classic bpf programs steering packets among SO_REUSEPORT sockets
+//------------------------------------------------------------------------------
+
+const (
+	// Negative offset of loads which are relative to network header instead of payload
+	skfNetOff = -0x100000
+
+	// Multiplier of hash, also used by ClientHash and PayloadHash
+	steeringHashMul = 0x9e3779b1
+)
+
+// Return program steering packets of the same client address to the same socket,
+// the index of socket in reuseport group is ClientHash(addr) % n
+func ClientSteeringProgram(n int) []unix.SockFilter {
+	return append(clientHashInsns(), mixHashInsns(n)...)
+}
+
+// Return program steering packets by payload bytes data[start:end] to the same socket,
+// the index of socket in reuseport group is PayloadHash(data, start, end) % n,
+// packets shorter than end are steered by client address, data[start:end] should not exceed 64 bytes
+func PayloadSteeringProgram(start, end, n int) []unix.SockFilter {
+	body := []unix.SockFilter{stmt(unix.BPF_LD|unix.BPF_IMM, 0)}
+	for off := start; off < end; {
+		size, width := unix.BPF_W, 4
+		if end-off < 2 {
+			size, width = unix.BPF_B, 1
+		} else if end-off < 4 {
+			size, width = unix.BPF_H, 2
+		}
+		body = append(body,
+			stmt(unix.BPF_MISC|unix.BPF_TAX, 0),
+			stmt(unix.BPF_LD|uint16(size)|unix.BPF_ABS, uint32(off)),
+			stmt(unix.BPF_ALU|unix.BPF_XOR|unix.BPF_X, 0),
+			stmt(unix.BPF_ALU|unix.BPF_MUL|unix.BPF_K, steeringHashMul),
+		)
+		off += width
+	}
+
+	client := clientHashInsns()
+	body = append(body, stmt(unix.BPF_JMP|unix.BPF_JA, uint32(len(client))))
+	prog := []unix.SockFilter{
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_LEN, 0),
+		jump(unix.BPF_JGE, uint32(end), 0, uint8(len(body))),
+	}
+	prog = append(prog, body...)
+	prog = append(prog, client...)
+	return append(prog, mixHashInsns(n)...)
+}
+
+// Attach steering program to reuseport group which fd belongs to, it replaces program attached before
+// Returns err if attach fails
+func AttachReuseportProgram(fd int, prog []unix.SockFilter) error {
+	fprog := &unix.SockFprog{Len: uint16(len(prog)), Filter: &prog[0]}
+	if err := unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_REUSEPORT_CBPF, fprog); err != nil {
+		return fmt.Errorf("setsockopt attach reuseport cbpf failed: %w", err)
+	}
+	return nil
+}
+
+// Return hash of client address, which is the same as computed by ClientSteeringProgram
+func ClientHash(sa unix.Sockaddr) uint32 {
+	var h uint32
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		h = binary.BigEndian.Uint32(sa.Addr[:]) ^ uint32(sa.Port)
+	case *unix.SockaddrInet6:
+		// ipv4-mapped address is received as ipv4 packet by dual stack socket
+		if isV4Mapped(sa.Addr[:]) {
+			h = binary.BigEndian.Uint32(sa.Addr[12:])
+		} else {
+			for i := 0; i < 16; i += 4 {
+				h ^= binary.BigEndian.Uint32(sa.Addr[i:])
+			}
+		}
+		h ^= uint32(sa.Port)
+	}
+	return mixHash(h)
+}
+
+// Return hash of data[start:end], which is the same as computed by PayloadSteeringProgram
+// Returns false if data is shorter than end
+func PayloadHash(data []byte, start, end int) (uint32, bool) {
+	if len(data) < end {
+		return 0, false
+	}
+
+	var h uint32
+	for off := start; off < end; {
+		var chunk uint32
+		switch {
+		case end-off < 2:
+			chunk = uint32(data[off])
+			off++
+		case end-off < 4:
+			chunk = uint32(binary.BigEndian.Uint16(data[off:]))
+			off += 2
+		default:
+			chunk = binary.BigEndian.Uint32(data[off:])
+			off += 4
+		}
+		h = (h ^ chunk) * steeringHashMul
+	}
+	return mixHash(h), true
+}
+
+func mixHash(h uint32) uint32 {
+	h *= steeringHashMul
+	return h ^ h>>16
+}
+
+func isV4Mapped(ip []byte) bool {
+	for i := 0; i < 10; i++ {
+		if ip[i] != 0 {
+			return false
+		}
+	}
+	return ip[10] == 0xff && ip[11] == 0xff
+}
+
+// Instructions leaving source ip xor source port in A, ipv6 extension headers are not skipped
+func clientHashInsns() []unix.SockFilter {
+	v6 := []unix.SockFilter{
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, netOff(8)),
+		stmt(unix.BPF_MISC|unix.BPF_TAX, 0),
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, netOff(12)),
+		stmt(unix.BPF_ALU|unix.BPF_XOR|unix.BPF_X, 0),
+		stmt(unix.BPF_MISC|unix.BPF_TAX, 0),
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, netOff(16)),
+		stmt(unix.BPF_ALU|unix.BPF_XOR|unix.BPF_X, 0),
+		stmt(unix.BPF_MISC|unix.BPF_TAX, 0),
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, netOff(20)),
+		stmt(unix.BPF_ALU|unix.BPF_XOR|unix.BPF_X, 0),
+		stmt(unix.BPF_ST, 0),
+		stmt(unix.BPF_LD|unix.BPF_H|unix.BPF_ABS, netOff(40)),
+	}
+	v4 := []unix.SockFilter{
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, netOff(12)),
+		stmt(unix.BPF_ST, 0),
+		stmt(unix.BPF_LDX|unix.BPF_B|unix.BPF_MSH, netOff(0)),
+		stmt(unix.BPF_LD|unix.BPF_H|unix.BPF_IND, netOff(0)),
+		stmt(unix.BPF_JMP|unix.BPF_JA, uint32(len(v6))),
+	}
+
+	// version of ip header is the high nibble of its first byte
+	prog := []unix.SockFilter{
+		stmt(unix.BPF_LD|unix.BPF_B|unix.BPF_ABS, netOff(0)),
+		stmt(unix.BPF_ALU|unix.BPF_RSH|unix.BPF_K, 4),
+		jump(unix.BPF_JEQ, 6, uint8(len(v4)), 0),
+	}
+	prog = append(prog, v4...)
+	prog = append(prog, v6...)
+	return append(prog,
+		stmt(unix.BPF_MISC|unix.BPF_TAX, 0),
+		stmt(unix.BPF_LD|unix.BPF_MEM, 0),
+		stmt(unix.BPF_ALU|unix.BPF_XOR|unix.BPF_X, 0),
+	)
+}
+
+// Instructions mixing hash in A and returning it modulo n as socket index
+func mixHashInsns(n int) []unix.SockFilter {
+	return []unix.SockFilter{
+		stmt(unix.BPF_ALU|unix.BPF_MUL|unix.BPF_K, steeringHashMul),
+		stmt(unix.BPF_ST, 0),
+		stmt(unix.BPF_ALU|unix.BPF_RSH|unix.BPF_K, 16),
+		stmt(unix.BPF_MISC|unix.BPF_TAX, 0),
+		stmt(unix.BPF_LD|unix.BPF_MEM, 0),
+		stmt(unix.BPF_ALU|unix.BPF_XOR|unix.BPF_X, 0),
+		stmt(unix.BPF_ALU|unix.BPF_MOD|unix.BPF_K, uint32(n)),
+		stmt(unix.BPF_RET|unix.BPF_A, 0),
+	}
+}
+
+// Return k of loads relative to network header
+func netOff(off int32) uint32 {
+	return uint32(skfNetOff + off)
+}
+
+func stmt(code uint16, k uint32) unix.SockFilter {
+	return unix.SockFilter{Code: code, K: k}
+}
+
+func jump(op uint16, k uint32, jt, jf uint8) unix.SockFilter {
+	return unix.SockFilter{Code: unix.BPF_JMP | op | unix.BPF_K, Jt: jt, Jf: jf, K: k}
+}
@@ -0,0 +1,100 @@
+package sd_socket
+
+import (
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+	"testing"
+	"time"
+)
+
+// Create n sockets sharing a port of sa, the index of socket in reuseport group is its order
+func newReuseportGroup(t *testing.T, sa unix.Sockaddr, n int) []int {
+	fds := make([]int, 0, n)
+	for i := 0; i < n; i++ {
+		fd, err := UDPBoundSocket(sa, false, true, true)
+		if !assert.Nil(t, err) {
+			t.FailNow()
+		}
+		assert.Nil(t, SetSocketTimeout(fd, 0, 1))
+		fds = append(fds, fd)
+		if i == 0 {
+			sa, _ = unix.Getsockname(fd)
+		}
+	}
+	t.Cleanup(func() {
+		for _, fd := range fds {
+			_ = unix.Close(fd)
+		}
+	})
+	return fds
+}
+
+// Send data from a new client socket, return the index of socket received it
+func sendToGroup(t *testing.T, fds []int, data []byte) (int, unix.Sockaddr) {
+	to, _ := unix.Getsockname(fds[0])
+	family := unix.AF_INET
+	if _, ok := to.(*unix.SockaddrInet6); ok {
+		family = unix.AF_INET6
+	}
+	client, err := UDPSocket(family, false, false, false)
+	assert.Nil(t, err)
+	defer unix.Close(client)
+	assert.Nil(t, SendTo(client, data, 0, to))
+
+	buf := make([]byte, 64)
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		for i, fd := range fds {
+			if _, from, err := unix.Recvfrom(fd, buf, unix.MSG_DONTWAIT); err == nil {
+				return i, from
+			}
+		}
+	}
+	t.Fatal("packet not received")
+	return -1, nil
+}
+
+// Client steering program should send packets to socket chosen by ClientHash
+func TestClientSteeringProgram(t *testing.T) {
+	for _, sa := range []unix.Sockaddr{
+		&unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}},
+		&unix.SockaddrInet6{Addr: [16]byte{15: 1}},
+	} {
+		fds := newReuseportGroup(t, sa, 4)
+		assert.Nil(t, AttachReuseportProgram(fds[0], ClientSteeringProgram(len(fds))))
+
+		for i := 0; i < 32; i++ {
+			idx, from := sendToGroup(t, fds, []byte("ping"))
+			assert.Equal(t, int(ClientHash(from)%4), idx, "%v", from)
+		}
+	}
+}
+
+// Payload steering program should send packets to socket chosen by PayloadHash, or ClientHash if too short
+func TestPayloadSteeringProgram(t *testing.T) {
+	fds := newReuseportGroup(t, &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}, 4)
+	assert.Nil(t, AttachReuseportProgram(fds[0], PayloadSteeringProgram(1, 8, len(fds))))
+
+	for i := 0; i < 32; i++ {
+		data := []byte{0, byte(i), 2, 3, 4, 5, byte(i * 7), 7, 8}
+		hash, ok := PayloadHash(data, 1, 8)
+		assert.True(t, ok)
+		idx, _ := sendToGroup(t, fds, data)
+		assert.Equal(t, int(hash%4), idx)
+
+		idx, from := sendToGroup(t, fds, data[:7])
+		assert.Equal(t, int(ClientHash(from)%4), idx)
+	}
+}
+
+// Client hash of ipv4-mapped address should be the same as ipv4 address
+func TestClientHash(t *testing.T) {
+	v4 := &unix.SockaddrInet4{Addr: [4]byte{10, 0, 0, 1}, Port: 5000}
+	v6 := &unix.SockaddrInet6{Addr: [16]byte{10: 0xff, 11: 0xff, 12: 10, 15: 1}, Port: 5000}
+	assert.Equal(t, ClientHash(v4), ClientHash(v6))
+	v6.Addr[10] = 0
+	assert.NotEqual(t, ClientHash(v4), ClientHash(v6))
+
+	_, ok := PayloadHash([]byte{1, 2, 3}, 0, 4)
+	assert.False(t, ok)
+}
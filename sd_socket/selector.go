@@ -23,6 +23,8 @@ type Selector interface {
 	Mod(fd int, ev SelectorEvent) error
 	Del(fd int) error
 	Polling(ctx context.Context, handle func(evs []unix.EpollEvent)) error
+	Wakeup() error
+	Close() error
 }
 
 //------------------------------------------------------------------------------
@@ -30,9 +32,10 @@ type Selector interface {
 //------------------------------------------------------------------------------
 
 type Epoller struct {
-	fd  int               // epoll fd
-	evs []unix.EpollEvent // max events per poll
-	et  bool              // if use edge trigger
+	fd     int               // epoll fd
+	wakeFd int               // eventfd used to wakeup polling
+	evs    []unix.EpollEvent // max events per poll
+	et     bool              // if use edge trigger
 }
 
 func NewEpoller(eventSize int, et bool) (Selector, error) {
@@ -45,14 +48,30 @@ func NewEpoller(eventSize int, et bool) (Selector, error) {
 		return nil, os.NewSyscallError("epoll_create1", err)
 	}
 
+	wakeFd, err := unix.Eventfd(0, unix.EFD_NONBLOCK|unix.EFD_CLOEXEC)
+	if err != nil {
+		_ = unix.Close(fd)
+		return nil, os.NewSyscallError("eventfd", err)
+	}
+	e := &unix.EpollEvent{Fd: int32(wakeFd), Events: unix.EPOLLIN}
+	if err := unix.EpollCtl(fd, unix.EPOLL_CTL_ADD, wakeFd, e); err != nil {
+		_ = unix.Close(wakeFd)
+		_ = unix.Close(fd)
+		return nil, os.NewSyscallError("epoll_ctl add", err)
+	}
+
 	return &Epoller{
-		fd:  fd,
-		evs: make([]unix.EpollEvent, eventSize),
-		et:  et,
+		fd:     fd,
+		wakeFd: wakeFd,
+		evs:    make([]unix.EpollEvent, eventSize),
+		et:     et,
 	}, nil
 }
 
 func (s *Epoller) Close() error {
+	if err := unix.Close(s.wakeFd); err != nil {
+		return os.NewSyscallError("close", err)
+	}
 	if err := unix.Close(s.fd); err != nil {
 		return os.NewSyscallError("close", err)
 	}
@@ -60,6 +79,17 @@ func (s *Epoller) Close() error {
 	return nil
 }
 
+// Wakeup polling which is blocked in epoll wait, used to make polling notice ctx canceled
+func (s *Epoller) Wakeup() error {
+	var buf [8]byte
+	buf[0] = 1
+	if _, err := unix.Write(s.wakeFd, buf[:]); err != nil && err != unix.EAGAIN {
+		return os.NewSyscallError("write", err)
+	}
+
+	return nil
+}
+
 func (s *Epoller) Add(fd int, ev SelectorEvent) error {
 	e := &unix.EpollEvent{
 		Fd: int32(fd),
@@ -135,7 +165,20 @@ func (s *Epoller) Polling(ctx context.Context, handle func(evs []unix.EpollEvent
 			if n < 0 {
 				continue
 			}
-			handle(s.evs[:n])
+
+			// consume wakeup event and exclude it
+			evs := s.evs[:0]
+			for i := 0; i < n; i++ {
+				if int(s.evs[i].Fd) == s.wakeFd {
+					var buf [8]byte
+					_, _ = unix.Read(s.wakeFd, buf[:])
+					continue
+				}
+				evs = append(evs, s.evs[i])
+			}
+			if len(evs) > 0 {
+				handle(evs)
+			}
 		}
 	}
 }
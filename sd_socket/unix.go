@@ -0,0 +1,101 @@
+package sd_socket
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+// Max number of fds sent in one message, kernel limits it to SCM_MAX_FD (253)
+const MaxFdsPerMsg = 200
+
+// Create a unix seqpacket socket listening on path, remove stale file first
+// Returns err if create fails
+func UnixSeqpacketListen(path string) (int, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return -1, fmt.Errorf("remove stale unix socket %s failed: %w", path, err)
+	}
+
+	fd, err := unix.Socket(unix.AF_UNIX, unix.SOCK_SEQPACKET|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return -1, fmt.Errorf("create unix socket failed: %w", err)
+	}
+	if err = unix.Bind(fd, &unix.SockaddrUnix{Name: path}); err != nil {
+		_ = unix.Close(fd)
+		return -1, fmt.Errorf("bind unix socket %s failed: %w", path, err)
+	}
+	if err = unix.Listen(fd, 1); err != nil {
+		_ = unix.Close(fd)
+		return -1, fmt.Errorf("listen unix socket %s failed: %w", path, err)
+	}
+
+	return fd, nil
+}
+
+// Create a unix seqpacket socket connected to path
+// Returns err if connect fails
+func UnixSeqpacketDial(path string) (int, error) {
+	fd, err := unix.Socket(unix.AF_UNIX, unix.SOCK_SEQPACKET|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return -1, fmt.Errorf("create unix socket failed: %w", err)
+	}
+	if err = unix.Connect(fd, &unix.SockaddrUnix{Name: path}); err != nil {
+		_ = unix.Close(fd)
+		return -1, fmt.Errorf("connect unix socket %s failed: %w", path, err)
+	}
+
+	return fd, nil
+}
+
+// Send data with fds attached through SCM_RIGHTS
+// Returns err if send fails or fds are too many
+func SendFds(fd int, data []byte, fds []int) error {
+	if len(fds) > MaxFdsPerMsg {
+		return fmt.Errorf("too many fds %d in one message", len(fds))
+	}
+
+	var oob []byte
+	if len(fds) > 0 {
+		oob = unix.UnixRights(fds...)
+	}
+	for {
+		err := unix.Sendmsg(fd, data, oob, nil, 0)
+		if err == unix.EINTR {
+			continue
+		}
+		return err
+	}
+}
+
+// Recv data with fds attached through SCM_RIGHTS, fds received are close-on-exec
+// Returns length of data, received fds and err
+func RecvFds(fd int, buf []byte) (int, []int, error) {
+	oob := make([]byte, unix.CmsgSpace(MaxFdsPerMsg*4))
+	for {
+		n, oobn, flags, _, err := unix.Recvmsg(fd, buf, oob, unix.MSG_CMSG_CLOEXEC)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		if flags&(unix.MSG_TRUNC|unix.MSG_CTRUNC) != 0 {
+			return 0, nil, fmt.Errorf("message truncated")
+		}
+
+		// parse fds
+		msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			return 0, nil, fmt.Errorf("parse control message failed: %w", err)
+		}
+		fds := make([]int, 0)
+		for _, msg := range msgs {
+			rights, err := unix.ParseUnixRights(&msg)
+			if err != nil {
+				return 0, nil, fmt.Errorf("parse unix rights failed: %w", err)
+			}
+			fds = append(fds, rights...)
+		}
+		return n, fds, nil
+	}
+}
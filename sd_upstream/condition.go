@@ -0,0 +1,648 @@
+package sd_upstream
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/near-notfaraway/stevedore/sd_config"
+	"github.com/near-notfaraway/stevedore/sd_util"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+//------------------------------------------------------------------------------
+// Condition: Used to decide if data matches a route
+//------------------------------------------------------------------------------
+
+type Condition interface {
+	Match(pkt *Packet) bool // should not allocate memory
+	String() string         // readable expression of condition
+}
+
+// Create condition tree from config
+// Returns ErrorList contains all invalid fields
+func NewCondition(config *sd_config.ConditionConfig) (Condition, error) {
+	if config == nil {
+		return nil, sd_config.NewFieldError("", "is missing")
+	}
+
+	// only one kind of condition should be set
+	kinds := 0
+	for _, set := range []bool{config.And != nil, config.Or != nil, config.Not != nil,
+		isLeafConditionConfig(config), config.SrcCIDR != "", config.SrcPort != "", config.Length != "",
+		config.DNSSuffix != "", config.DNSQType != "", config.DNSOpcode != "", config.DNSFlags != ""} {
+		if set {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return nil, sd_config.NewFieldError("", "should set only one of And, Or, Not, KeyBytes, KeyExtractor, SrcCIDR, "+
+			"SrcPort, Length, DNSSuffix, DNSQType, DNSOpcode or DNSFlags")
+	}
+
+	switch {
+	case config.And != nil:
+		conds, err := newSubConditions("And", config.And)
+		if err != nil {
+			return nil, err
+		}
+		return andCondition(conds), nil
+
+	case config.Or != nil:
+		conds, err := newSubConditions("Or", config.Or)
+		if err != nil {
+			return nil, err
+		}
+		return orCondition(conds), nil
+
+	case config.Not != nil:
+		cond, err := NewCondition(config.Not)
+		if err != nil {
+			return nil, sd_config.WithPath("Not", err)
+		}
+		return &notCondition{cond: cond}, nil
+
+	case config.SrcCIDR != "":
+		cond, err := newSrcCIDRCondition(config.SrcCIDR)
+		if err != nil {
+			return nil, sd_config.WithPath("SrcCIDR", err)
+		}
+		return cond, nil
+
+	case config.SrcPort != "":
+		cond, err := newSrcPortCondition(config.SrcPort)
+		if err != nil {
+			return nil, sd_config.WithPath("SrcPort", err)
+		}
+		return cond, nil
+
+	case config.Length != "":
+		cond, err := newLengthCondition(config.Length)
+		if err != nil {
+			return nil, sd_config.WithPath("Length", err)
+		}
+		return cond, nil
+
+	case config.DNSSuffix != "":
+		cond, err := newDNSSuffixCondition(config.DNSSuffix)
+		if err != nil {
+			return nil, sd_config.WithPath("DNSSuffix", err)
+		}
+		return cond, nil
+
+	case config.DNSQType != "":
+		cond, err := newDNSQTypeCondition(config.DNSQType)
+		if err != nil {
+			return nil, sd_config.WithPath("DNSQType", err)
+		}
+		return cond, nil
+
+	case config.DNSOpcode != "":
+		cond, err := newDNSOpcodeCondition(config.DNSOpcode)
+		if err != nil {
+			return nil, sd_config.WithPath("DNSOpcode", err)
+		}
+		return cond, nil
+
+	case config.DNSFlags != "":
+		cond, err := newDNSFlagsCondition(config.DNSFlags)
+		if err != nil {
+			return nil, sd_config.WithPath("DNSFlags", err)
+		}
+		return cond, nil
+	}
+
+	return newLeafCondition(config)
+}
+
+// Return if any field of leaf condition is set
+func isLeafConditionConfig(config *sd_config.ConditionConfig) bool {
+	return config.KeyBytes != "" || config.KeyExtractor != "" || config.Operator != "" || config.Value != "" || config.Endian != "" ||
+		config.ScanLimit != 0
+}
+
+func newSubConditions(path string, configs []*sd_config.ConditionConfig) ([]Condition, error) {
+	if len(configs) == 0 {
+		return nil, sd_config.NewFieldError(path, "should not be empty")
+	}
+
+	var errs sd_config.ErrorList
+	conds := make([]Condition, 0, len(configs))
+	for i, config := range configs {
+		cond, err := NewCondition(config)
+		errs.Add(fmt.Sprintf("%s[%d]", path, i), err)
+		conds = append(conds, cond)
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return conds, nil
+}
+
+// Match if all sub conditions match
+type andCondition []Condition
+
+func (c andCondition) Match(pkt *Packet) bool {
+	for _, cond := range c {
+		if !cond.Match(pkt) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c andCondition) String() string {
+	return joinConditions(c, " && ")
+}
+
+// Match if any sub condition matches
+type orCondition []Condition
+
+func (c orCondition) Match(pkt *Packet) bool {
+	for _, cond := range c {
+		if cond.Match(pkt) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c orCondition) String() string {
+	return joinConditions(c, " || ")
+}
+
+func joinConditions(conds []Condition, sep string) string {
+	strs := make([]string, 0, len(conds))
+	for _, cond := range conds {
+		strs = append(strs, cond.String())
+	}
+	return "(" + strings.Join(strs, sep) + ")"
+}
+
+// Match if sub condition not matches
+type notCondition struct {
+	cond Condition
+}
+
+func (c *notCondition) Match(pkt *Packet) bool {
+	return !c.cond.Match(pkt)
+}
+
+func (c *notCondition) String() string {
+	return "!" + c.cond.String()
+}
+
+// Create leaf condition whose key bytes operate with value, by bytes, numeric or search operator
+// Returns ErrorList contains all invalid fields
+func newLeafCondition(config *sd_config.ConditionConfig) (Condition, error) {
+	var errs sd_config.ErrorList
+	isSearch := sd_util.IsSearchOperator(config.Operator)
+
+	// init key spec or key extractor, which is optional for search operators
+	var key KeyExtractor
+	switch {
+	case config.KeyExtractor != "":
+		if config.KeyBytes != "" {
+			errs = append(errs, sd_config.NewFieldError("KeyBytes", "should not be set with KeyExtractor"))
+		}
+		if extractor, err := parseKeyExtractor(config.KeyExtractor); err != nil {
+			errs.Add("KeyExtractor", err)
+		} else {
+			key = extractor
+		}
+	case !isSearch || config.KeyBytes != "":
+		if spec, err := parseKeySpec(config.KeyBytes); err != nil {
+			errs.Add("KeyBytes", err)
+		} else {
+			key = spec
+		}
+	}
+	if config.Endian != "" && !sd_util.IsNumOperator(config.Operator) {
+		errs = append(errs, sd_config.NewFieldError("Endian", "only works with numeric operators"))
+	}
+	if config.ScanLimit != 0 && !isSearch {
+		errs = append(errs, sd_config.NewFieldError("ScanLimit", "only works with search operators"))
+	}
+
+	// init operator and value
+	var cond Condition
+	var err error
+	switch {
+	case sd_util.IsBytesOperator(config.Operator):
+		cond, err = newBytesCondition(key, config.Operator, config.Value)
+		errs.Add("", err)
+
+	case sd_util.IsNumOperator(config.Operator):
+		cond, err = newNumCondition(key, config)
+		errs.Add("", err)
+
+	case isSearch:
+		cond, err = newSearchCondition(key, config)
+		errs.Add("", err)
+
+	default:
+		// value is still checked as bytes
+		errs = append(errs, sd_config.NewFieldError("Operator", "invalid operator %q", config.Operator))
+		_, err = newBytesCondition(key, config.Operator, config.Value)
+		errs.Add("", err)
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return cond, nil
+}
+
+// Match if key operates with value returns true
+type bytesCondition struct {
+	operator   string       // bytes operation type
+	key        KeyExtractor // used to extract key from data
+	bytesValue []byte       // bytes used to operate with key
+}
+
+// Check length of value only if key is valid and its length is fixed
+// Key with variable length never matches if its length is not equal to value
+func newBytesCondition(key KeyExtractor, operator, value string) (*bytesCondition, error) {
+	bytesValue, err := sd_util.StringToBytes(value)
+	if err != nil {
+		return nil, sd_config.WithPath("Value", err)
+	}
+	if key != nil {
+		if keyLen, fixed := keyFixedLen(key); fixed && len(bytesValue) != keyLen {
+			return nil, sd_config.NewFieldError("Value",
+				"value %s length %d is not equal to bytes length %d", value, len(bytesValue), keyLen)
+		}
+	}
+
+	return &bytesCondition{
+		operator:   operator,
+		key:        key,
+		bytesValue: bytesValue,
+	}, nil
+}
+
+func (c *bytesCondition) Match(pkt *Packet) bool {
+	// data too short
+	key, ok := extractKey(c.key, pkt)
+	if !ok {
+		return false
+	}
+
+	// operator is checked when created, returns false if length mismatch
+	matched, _ := sd_util.BytesOperate(c.operator, key, c.bytesValue)
+	return matched
+}
+
+func (c *bytesCondition) String() string {
+	return fmt.Sprintf("%s %s 0x%x", c.key.String(), c.operator, c.bytesValue)
+}
+
+// Match if key as unsigned integer operates with operands returns true
+type numCondition struct {
+	operator     string       // numeric operation type
+	key          KeyExtractor // used to extract key from data
+	littleEndian bool         // byte order of key
+	operands     []uint64     // integers used to operate with key
+	mask         uint64       // mask applied to key before operating, 0 means no mask
+	negate       bool         // if result is negated, key which can not be extracted still never matches
+}
+
+// Value is an integer for comparison, `min:max` for in-range and `a,b,c` for in-set
+// Check if operands overflow only if key is valid and its length is fixed
+// Key with variable length never matches if its length exceeds 8
+func newNumCondition(key KeyExtractor, config *sd_config.ConditionConfig) (*numCondition, error) {
+	var errs sd_config.ErrorList
+	cond := &numCondition{
+		operator: config.Operator,
+		key:      key,
+	}
+
+	// init endian
+	switch config.Endian {
+	case "", sd_util.EndianBig:
+	case sd_util.EndianLittle:
+		cond.littleEndian = true
+	default:
+		errs = append(errs, sd_config.NewFieldError("Endian", "should be %s or %s",
+			sd_util.EndianBig, sd_util.EndianLittle))
+	}
+
+	// init operands
+	var strs []string
+	switch config.Operator {
+	case sd_util.NumOpInRange:
+		if strs = strings.Split(config.Value, ":"); len(strs) != 2 {
+			errs = append(errs, sd_config.NewFieldError("Value", "value %q should be in form min:max", config.Value))
+			strs = nil
+		}
+	case sd_util.NumOpInSet:
+		strs = strings.Split(config.Value, ",")
+	default:
+		strs = []string{config.Value}
+	}
+	for _, str := range strs {
+		operand, err := sd_util.StringToUint(strings.TrimSpace(str))
+		if err != nil {
+			errs.Add("Value", err)
+			continue
+		}
+		cond.operands = append(cond.operands, operand)
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	if config.Operator == sd_util.NumOpInRange && cond.operands[0] > cond.operands[1] {
+		return nil, sd_config.NewFieldError("Value", "min of range %q is greater than max", config.Value)
+	}
+	if key == nil {
+		return cond, nil
+	}
+	if keyLen, fixed := keyFixedLen(key); fixed {
+		if keyLen > 8 {
+			return nil, sd_config.NewFieldError(keyField(key), "bytes length %d exceeds 8 for numeric operator", keyLen)
+		}
+		for _, operand := range cond.operands {
+			if keyLen < 8 && operand >= 1<<(8*keyLen) {
+				return nil, sd_config.NewFieldError("Value", "value %d overflows bytes length %d", operand, keyLen)
+			}
+		}
+	}
+
+	return cond, nil
+}
+
+func (c *numCondition) Match(pkt *Packet) bool {
+	// data too short or key too long
+	key, ok := extractKey(c.key, pkt)
+	if !ok || len(key) > 8 {
+		return false
+	}
+
+	// operator and operands are checked when created
+	val := sd_util.BytesToUint(key, c.littleEndian)
+	if c.mask != 0 {
+		val &= c.mask
+	}
+	matched, _ := sd_util.NumOperate(c.operator, val, c.operands)
+	return matched != c.negate
+}
+
+func (c *numCondition) String() string {
+	key := c.key.String()
+	if c.littleEndian {
+		key += "(le)"
+	}
+	if c.mask != 0 {
+		key += fmt.Sprintf(" & 0x%x", c.mask)
+	}
+
+	var value string
+	switch c.operator {
+	case sd_util.NumOpInRange:
+		value = fmt.Sprintf("%d:%d", c.operands[0], c.operands[1])
+	case sd_util.NumOpInSet:
+		strs := make([]string, 0, len(c.operands))
+		for _, operand := range c.operands {
+			strs = append(strs, strconv.FormatUint(operand, 10))
+		}
+		value = strings.Join(strs, ",")
+	default:
+		value = strconv.FormatUint(c.operands[0], 10)
+	}
+	if c.negate {
+		return fmt.Sprintf("!%s %s %s", key, c.operator, value)
+	}
+	return fmt.Sprintf("%s %s %s", key, c.operator, value)
+}
+
+// Default max bytes scanned by search operators
+const defaultScanLimit = 512
+
+// Match if key, or the whole data if no key, contains bytes or matches regular expression
+// Only the first scanLimit bytes are scanned
+type searchCondition struct {
+	operator  string         // search operation type
+	key       KeyExtractor   // used to extract window from data, nil means the whole data
+	scanLimit int            // max bytes scanned
+	value     string         // origin value
+	pattern   []byte         // bytes searched by contains
+	regexp    *regexp.Regexp // regular expression used by match, each byte is read as a rune
+}
+
+// Value is hex or bit string for contains, regular expression for match
+func newSearchCondition(key KeyExtractor, config *sd_config.ConditionConfig) (*searchCondition, error) {
+	var errs sd_config.ErrorList
+	cond := &searchCondition{
+		operator:  config.Operator,
+		key:       key,
+		scanLimit: config.ScanLimit,
+		value:     config.Value,
+	}
+	if cond.scanLimit == 0 {
+		cond.scanLimit = defaultScanLimit
+	}
+	if cond.scanLimit < 0 {
+		errs = append(errs, sd_config.NewFieldError("ScanLimit", "should not be negative"))
+	}
+
+	var err error
+	switch config.Operator {
+	case sd_util.SearchOpContains:
+		if cond.pattern, err = sd_util.StringToBytes(config.Value); err != nil {
+			errs.Add("Value", err)
+		}
+	case sd_util.SearchOpMatch:
+		if cond.regexp, err = regexp.Compile(config.Value); err != nil {
+			errs.Add("Value", err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return cond, nil
+}
+
+func (c *searchCondition) Match(pkt *Packet) bool {
+	data := pkt.Data
+	if c.key != nil {
+		var ok bool
+		if data, ok = extractKey(c.key, pkt); !ok {
+			return false
+		}
+	}
+	if len(data) > c.scanLimit {
+		data = data[:c.scanLimit]
+	}
+
+	if c.regexp != nil {
+		pkt.latin1.Reset(data)
+		return c.regexp.MatchReader(&pkt.latin1)
+	}
+	return bytes.Contains(data, c.pattern)
+}
+
+func (c *searchCondition) String() string {
+	var window string
+	if c.key != nil {
+		window = c.key.String() + " "
+	}
+	if c.regexp != nil {
+		return fmt.Sprintf("%smatch %q", window, c.value)
+	}
+	return fmt.Sprintf("%scontains 0x%x", window, c.pattern)
+}
+
+// Match if source ip is in any of cidrs
+type srcCIDRCondition struct {
+	cidrs []string   // origin cidrs
+	ips   [][16]byte // network ips in 16-byte form
+	masks [][16]byte // network masks in 16-byte form
+}
+
+func newSrcCIDRCondition(value string) (*srcCIDRCondition, error) {
+	cond := &srcCIDRCondition{}
+	for _, cidr := range strings.Split(value, ",") {
+		cidr = strings.TrimSpace(cidr)
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %q", cidr)
+		}
+
+		// ipv4 network is mapped to ipv6 form
+		var ip, mask [16]byte
+		copy(ip[:], ipNet.IP.To16())
+		if len(ipNet.Mask) == net.IPv4len {
+			for i := 0; i < 12; i++ {
+				mask[i] = 0xff
+			}
+			copy(mask[12:], ipNet.Mask)
+		} else {
+			copy(mask[:], ipNet.Mask)
+		}
+
+		cond.cidrs = append(cond.cidrs, cidr)
+		cond.ips = append(cond.ips, ip)
+		cond.masks = append(cond.masks, mask)
+	}
+
+	return cond, nil
+}
+
+func (c *srcCIDRCondition) Match(pkt *Packet) bool {
+	ip, _, ok := pkt.srcAddr()
+	if !ok {
+		return false
+	}
+
+	for i := range c.ips {
+		matched := true
+		for j := 0; j < len(ip); j++ {
+			if ip[j]&c.masks[i][j] != c.ips[i][j] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *srcCIDRCondition) String() string {
+	return "src in " + strings.Join(c.cidrs, ",")
+}
+
+// Match if source port is in range [min, max]
+type srcPortCondition struct {
+	min int // min port
+	max int // max port
+}
+
+func newSrcPortCondition(value string) (*srcPortCondition, error) {
+	strs := strings.Split(value, ":")
+	if len(strs) > 2 {
+		return nil, fmt.Errorf("source port %q should be in form port or min:max", value)
+	}
+
+	ports := make([]int, 0, len(strs))
+	for _, str := range strs {
+		port, err := strconv.Atoi(str)
+		if err != nil || port < 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid source port %q", str)
+		}
+		ports = append(ports, port)
+	}
+	cond := &srcPortCondition{min: ports[0], max: ports[len(ports)-1]}
+	if cond.min > cond.max {
+		return nil, fmt.Errorf("min of source port range %q is greater than max", value)
+	}
+
+	return cond, nil
+}
+
+func (c *srcPortCondition) Match(pkt *Packet) bool {
+	_, port, ok := pkt.srcAddr()
+	return ok && c.min <= port && port <= c.max
+}
+
+func (c *srcPortCondition) String() string {
+	if c.min == c.max {
+		return fmt.Sprintf("sport == %d", c.min)
+	}
+	return fmt.Sprintf("sport in %d:%d", c.min, c.max)
+}
+
+// Match if length of payload is in range [min, max], max is -1 if unlimited
+type lengthCondition struct {
+	min int // min length
+	max int // max length, -1 means unlimited
+}
+
+// Value in form len, min:, :max or min:max
+func newLengthCondition(value string) (*lengthCondition, error) {
+	strs := strings.Split(value, ":")
+	if len(strs) > 2 {
+		return nil, fmt.Errorf("length %q should be in form len, min:, :max or min:max", value)
+	}
+
+	lens := make([]int, 0, len(strs))
+	for i, str := range strs {
+		// only one side can be omitted in range
+		if str == "" && len(strs) == 2 && strs[1-i] != "" {
+			lens = append(lens, -1)
+			continue
+		}
+		length, err := strconv.Atoi(str)
+		if err != nil || length < 0 {
+			return nil, fmt.Errorf("invalid length %q", str)
+		}
+		lens = append(lens, length)
+	}
+
+	cond := &lengthCondition{min: lens[0], max: lens[len(lens)-1]}
+	if cond.min < 0 {
+		cond.min = 0
+	}
+	if cond.max >= 0 && cond.min > cond.max {
+		return nil, fmt.Errorf("min of length range %q is greater than max", value)
+	}
+	return cond, nil
+}
+
+func (c *lengthCondition) Match(pkt *Packet) bool {
+	return len(pkt.Data) >= c.min && (c.max < 0 || len(pkt.Data) <= c.max)
+}
+
+func (c *lengthCondition) String() string {
+	switch {
+	case c.min == c.max:
+		return fmt.Sprintf("len == %d", c.min)
+	case c.max < 0:
+		return fmt.Sprintf("len >= %d", c.min)
+	}
+	return fmt.Sprintf("len in %d:%d", c.min, c.max)
+}
@@ -0,0 +1,204 @@
+package sd_upstream
+
+import (
+	"github.com/near-notfaraway/stevedore/sd_config"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+	"testing"
+)
+
+// ver == 0x02 AND flag &= 0x80 AND NOT cmd == 0xff
+func testConditionConfig() *sd_config.ConditionConfig {
+	return &sd_config.ConditionConfig{And: []*sd_config.ConditionConfig{
+		{KeyBytes: "4:6", Operator: "==", Value: "0x0002"},
+		{KeyBytes: "0:1", Operator: "&=", Value: "0x80"},
+		{Not: &sd_config.ConditionConfig{KeyBytes: "6:7", Operator: "==", Value: "0xff"}},
+	}}
+}
+
+// Compound condition matching
+func TestCondition_Match(t *testing.T) {
+	cond, err := NewCondition(testConditionConfig())
+	assert.Nil(t, err)
+	assert.Equal(t, "(4:6 == 0x0002 && 0:1 &= 0x80 && !6:7 == 0xff)", cond.String())
+
+	assert.True(t, cond.Match(&Packet{Data: []byte{0x81, 0, 0, 0, 0, 2, 0x01}}))
+	assert.False(t, cond.Match(&Packet{Data: []byte{0x01, 0, 0, 0, 0, 2, 0x01}}))
+	assert.False(t, cond.Match(&Packet{Data: []byte{0x81, 0, 0, 0, 0, 2, 0xff}}))
+	assert.False(t, cond.Match(&Packet{Data: []byte{0x81, 0, 0, 0, 0}}))
+
+	or, err := NewCondition(&sd_config.ConditionConfig{Or: []*sd_config.ConditionConfig{
+		{KeyBytes: "0:1", Operator: "==", Value: "0x01"},
+		{KeyBytes: "0:1", Operator: "==", Value: "0x02"},
+	}})
+	assert.Nil(t, err)
+	assert.True(t, or.Match(&Packet{Data: []byte{0x02}}))
+	assert.False(t, or.Match(&Packet{Data: []byte{0x03}}))
+
+	// evaluated without allocation
+	pkt := &Packet{Data: []byte{0x81, 0, 0, 0, 0, 2, 0x01}}
+	allocs := testing.AllocsPerRun(100, func() { cond.Match(pkt) })
+	assert.Equal(t, float64(0), allocs)
+}
+
+// Numeric condition in big or little endian
+func TestCondition_MatchNum(t *testing.T) {
+	cond, err := NewCondition(&sd_config.ConditionConfig{KeyBytes: "4:6", Operator: "in-range", Value: "3:7"})
+	assert.Nil(t, err)
+	assert.Equal(t, "4:6 in-range 3:7", cond.String())
+	assert.True(t, cond.Match(&Packet{Data: []byte{0, 0, 0, 0, 0, 3}}))
+	assert.False(t, cond.Match(&Packet{Data: []byte{0, 0, 0, 0, 3, 0}}))
+
+	cond, err = NewCondition(&sd_config.ConditionConfig{
+		KeyBytes: "0:4", Operator: "in-set", Value: "1, 0x10, 0b11", Endian: "little"})
+	assert.Nil(t, err)
+	assert.Equal(t, "0:4(le) in-set 1,16,3", cond.String())
+	assert.True(t, cond.Match(&Packet{Data: []byte{0x10, 0, 0, 0}}))
+	assert.False(t, cond.Match(&Packet{Data: []byte{0, 0, 0, 0x10}}))
+
+	cond, err = NewCondition(&sd_config.ConditionConfig{KeyBytes: "0:1", Operator: ">=", Value: "200"})
+	assert.Nil(t, err)
+	assert.True(t, cond.Match(&Packet{Data: []byte{200}}))
+	assert.False(t, cond.Match(&Packet{Data: []byte{199}}))
+}
+
+// Source address condition combined with bytes condition
+func TestCondition_MatchSrc(t *testing.T) {
+	cond, err := NewCondition(&sd_config.ConditionConfig{And: []*sd_config.ConditionConfig{
+		{SrcCIDR: "10.0.0.0/8, 192.168.1.0/24, fd00::/8"},
+		{SrcPort: "1000:2000"},
+		{KeyBytes: "0:1", Operator: "==", Value: "0x01"},
+	}})
+	assert.Nil(t, err)
+	assert.Equal(t, "(src in 10.0.0.0/8,192.168.1.0/24,fd00::/8 && sport in 1000:2000 && 0:1 == 0x01)",
+		cond.String())
+
+	data := []byte{0x01}
+	assert.True(t, cond.Match(&Packet{Data: data,
+		Sockaddr: &unix.SockaddrInet4{Addr: [4]byte{10, 1, 2, 3}, Port: 1000}}))
+	assert.True(t, cond.Match(&Packet{Data: data,
+		Sockaddr: &unix.SockaddrInet6{Addr: [16]byte{0xfd, 15: 1}, Port: 2000}}))
+	assert.False(t, cond.Match(&Packet{Data: data,
+		Sockaddr: &unix.SockaddrInet4{Addr: [4]byte{192, 168, 2, 1}, Port: 1000}}))
+	assert.False(t, cond.Match(&Packet{Data: data,
+		Sockaddr: &unix.SockaddrInet4{Addr: [4]byte{10, 1, 2, 3}, Port: 2001}}))
+	assert.False(t, cond.Match(&Packet{Data: data}))
+
+	pkt := &Packet{Data: data, Sockaddr: &unix.SockaddrInet4{Addr: [4]byte{10, 1, 2, 3}, Port: 1000}}
+	allocs := testing.AllocsPerRun(100, func() { cond.Match(pkt) })
+	assert.Equal(t, float64(0), allocs)
+}
+
+// Key relative to the end of data or a length-prefixed field
+func TestCondition_MatchKeySpec(t *testing.T) {
+	cond, err := NewCondition(&sd_config.ConditionConfig{KeyBytes: "-2:", Operator: "==", Value: "0xbeef"})
+	assert.Nil(t, err)
+	assert.True(t, cond.Match(&Packet{Data: []byte{1, 2, 3, 0xbe, 0xef}}))
+	assert.False(t, cond.Match(&Packet{Data: []byte{0xef}}))
+
+	cond, err = NewCondition(&sd_config.ConditionConfig{KeyBytes: "0#1", Operator: ">", Value: "0x0100"})
+	assert.Nil(t, err)
+	assert.True(t, cond.Match(&Packet{Data: []byte{2, 1, 1}}))
+	assert.False(t, cond.Match(&Packet{Data: []byte{1, 1}}))
+
+	_, err = NewCondition(&sd_config.ConditionConfig{KeyBytes: "-4:-2", Operator: "==", Value: "0xbeef00"})
+	assert.NotNil(t, err)
+}
+
+// Length condition in form len, min:, :max or min:max
+func TestCondition_MatchLength(t *testing.T) {
+	for value, expect := range map[string][]bool{
+		"4":   {false, true, false},
+		"4:":  {false, true, true},
+		":4":  {true, true, false},
+		"2:4": {true, true, false},
+	} {
+		cond, err := NewCondition(&sd_config.ConditionConfig{Length: value})
+		assert.Nil(t, err)
+		for i, length := range []int{3, 4, 5} {
+			assert.Equal(t, expect[i], cond.Match(&Packet{Data: make([]byte, length)}), value)
+		}
+	}
+
+	for _, value := range []string{":", "-1", "4:2", "1:2:3", "a:"} {
+		_, err := NewCondition(&sd_config.ConditionConfig{Length: value})
+		assert.NotNil(t, err, value)
+	}
+}
+
+// Search condition on the whole data or a window, only scanLimit bytes are scanned
+func TestCondition_MatchSearch(t *testing.T) {
+	cond, err := NewCondition(&sd_config.ConditionConfig{Operator: "contains", Value: "0xcafe"})
+	assert.Nil(t, err)
+	assert.Equal(t, "contains 0xcafe", cond.String())
+	assert.True(t, cond.Match(&Packet{Data: []byte{0, 1, 0xca, 0xfe, 2}}))
+	assert.False(t, cond.Match(&Packet{Data: []byte{0, 1, 0xca, 0xff, 0xfe}}))
+
+	cond, err = NewCondition(&sd_config.ConditionConfig{
+		KeyBytes: "2:", Operator: "contains", Value: "0xcafe", ScanLimit: 3})
+	assert.Nil(t, err)
+	assert.Equal(t, "2: contains 0xcafe", cond.String())
+	assert.True(t, cond.Match(&Packet{Data: []byte{0, 0, 0, 0xca, 0xfe}}))
+	assert.False(t, cond.Match(&Packet{Data: []byte{0xca, 0xfe, 0, 0}}))
+	assert.False(t, cond.Match(&Packet{Data: []byte{0, 0, 0, 0, 0xca, 0xfe}}))
+
+	cond, err = NewCondition(&sd_config.ConditionConfig{Operator: "match", Value: `tenant=[a-z]+\xff`})
+	assert.Nil(t, err)
+	assert.Equal(t, `match "tenant=[a-z]+\\xff"`, cond.String())
+	assert.True(t, cond.Match(&Packet{Data: append([]byte{0x80, 0x01, 't'}, "tenant=abc\xff"...)}))
+	assert.False(t, cond.Match(&Packet{Data: []byte("tenant=abc\xfe")}))
+	assert.False(t, cond.Match(&Packet{Data: []byte("tenant=\xff")}))
+
+	// evaluated without allocation
+	if !raceEnabled {
+		pkt := &Packet{Data: []byte("....tenant=abc\xff")}
+		allocs := testing.AllocsPerRun(100, func() { cond.Match(pkt) })
+		assert.Equal(t, float64(0), allocs)
+	}
+}
+
+// All errors in condition tree should be reported with json path
+func TestNewCondition(t *testing.T) {
+	_, err := NewCondition(&sd_config.ConditionConfig{And: []*sd_config.ConditionConfig{
+		{KeyBytes: "4:6", Operator: "==", Value: "0x02"},
+		{Or: []*sd_config.ConditionConfig{}},
+		{Not: &sd_config.ConditionConfig{KeyBytes: "6:7", Operator: "=", Value: "0xff"}},
+		{KeyBytes: "0:1", Operator: "==", Value: "0x01", Not: &sd_config.ConditionConfig{}},
+		{KeyBytes: "0:1", Operator: "==", Value: "0x01", Endian: "little"},
+		{KeyBytes: "0:1", Operator: "<", Value: "256"},
+		{KeyBytes: "0:2", Operator: "in-range", Value: "7:3"},
+		{KeyBytes: "0:9", Operator: "in-set", Value: "1,x", Endian: "middle"},
+		{SrcCIDR: "10.0.0.0/33"},
+		{SrcPort: "2000:1000"},
+		{SrcPort: "1000", SrcCIDR: "10.0.0.0/8"},
+		{KeyBytes: "0:1", Operator: "==", Value: "0x01", ScanLimit: 16},
+		{Operator: "match", Value: "(", ScanLimit: -1},
+		{KeyBytes: "2", Operator: "contains", Value: "cafe"},
+	}})
+	errs, ok := err.(sd_config.ErrorList)
+	assert.True(t, ok)
+
+	paths := make([]string, 0, len(errs))
+	for _, e := range errs {
+		paths = append(paths, e.(*sd_config.FieldError).Path)
+	}
+	assert.Equal(t, []string{
+		"And[0].Value",
+		"And[1].Or",
+		"And[2].Not.Operator",
+		"And[3]",
+		"And[4].Endian",
+		"And[5].Value",
+		"And[6].Value",
+		"And[7].Endian",
+		"And[7].Value",
+		"And[8].SrcCIDR",
+		"And[9].SrcPort",
+		"And[10]",
+		"And[11].ScanLimit",
+		"And[12].ScanLimit",
+		"And[12].Value",
+		"And[13].KeyBytes",
+		"And[13].Value",
+	}, paths)
+}
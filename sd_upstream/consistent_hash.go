@@ -32,7 +32,7 @@ type ConsistentHash struct {
 	lookupTableMutex sync.RWMutex
 }
 
-func NewConsistentHash(peers []*Peer) *ConsistentHash {
+func NewConsistentHash(peers []*Peer) (*ConsistentHash, error) {
 	c := &ConsistentHash{
 		cache:       make(map[string]*Peer),
 		lookupTable: make([]*Peer, LookupTableSize),
@@ -40,10 +40,10 @@ func NewConsistentHash(peers []*Peer) *ConsistentHash {
 
 	// init lookup table
 	if err := c.UpdateLookupTable(peers, true); err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	return c
+	return c, nil
 }
 
 func (c *ConsistentHash) UpdateLookupTable(peers []*Peer, init bool) error {
@@ -82,9 +82,11 @@ func (c *ConsistentHash) UpdateLookupTable(peers []*Peer, init bool) error {
 
 	// get max weight
 	maxWeight := 0
-	for _, peer := range peers {
-		if peer.weight > maxWeight {
-			maxWeight = peer.weight
+	weights := make([]int, len(peers))
+	for i, peer := range peers {
+		weights[i] = peer.getWeight()
+		if weights[i] > maxWeight {
+			maxWeight = weights[i]
 		}
 	}
 
@@ -106,7 +108,7 @@ func (c *ConsistentHash) UpdateLookupTable(peers []*Peer, init bool) error {
 	for {
 		// find next peer
 		for i, peer := range peers {
-			accumulatedWeights[i] += peer.weight
+			accumulatedWeights[i] += weights[i]
 			if accumulatedWeights[i] >= maxWeight {
 				accumulatedWeights[i] -= maxWeight
 
@@ -151,3 +153,17 @@ func (c *ConsistentHash) SelectPeer(key []byte) *Peer {
 	posInLookupTable := time33HashValue(key, 1) % uint(len(c.lookupTable))
 	return c.lookupTable[posInLookupTable]
 }
+
+// Return number of slots owned by each peer in lookup table
+func (c *ConsistentHash) TableShare() map[string]int {
+	c.lookupTableMutex.RLock()
+	defer c.lookupTableMutex.RUnlock()
+
+	share := make(map[string]int)
+	for _, peer := range c.lookupTable {
+		if peer != nil {
+			share[peer.addr] += 1
+		}
+	}
+	return share
+}
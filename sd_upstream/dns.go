@@ -0,0 +1,324 @@
+package sd_upstream
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/near-notfaraway/stevedore/sd_config"
+	"strconv"
+	"strings"
+)
+
+//------------------------------------------------------------------------------
+// DNS: Used to route and hash dns queries by header and question
+//------------------------------------------------------------------------------
+
+const (
+	dnsHeaderLen  = 12
+	maxDNSNameLen = 255 // max length of name in wire format
+	maxDNSLabel   = 63  // max length of label
+
+	dnsFlagQR     = 0x8000
+	dnsOpcodeMask = 0x7800
+	dnsOpcodeBit  = 11
+)
+
+// Actions on malformed query of dns mode
+const (
+	DNSMalformedDrop    = "drop"    // drop malformed query
+	DNSMalformedForward = "forward" // route malformed query as usual, dns conditions of it never match
+)
+
+// Flag bits of dns header, which can be matched by DNSFlags
+var dnsFlags = map[string]uint16{
+	"aa": 0x0400, "tc": 0x0200, "rd": 0x0100, "ra": 0x0080, "z": 0x0040, "ad": 0x0020, "cd": 0x0010,
+}
+
+var dnsOpcodes = map[string]uint16{
+	"QUERY": 0, "IQUERY": 1, "STATUS": 2, "NOTIFY": 4, "UPDATE": 5,
+}
+
+var dnsQTypes = map[string]uint16{
+	"A": 1, "NS": 2, "CNAME": 5, "SOA": 6, "PTR": 12, "MX": 15, "TXT": 16, "AAAA": 28, "SRV": 33,
+	"NAPTR": 35, "DS": 43, "RRSIG": 46, "NSEC": 47, "DNSKEY": 48, "SVCB": 64, "HTTPS": 65,
+	"IXFR": 251, "AXFR": 252, "ANY": 255, "CAA": 257,
+}
+
+// Header and the only question of dns query, qname is a sub slice of packet
+type dnsQuery struct {
+	flags uint16 // flags of header, including opcode
+	qname []byte // name in wire format, ends with root label
+	qtype uint16 // type of question
+}
+
+// Parse dns query, ok is false if data is not a query with one question, or name is compressed or too long
+func parseDNSQuery(data []byte) (q dnsQuery, ok bool) {
+	if len(data) < dnsHeaderLen {
+		return q, false
+	}
+	q.flags = binary.BigEndian.Uint16(data[2:])
+	if q.flags&dnsFlagQR != 0 || binary.BigEndian.Uint16(data[4:]) != 1 {
+		return q, false
+	}
+
+	// labels end with root label, compression pointer is not expected in question
+	off := dnsHeaderLen
+	for {
+		if off >= len(data) {
+			return q, false
+		}
+		n := int(data[off])
+		if n > maxDNSLabel {
+			return q, false
+		}
+		off += 1 + n
+		if off-dnsHeaderLen > maxDNSNameLen {
+			return q, false
+		}
+		if n == 0 {
+			break
+		}
+	}
+	if off+4 > len(data) {
+		return q, false
+	}
+
+	q.qname = data[dnsHeaderLen:off]
+	q.qtype = binary.BigEndian.Uint16(data[off:])
+	return q, true
+}
+
+func (q *dnsQuery) opcode() uint16 {
+	return (q.flags & dnsOpcodeMask) >> dnsOpcodeBit
+}
+
+// Write lowercase qname into buf, returns sub slice of buf
+func (q *dnsQuery) lowerQName(buf []byte) []byte {
+	for i, b := range q.qname {
+		buf[i] = toLowerASCII(b)
+	}
+	return buf[:len(q.qname)]
+}
+
+// Convert domain to lowercase name in wire format, trailing dot is optional and "." is the root
+func dnsNameToWire(domain string) ([]byte, error) {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	wire := make([]byte, 0, len(domain)+2)
+	if domain != "" {
+		for _, label := range strings.Split(domain, ".") {
+			if len(label) == 0 || len(label) > maxDNSLabel {
+				return nil, fmt.Errorf("invalid domain %q", domain)
+			}
+			wire = append(wire, byte(len(label)))
+			wire = append(wire, label...)
+		}
+	}
+	wire = append(wire, 0)
+	if len(wire) > maxDNSNameLen {
+		return nil, fmt.Errorf("domain %q is too long", domain)
+	}
+	return wire, nil
+}
+
+// Convert name in wire format to domain, the root is "."
+func dnsWireToName(wire []byte) string {
+	var labels []string
+	for off := 0; off < len(wire) && wire[off] != 0; off += 1 + int(wire[off]) {
+		labels = append(labels, string(wire[off+1:off+1+int(wire[off])]))
+	}
+	return strings.Join(labels, ".") + "."
+}
+
+func toLowerASCII(b byte) byte {
+	if 'A' <= b && b <= 'Z' {
+		return b + 'a' - 'A'
+	}
+	return b
+}
+
+// Check dns mode config of listener
+// Returns ErrorList contains all invalid fields
+func checkDNSConfig(config *sd_config.DNSConfig) error {
+	if config == nil {
+		return nil
+	}
+	switch config.Malformed {
+	case "", DNSMalformedDrop, DNSMalformedForward:
+		return nil
+	}
+	return sd_config.NewFieldError("Malformed", "invalid malformed action %q, should be %s or %s",
+		config.Malformed, DNSMalformedDrop, DNSMalformedForward)
+}
+
+// Parse comma separated names or numbers of dns field
+func parseDNSCodes(value, field string, names map[string]uint16, max int) ([]uint16, error) {
+	var codes []uint16
+	for _, str := range strings.Split(value, ",") {
+		str = strings.TrimSpace(str)
+		if code, ok := names[strings.ToUpper(str)]; ok {
+			codes = append(codes, code)
+			continue
+		}
+		code, err := strconv.Atoi(str)
+		if err != nil || code < 0 || code > max {
+			return nil, fmt.Errorf("invalid %s %q", field, str)
+		}
+		codes = append(codes, uint16(code))
+	}
+	return codes, nil
+}
+
+func containsCode(codes []uint16, code uint16) bool {
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// Match if qname of dns query equals or is a subdomain of any of suffixes, case-insensitively
+type dnsSuffixCondition struct {
+	suffixes [][]byte // lowercase names in wire format
+}
+
+func newDNSSuffixCondition(value string) (*dnsSuffixCondition, error) {
+	cond := &dnsSuffixCondition{}
+	for _, domain := range strings.Split(value, ",") {
+		wire, err := dnsNameToWire(strings.TrimSpace(domain))
+		if err != nil {
+			return nil, err
+		}
+		cond.suffixes = append(cond.suffixes, wire)
+	}
+	return cond, nil
+}
+
+func (c *dnsSuffixCondition) Match(pkt *Packet) bool {
+	q, ok := pkt.dnsQuery()
+	if !ok {
+		return false
+	}
+
+	// compare with suffixes at each label boundary of qname
+	for off := 0; off < len(q.qname); off += 1 + int(q.qname[off]) {
+		for _, suffix := range c.suffixes {
+			if len(q.qname)-off == len(suffix) && equalLowerASCII(q.qname[off:], suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Return if data equals lower which is lowercase, label lengths are never letters
+func equalLowerASCII(data, lower []byte) bool {
+	for i := range data {
+		if toLowerASCII(data[i]) != lower[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *dnsSuffixCondition) String() string {
+	strs := make([]string, 0, len(c.suffixes))
+	for _, suffix := range c.suffixes {
+		strs = append(strs, dnsWireToName(suffix))
+	}
+	return "qname suffix " + strings.Join(strs, ",")
+}
+
+// Match if qtype or opcode of dns query is in codes
+type dnsCodeCondition struct {
+	field string   // qtype or opcode
+	value string   // origin value
+	codes []uint16 // qtypes or opcodes
+}
+
+func newDNSQTypeCondition(value string) (*dnsCodeCondition, error) {
+	codes, err := parseDNSCodes(value, "qtype", dnsQTypes, 0xffff)
+	if err != nil {
+		return nil, err
+	}
+	return &dnsCodeCondition{field: "qtype", value: value, codes: codes}, nil
+}
+
+func newDNSOpcodeCondition(value string) (*dnsCodeCondition, error) {
+	codes, err := parseDNSCodes(value, "opcode", dnsOpcodes, 15)
+	if err != nil {
+		return nil, err
+	}
+	return &dnsCodeCondition{field: "opcode", value: value, codes: codes}, nil
+}
+
+func (c *dnsCodeCondition) Match(pkt *Packet) bool {
+	q, ok := pkt.dnsQuery()
+	if !ok {
+		return false
+	}
+	if c.field == "opcode" {
+		return containsCode(c.codes, q.opcode())
+	}
+	return containsCode(c.codes, q.qtype)
+}
+
+func (c *dnsCodeCondition) String() string {
+	return c.field + " in " + c.value
+}
+
+// Match if flags of dns query are set or clear as required, such as rd,!cd
+type dnsFlagsCondition struct {
+	value string // origin value
+	mask  uint16 // flags required
+	bits  uint16 // required value of flags
+}
+
+func newDNSFlagsCondition(value string) (*dnsFlagsCondition, error) {
+	cond := &dnsFlagsCondition{value: value}
+	for _, str := range strings.Split(value, ",") {
+		str = strings.TrimSpace(str)
+		name := strings.TrimPrefix(str, "!")
+		flag, ok := dnsFlags[strings.ToLower(name)]
+		if !ok || cond.mask&flag != 0 {
+			return nil, fmt.Errorf("invalid or duplicated flag %q", str)
+		}
+		cond.mask |= flag
+		if name == str {
+			cond.bits |= flag
+		}
+	}
+	return cond, nil
+}
+
+func (c *dnsFlagsCondition) Match(pkt *Packet) bool {
+	q, ok := pkt.dnsQuery()
+	return ok && q.flags&c.mask == c.bits
+}
+
+func (c *dnsFlagsCondition) String() string {
+	return "flags " + c.value
+}
+
+// Extract lowercase qname in wire format of dns query as key
+type dnsQNameExtractor struct{}
+
+func (e *dnsQNameExtractor) Extract(data, buf []byte) ([]byte, bool) {
+	q, ok := parseDNSQuery(data)
+	if !ok {
+		return nil, false
+	}
+	return q.lowerQName(buf), true
+}
+
+// Extract key from dns query cached in packet
+func (e *dnsQNameExtractor) extractPacket(pkt *Packet) ([]byte, bool) {
+	q, ok := pkt.dnsQuery()
+	if !ok {
+		return nil, false
+	}
+	return q.lowerQName(pkt.keyBuf[:]), true
+}
+
+func (e *dnsQNameExtractor) String() string {
+	return KeyExtractorDNSQName
+}
@@ -0,0 +1,186 @@
+package sd_upstream
+
+import (
+	"encoding/binary"
+	"github.com/near-notfaraway/stevedore/sd_config"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+// Build dns query with one question, case of qname is kept
+func testDNSQuery(flags uint16, qname string, qtype uint16) []byte {
+	data := make([]byte, dnsHeaderLen, 64)
+	binary.BigEndian.PutUint16(data[2:], flags)
+	binary.BigEndian.PutUint16(data[4:], 1)
+	for _, label := range strings.Split(strings.TrimSuffix(qname, "."), ".") {
+		if label != "" {
+			data = append(append(data, byte(len(label))), label...)
+		}
+	}
+	return append(data, 0, byte(qtype>>8), byte(qtype), 0, 1)
+}
+
+// Query should be parsed with header and question, malformed ones are rejected
+func TestParseDNSQuery(t *testing.T) {
+	data := testDNSQuery(0x0100, "WWW.Example.com", 28)
+	q, ok := parseDNSQuery(data)
+	assert.True(t, ok)
+	assert.Equal(t, "WWW.Example.com.", dnsWireToName(q.qname))
+	assert.Equal(t, uint16(28), q.qtype)
+	assert.Equal(t, uint16(0), q.opcode())
+
+	// response, truncated question, compressed name and two questions
+	for _, bad := range [][]byte{
+		testDNSQuery(0x8100, "example.com", 1),
+		data[:len(data)-1],
+		data[:dnsHeaderLen],
+		append(append([]byte{}, data[:dnsHeaderLen]...), 0xc0, 0x0c, 0, 1, 0, 1),
+		append(append([]byte{}, data[:4]...), append([]byte{0, 2}, data[6:]...)...),
+	} {
+		_, ok := parseDNSQuery(bad)
+		assert.False(t, ok, "%x", bad)
+	}
+}
+
+// Dns query should be parsed once for each data set into packet
+func TestPacket_DNSQuery(t *testing.T) {
+	pkt := &Packet{}
+	pkt.Set(testDNSQuery(0x0100, "WWW.Example.com", 1), nil)
+	q, ok := pkt.dnsQuery()
+	assert.True(t, ok)
+	assert.Equal(t, uint16(1), q.qtype)
+
+	// data changed in place is not parsed again until it is set
+	pkt.Data[len(pkt.Data)-3] = 28
+	q, _ = pkt.dnsQuery()
+	assert.Equal(t, uint16(1), q.qtype)
+	pkt.Set(pkt.Data, nil)
+	q, _ = pkt.dnsQuery()
+	assert.Equal(t, uint16(28), q.qtype)
+
+	// key condition of dns-qname uses query cached in packet
+	cond, err := NewCondition(&sd_config.ConditionConfig{
+		KeyExtractor: "dns-qname", Operator: "==", Value: "0x03777777076578616d706c6503636f6d00"})
+	assert.Nil(t, err)
+	assert.True(t, cond.Match(pkt))
+	allocs := testing.AllocsPerRun(100, func() { cond.Match(pkt) })
+	assert.Equal(t, float64(0), allocs)
+
+	pkt.Set([]byte("not a dns query"), nil)
+	_, ok = pkt.dnsQuery()
+	assert.False(t, ok)
+	assert.False(t, cond.Match(pkt))
+}
+
+// Conditions of dns query
+func TestCondition_MatchDNS(t *testing.T) {
+	for suffix, cases := range map[string]map[string]bool{
+		"example.com, Example.ORG.": {
+			"example.com": true, "WWW.EXAMPLE.COM": true, "a.b.example.org": true,
+			"badexample.com": false, "example.co": false, "com": false,
+		},
+		".": {"example.com": true, ".": true},
+	} {
+		cond, err := NewCondition(&sd_config.ConditionConfig{DNSSuffix: suffix})
+		assert.Nil(t, err)
+		for qname, expected := range cases {
+			pkt := &Packet{Data: testDNSQuery(0x0100, qname, 1)}
+			assert.Equal(t, expected, cond.Match(pkt), "%s: %s", cond, qname)
+		}
+	}
+
+	cond, err := NewCondition(&sd_config.ConditionConfig{DNSQType: "A, aaaa, 65"})
+	assert.Nil(t, err)
+	assert.Equal(t, "qtype in A, aaaa, 65", cond.String())
+	assert.True(t, cond.Match(&Packet{Data: testDNSQuery(0, "a.com", 28)}))
+	assert.True(t, cond.Match(&Packet{Data: testDNSQuery(0, "a.com", 65)}))
+	assert.False(t, cond.Match(&Packet{Data: testDNSQuery(0, "a.com", 16)}))
+
+	cond, err = NewCondition(&sd_config.ConditionConfig{DNSOpcode: "NOTIFY,UPDATE"})
+	assert.Nil(t, err)
+	assert.True(t, cond.Match(&Packet{Data: testDNSQuery(4<<11, "a.com", 6)}))
+	assert.False(t, cond.Match(&Packet{Data: testDNSQuery(0x0100, "a.com", 6)}))
+
+	cond, err = NewCondition(&sd_config.ConditionConfig{DNSFlags: "rd,!cd"})
+	assert.Nil(t, err)
+	assert.True(t, cond.Match(&Packet{Data: testDNSQuery(0x0120, "a.com", 1)}))
+	assert.False(t, cond.Match(&Packet{Data: testDNSQuery(0x0110, "a.com", 1)}))
+	assert.False(t, cond.Match(&Packet{Data: testDNSQuery(0x0000, "a.com", 1)}))
+	assert.False(t, cond.Match(&Packet{Data: []byte("not a dns query")}))
+
+	pkt := &Packet{Data: testDNSQuery(0x0100, "www.example.com", 1)}
+	cond, _ = NewCondition(&sd_config.ConditionConfig{DNSSuffix: "example.com"})
+	allocs := testing.AllocsPerRun(100, func() { cond.Match(pkt) })
+	assert.Equal(t, float64(0), allocs)
+
+	for _, c := range []struct {
+		config *sd_config.ConditionConfig
+		path   string
+	}{
+		{&sd_config.ConditionConfig{DNSSuffix: "a..com"}, "DNSSuffix"},
+		{&sd_config.ConditionConfig{DNSQType: "A,BOGUS"}, "DNSQType"},
+		{&sd_config.ConditionConfig{DNSOpcode: "16"}, "DNSOpcode"},
+		{&sd_config.ConditionConfig{DNSFlags: "rd,!rd"}, "DNSFlags"},
+		{&sd_config.ConditionConfig{DNSFlags: "rd", DNSSuffix: "a.com"}, ""},
+	} {
+		_, err := NewCondition(c.config)
+		assert.Equal(t, c.path, err.(*sd_config.FieldError).Path, "%+v", c.config)
+	}
+}
+
+// Queries of the same name in any case should select the same peer
+func TestCHashUpstream_DNSQName(t *testing.T) {
+	ups, err := NewCHashUpstream(&sd_config.UpstreamConfig{
+		Name:          "dns",
+		Type:          UpstreamTypeCHash,
+		KeyExtractor:  "dns-qname",
+		HealthChecker: testHealthCheckerConfig(),
+		Peers: []*sd_config.PeerConfig{
+			{IP: "127.0.0.1", Port: 2345, Weight: 1, Backup: true},
+			{IP: "127.0.0.1", Port: 2346, Weight: 1},
+			{IP: "127.0.0.1", Port: 2347, Weight: 1},
+		},
+	})
+	assert.Nil(t, err)
+	defer ups.Close()
+
+	key, ok := ups.extractor.Extract(testDNSQuery(0, "WwW.Example.COM", 1), make([]byte, MaxExtractKeyLen))
+	assert.True(t, ok)
+	assert.Equal(t, []byte("\x03www\x07example\x03com\x00"), key)
+
+	for _, name := range []string{"a.com", "b.net", "c.org", "d.io", "e.cn", "f.de"} {
+		peer := ups.SelectPeer(testDNSQuery(0x0100, name, 1), 0, nil)
+		assert.NotNil(t, peer)
+		assert.Equal(t, peer, ups.SelectPeer(testDNSQuery(0x0100, strings.ToUpper(name), 28), 0, nil))
+	}
+	assert.Equal(t, ups.cHash.SelectPeer([]byte{0, 0, 0, 7}), ups.SelectPeer([]byte("not a dns query"), 7, nil))
+
+	data := testDNSQuery(0x0100, "www.example.com", 1)
+	allocs := testing.AllocsPerRun(100, func() { ups.SelectPeer(data, 0, nil) })
+	assert.Equal(t, float64(0), allocs)
+}
+
+// Malformed queries are counted, and dropped or routed as usual according to dns config
+func TestRouter_DNS(t *testing.T) {
+	routes := []sd_config.RouteConfig{
+		{Condition: &sd_config.ConditionConfig{DNSSuffix: "internal"}, Upstream: "internal"},
+	}
+	for malformed, action := range map[string]string{"": RouteActionDrop, "forward": RouteActionForward} {
+		router, err := newRouter(&sd_config.ListenerConfig{
+			DefaultUpstream: "public",
+			DNS:             &sd_config.DNSConfig{Malformed: malformed},
+			Routes:          routes,
+		}, map[string]Upstream{"internal": nil, "public": nil})
+		assert.Nil(t, err)
+
+		assert.Equal(t, 0, router.Match(&Packet{Data: testDNSQuery(0x0100, "db.internal", 1)}).GetId())
+		assert.Equal(t, -1, router.Match(&Packet{Data: testDNSQuery(0x0100, "example.com", 1)}).GetId())
+		route := router.Match(&Packet{Data: []byte{0x01}})
+		assert.Equal(t, action, route.GetAction(), malformed)
+		assert.Equal(t, uint64(1), router.Status().DNS.MalformedPackets)
+	}
+
+	_, err := newRouter(&sd_config.ListenerConfig{DNS: &sd_config.DNSConfig{Malformed: "reject"}}, nil)
+	assert.Equal(t, "DNS.Malformed", err.(*sd_config.FieldError).Path)
+}
@@ -0,0 +1,672 @@
+package sd_upstream
+
+import (
+	"errors"
+	"fmt"
+	"github.com/near-notfaraway/stevedore/sd_config"
+	"github.com/near-notfaraway/stevedore/sd_util"
+	"net"
+	"strconv"
+	"strings"
+)
+
+//------------------------------------------------------------------------------
+// Expression: Used to write condition tree as a tcpdump-like string
+//------------------------------------------------------------------------------
+
+// Expression is compiled into the same condition tree as ConditionConfig, its grammar is:
+//
+//	expr    = and { "||" and }
+//	and     = unary { "&&" unary }
+//	unary   = "!" unary | cmp
+//	cmp     = value [ ("==" | "!=" | "<" | "<=" | ">" | ">=") literal
+//	          | "in" ( "{" literal { "," literal } "}" | literal )
+//	          | "contains" literal | "match" string ]
+//	value   = primary { "&" literal }
+//	primary = "(" expr ")" | field | literal
+//	field   = ("u8" | "u16" | "u32" | "u64" | "u16le" | "u32le" | "u64le") "[" index "]"
+//	          | "len" | "sport" | "src" | "payload"
+//
+// Index of u8 is a key spec like KeyBytes, and a single index n means n:n+1, u8 compares with hex or
+// bit string as bytes, otherwise as big-endian integer, index of other fields is offset of integer
+// Mask binds tighter than comparison like Go, so that `u8[0] & 0x80 != 0` is `(u8[0] & 0x80) != 0`
+// Literals of in on len and sport can be ranges min:max, min: and :max like Length of condition config
+// Fields which can not be extracted from packet never match, even for `!=`
+type exprParser struct {
+	tokens []exprToken
+	next   int
+}
+
+type exprToken struct {
+	kind int    // kind of token
+	text string // origin text, or unquoted text of string
+	pos  int    // column of token, starts from 1
+}
+
+const (
+	exprTokenEOF    = iota
+	exprTokenWord   // identifier, number or address
+	exprTokenString // quoted string
+	exprTokenIndex  // text between [ and ]
+	exprTokenOp     // operator or punctuation
+)
+
+// Node is a condition if cond is set, otherwise it is a field or literal value
+type exprNode struct {
+	pos     int       // column of node
+	cond    Condition // compiled condition
+	kind    int       // kind of value
+	text    string    // origin text of literal
+	key     *keySpec  // key of field, nil for payload
+	numeric bool      // if field is an integer, otherwise bytes
+	little  bool      // if integer field is little endian
+	mask    uint64    // mask applied to field, 0 means no mask
+}
+
+// Return key of field as key extractor, nil for payload rather than a nil key spec
+func (n *exprNode) extractor() KeyExtractor {
+	if n.key == nil {
+		return nil
+	}
+	return n.key
+}
+
+const (
+	exprLiteral = iota
+	exprString
+	exprField
+	exprPayload
+	exprLen
+	exprSport
+	exprSrc
+)
+
+// Size of integer fields
+var exprIntFields = map[string]int{"u16": 2, "u32": 4, "u64": 8, "u16le": 2, "u32le": 4, "u64le": 8}
+
+// Parse expression into condition tree, error points at the column of expression
+func ParseExpression(expr string) (Condition, error) {
+	tokens, err := lexExpression(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &exprParser{tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != exprTokenEOF {
+		return nil, exprErrorf(tok.pos, "unexpected %q", tok.text)
+	}
+	return p.toCondition(node)
+}
+
+// Return error at column of expression, path of field error is dropped
+func exprErrorf(pos int, format string, a ...interface{}) error {
+	return fmt.Errorf("column %d: %s", pos, fmt.Sprintf(format, a...))
+}
+
+func exprError(pos int, err error) error {
+	var list sd_config.ErrorList
+	if errors.As(err, &list) && len(list) > 0 {
+		err = list[0]
+	}
+	var fieldErr *sd_config.FieldError
+	if errors.As(err, &fieldErr) {
+		err = fieldErr.Err
+	}
+	return exprErrorf(pos, "%v", err)
+}
+
+// Split expression into tokens
+func lexExpression(expr string) ([]exprToken, error) {
+	var tokens []exprToken
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		pos := i + 1
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		case isExprWordChar(c):
+			start := i
+			for i < len(expr) && isExprWordChar(expr[i]) {
+				i++
+			}
+			tokens = append(tokens, exprToken{kind: exprTokenWord, text: expr[start:i], pos: pos})
+
+		case c == '[':
+			end := strings.IndexByte(expr[i:], ']')
+			if end < 0 {
+				return nil, exprErrorf(pos, "missing ]")
+			}
+			tokens = append(tokens, exprToken{kind: exprTokenIndex, text: expr[i+1 : i+end], pos: pos})
+			i += end + 1
+
+		case c == '`':
+			end := strings.IndexByte(expr[i+1:], '`')
+			if end < 0 {
+				return nil, exprErrorf(pos, "missing closing `")
+			}
+			tokens = append(tokens, exprToken{kind: exprTokenString, text: expr[i+1 : i+1+end], pos: pos})
+			i += end + 2
+
+		case c == '"':
+			end := i + 1
+			for end < len(expr) && expr[end] != '"' {
+				if expr[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(expr) {
+				return nil, exprErrorf(pos, "missing closing \"")
+			}
+			text, err := strconv.Unquote(expr[i : end+1])
+			if err != nil {
+				return nil, exprErrorf(pos, "invalid string %s", expr[i:end+1])
+			}
+			tokens = append(tokens, exprToken{kind: exprTokenString, text: text, pos: pos})
+			i = end + 1
+
+		default:
+			op := ""
+			if i+1 < len(expr) {
+				switch two := expr[i : i+2]; two {
+				case "==", "!=", "<=", ">=", "&&", "||":
+					op = two
+				}
+			}
+			if op == "" && strings.IndexByte("<>!&(){},", c) >= 0 {
+				op = string(c)
+			}
+			if op == "" {
+				return nil, exprErrorf(pos, "unexpected %q", c)
+			}
+			tokens = append(tokens, exprToken{kind: exprTokenOp, text: op, pos: pos})
+			i += len(op)
+		}
+	}
+	return append(tokens, exprToken{kind: exprTokenEOF, text: "end of expression", pos: len(expr) + 1}), nil
+}
+
+// Word is identifier, number, ip or cidr
+func isExprWordChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '_' || c == '.' || c == ':' || c == '/'
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.next]
+}
+
+func (p *exprParser) advance() exprToken {
+	tok := p.tokens[p.next]
+	if tok.kind != exprTokenEOF {
+		p.next++
+	}
+	return tok
+}
+
+// Return if next token is operator or keyword op
+func (p *exprParser) peekIs(op string) bool {
+	tok := p.peek()
+	return (tok.kind == exprTokenOp || tok.kind == exprTokenWord) && tok.text == op
+}
+
+func (p *exprParser) expect(op string) (exprToken, error) {
+	tok := p.advance()
+	if tok.kind != exprTokenOp || tok.text != op {
+		return tok, exprErrorf(tok.pos, "expected %q, got %q", op, tok.text)
+	}
+	return tok, nil
+}
+
+// Return condition of node, returns error if node is a value
+func (p *exprParser) toCondition(node *exprNode) (Condition, error) {
+	if node.cond == nil {
+		return nil, exprErrorf(node.pos, "expected condition, got value")
+	}
+	return node.cond, nil
+}
+
+func (p *exprParser) parseOr() (*exprNode, error) {
+	return p.parseLogical("||", p.parseAnd, func(conds []Condition) Condition {
+		var rst orCondition
+		for _, cond := range conds {
+			if sub, ok := cond.(orCondition); ok {
+				rst = append(rst, sub...)
+			} else {
+				rst = append(rst, cond)
+			}
+		}
+		return rst
+	})
+}
+
+func (p *exprParser) parseAnd() (*exprNode, error) {
+	return p.parseLogical("&&", p.parseUnary, func(conds []Condition) Condition {
+		var rst andCondition
+		for _, cond := range conds {
+			if sub, ok := cond.(andCondition); ok {
+				rst = append(rst, sub...)
+			} else {
+				rst = append(rst, cond)
+			}
+		}
+		return rst
+	})
+}
+
+// Parse operands joined by op, nested conditions of the same op are flattened by join
+func (p *exprParser) parseLogical(op string, parseOperand func() (*exprNode, error),
+	join func([]Condition) Condition) (*exprNode, error) {
+	first, err := parseOperand()
+	if err != nil || !p.peekIs(op) {
+		return first, err
+	}
+
+	cond, err := p.toCondition(first)
+	if err != nil {
+		return nil, err
+	}
+	conds := []Condition{cond}
+	for p.peekIs(op) {
+		p.advance()
+		node, err := parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		if cond, err = p.toCondition(node); err != nil {
+			return nil, err
+		}
+		conds = append(conds, cond)
+	}
+	return &exprNode{pos: first.pos, cond: join(conds)}, nil
+}
+
+func (p *exprParser) parseUnary() (*exprNode, error) {
+	if !p.peekIs("!") {
+		return p.parseCompare()
+	}
+
+	tok := p.advance()
+	node, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	cond, err := p.toCondition(node)
+	if err != nil {
+		return nil, err
+	}
+	return &exprNode{pos: tok.pos, cond: &notCondition{cond: cond}}, nil
+}
+
+func (p *exprParser) parseCompare() (*exprNode, error) {
+	left, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+
+	tok := p.peek()
+	if tok.kind != exprTokenOp && tok.kind != exprTokenWord {
+		return left, nil
+	}
+	switch tok.text {
+	case "==", "!=", "<", "<=", ">", ">=", "in", sd_util.SearchOpContains, sd_util.SearchOpMatch:
+	default:
+		return left, nil
+	}
+	p.advance()
+	if left.cond != nil || left.kind == exprLiteral || left.kind == exprString {
+		return nil, exprErrorf(left.pos, "left side of %s should be a field", tok.text)
+	}
+
+	// parse right side
+	var literals []*exprNode
+	if tok.text == "in" && p.peekIs("{") {
+		p.advance()
+		for {
+			literal, err := p.parseLiteral()
+			if err != nil {
+				return nil, err
+			}
+			literals = append(literals, literal)
+			if !p.peekIs(",") {
+				break
+			}
+			p.advance()
+		}
+		if _, err := p.expect("}"); err != nil {
+			return nil, err
+		}
+	} else {
+		literal, err := p.parseLiteral()
+		if err != nil {
+			return nil, err
+		}
+		literals = append(literals, literal)
+	}
+
+	cond, err := compileCompare(left, tok, literals)
+	if err != nil {
+		return nil, err
+	}
+	return &exprNode{pos: left.pos, cond: cond}, nil
+}
+
+func (p *exprParser) parseValue() (*exprNode, error) {
+	node, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peekIs("&") {
+		tok := p.advance()
+		mask, err := p.parseLiteral()
+		if err != nil {
+			return nil, err
+		}
+		if node.cond != nil || node.kind != exprField {
+			return nil, exprErrorf(tok.pos, "mask only works with u8, u16, u32 and u64 fields")
+		}
+		value, err := sd_util.StringToUint(mask.text)
+		if err != nil || value == 0 {
+			return nil, exprErrorf(mask.pos, "invalid mask %q", mask.text)
+		}
+		if keyLen, fixed := node.key.fixedLen(); fixed && keyLen < 8 && value >= 1<<(8*keyLen) {
+			return nil, exprErrorf(mask.pos, "mask %s overflows bytes length %d", mask.text, keyLen)
+		}
+		masked := *node
+		masked.numeric, masked.mask = true, value
+		if node.mask != 0 {
+			masked.mask &= node.mask
+		}
+		node = &masked
+	}
+	return node, nil
+}
+
+func (p *exprParser) parsePrimary() (*exprNode, error) {
+	tok := p.advance()
+	switch tok.kind {
+	case exprTokenOp:
+		if tok.text != "(" {
+			return nil, exprErrorf(tok.pos, "unexpected %q", tok.text)
+		}
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return node, nil
+
+	case exprTokenString:
+		return &exprNode{pos: tok.pos, kind: exprString, text: tok.text}, nil
+
+	case exprTokenWord:
+		switch tok.text {
+		case "payload":
+			return &exprNode{pos: tok.pos, kind: exprPayload}, nil
+		case "len":
+			return &exprNode{pos: tok.pos, kind: exprLen}, nil
+		case "sport":
+			return &exprNode{pos: tok.pos, kind: exprSport}, nil
+		case "src":
+			return &exprNode{pos: tok.pos, kind: exprSrc}, nil
+		}
+		if _, ok := exprIntFields[tok.text]; ok || tok.text == "u8" {
+			return p.parseField(tok)
+		}
+		return &exprNode{pos: tok.pos, kind: exprLiteral, text: tok.text}, nil
+	}
+	return nil, exprErrorf(tok.pos, "unexpected %s", tok.text)
+}
+
+// Parse index of field, tok is name of field
+func (p *exprParser) parseField(tok exprToken) (*exprNode, error) {
+	index := p.advance()
+	if index.kind != exprTokenIndex {
+		return nil, exprErrorf(index.pos, "expected [ after %s", tok.text)
+	}
+	node := &exprNode{pos: tok.pos, kind: exprField}
+
+	spec := strings.TrimSpace(index.text)
+	if size, ok := exprIntFields[tok.text]; ok {
+		off, err := strconv.Atoi(spec)
+		if err != nil || off < 0 {
+			return nil, exprErrorf(index.pos+1, "offset %q of %s should be a non-negative integer", spec, tok.text)
+		}
+		spec = fmt.Sprintf("%d:%d", off, off+size)
+		node.numeric, node.little = true, strings.HasSuffix(tok.text, "le")
+	} else if n, err := strconv.Atoi(spec); err == nil {
+		spec = fmt.Sprintf("%d:%d", n, n+1)
+		if n == -1 {
+			spec = "-1:"
+		}
+	}
+
+	key, err := parseKeySpec(spec)
+	if err != nil {
+		return nil, exprError(index.pos+1, err)
+	}
+	node.key = key
+	return node, nil
+}
+
+func (p *exprParser) parseLiteral() (*exprNode, error) {
+	tok := p.advance()
+	switch tok.kind {
+	case exprTokenWord:
+		return &exprNode{pos: tok.pos, kind: exprLiteral, text: tok.text}, nil
+	case exprTokenString:
+		return &exprNode{pos: tok.pos, kind: exprString, text: tok.text}, nil
+	}
+	return nil, exprErrorf(tok.pos, "expected literal, got %q", tok.text)
+}
+
+// Compile comparison of field with literals into leaf condition
+func compileCompare(left *exprNode, op exprToken, literals []*exprNode) (Condition, error) {
+	if len(literals) > 1 && op.text != "in" {
+		return nil, exprErrorf(literals[1].pos, "only in accepts a set")
+	}
+	right := literals[0]
+	if (right.kind == exprString) != (op.text == sd_util.SearchOpMatch) {
+		if op.text == sd_util.SearchOpMatch {
+			return nil, exprErrorf(right.pos, "match expects a quoted regular expression")
+		}
+		return nil, exprErrorf(right.pos, "unexpected string")
+	}
+
+	switch left.kind {
+	case exprSrc:
+		return compileSrc(op, literals)
+	case exprLen:
+		return compileRange(op, literals, -1, func(min, max int) Condition {
+			return &lengthCondition{min: min, max: max}
+		})
+	case exprSport:
+		return compileRange(op, literals, 65535, func(min, max int) Condition {
+			return &srcPortCondition{min: min, max: max}
+		})
+	}
+
+	// search payload or bytes of field
+	if op.text == sd_util.SearchOpContains || op.text == sd_util.SearchOpMatch {
+		if left.numeric {
+			return nil, exprErrorf(op.pos, "%s only works with payload and u8 fields", op.text)
+		}
+		cond, err := newSearchCondition(left.extractor(), &sd_config.ConditionConfig{Operator: op.text, Value: right.text})
+		if err != nil {
+			return nil, exprError(right.pos, err)
+		}
+		return cond, nil
+	}
+	if left.kind == exprPayload {
+		return nil, exprErrorf(op.pos, "payload only works with contains and match")
+	}
+
+	// compare bytes with hex or bit string
+	isBytesLiteral := strings.HasPrefix(right.text, "0x") || strings.HasPrefix(right.text, "0b")
+	if !left.numeric && isBytesLiteral && (op.text == "==" || op.text == "!=") {
+		operator := sd_util.BytesOpEqual
+		if op.text == "!=" {
+			operator = sd_util.BytesOpNotEqual
+		}
+		cond, err := newBytesCondition(left.extractor(), operator, right.text)
+		if err != nil {
+			return nil, exprError(right.pos, err)
+		}
+		return cond, nil
+	}
+
+	// compare integer
+	config := &sd_config.ConditionConfig{Operator: op.text, Value: right.text}
+	negate := false
+	switch op.text {
+	case "==", "!=":
+		config.Operator, negate = sd_util.NumOpInSet, op.text == "!="
+	case "in":
+		values := make([]string, 0, len(literals))
+		for _, literal := range literals {
+			values = append(values, literal.text)
+		}
+		config.Operator, config.Value = sd_util.NumOpInSet, strings.Join(values, ",")
+	}
+	if left.little {
+		config.Endian = sd_util.EndianLittle
+	}
+	cond, err := newNumCondition(left.extractor(), config)
+	if err != nil {
+		var fieldErr *sd_config.FieldError
+		if errors.As(err, &fieldErr) && fieldErr.Path == "KeyBytes" {
+			return nil, exprError(left.pos, err)
+		}
+		return nil, exprError(right.pos, err)
+	}
+	cond.mask, cond.negate = left.mask, negate
+	return cond, nil
+}
+
+// Compile comparison of source address, only == and in are supported
+func compileSrc(op exprToken, literals []*exprNode) (Condition, error) {
+	if op.text != "==" && op.text != "!=" && op.text != "in" {
+		return nil, exprErrorf(op.pos, "src only works with ==, != and in")
+	}
+
+	cidrs := make([]string, 0, len(literals))
+	for _, literal := range literals {
+		cidr := literal.text
+		if op.text != "in" {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, exprErrorf(literal.pos, "invalid ip %q", cidr)
+			}
+			if ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return nil, exprErrorf(literal.pos, "invalid cidr %q", cidr)
+		}
+		cidrs = append(cidrs, cidr)
+	}
+
+	cond, err := newSrcCIDRCondition(strings.Join(cidrs, ","))
+	if err != nil {
+		return nil, exprError(literals[0].pos, err)
+	}
+	if op.text == "!=" {
+		return &notCondition{cond: cond}, nil
+	}
+	return cond, nil
+}
+
+// Compile comparison of integer into range [min, max], limit is max value, -1 means unlimited
+func compileRange(op exprToken, literals []*exprNode, limit int,
+	newRange func(min, max int) Condition) (Condition, error) {
+	if op.text == "in" {
+		conds := make(orCondition, 0, len(literals))
+		for _, literal := range literals {
+			min, max, err := parseExprRange(literal, limit)
+			if err != nil {
+				return nil, err
+			}
+			conds = append(conds, newRange(min, max))
+		}
+		if len(conds) == 1 {
+			return conds[0], nil
+		}
+		return conds, nil
+	}
+
+	v, err := parseExprInt(literals[0].text, literals[0].pos, limit)
+	if err != nil {
+		return nil, err
+	}
+	switch op.text {
+	case "==":
+		return newRange(v, v), nil
+	case "!=":
+		return &notCondition{cond: newRange(v, v)}, nil
+	case "<":
+		if v == 0 {
+			return nil, exprErrorf(literals[0].pos, "< 0 never matches")
+		}
+		return newRange(0, v-1), nil
+	case "<=":
+		return newRange(0, v), nil
+	case ">":
+		if v == limit {
+			return nil, exprErrorf(literals[0].pos, "> %d never matches", limit)
+		}
+		return newRange(v+1, limit), nil
+	case ">=":
+		return newRange(v, limit), nil
+	}
+	return nil, exprErrorf(op.pos, "%s only works with payload and u8 fields", op.text)
+}
+
+// Parse literal of in into range [min, max], which is a value, or min:max, min: and :max
+// Omitted min is 0 and omitted max is limit
+func parseExprRange(literal *exprNode, limit int) (min, max int, err error) {
+	sep := strings.IndexByte(literal.text, ':')
+	if sep < 0 {
+		v, err := parseExprInt(literal.text, literal.pos, limit)
+		return v, v, err
+	}
+
+	minStr, maxStr := literal.text[:sep], literal.text[sep+1:]
+	if minStr == "" && maxStr == "" {
+		return 0, 0, exprErrorf(literal.pos, "invalid range %q", literal.text)
+	}
+	min, max = 0, limit
+	if minStr != "" {
+		if min, err = parseExprInt(minStr, literal.pos, limit); err != nil {
+			return 0, 0, err
+		}
+	}
+	if maxStr != "" {
+		if max, err = parseExprInt(maxStr, literal.pos+sep+1, limit); err != nil {
+			return 0, 0, err
+		}
+	}
+	if max >= 0 && min > max {
+		return 0, 0, exprErrorf(literal.pos, "min of range %q is greater than max", literal.text)
+	}
+	return min, max, nil
+}
+
+// Parse integer not greater than limit at column pos, -1 means unlimited
+func parseExprInt(text string, pos int, limit int) (int, error) {
+	value, err := sd_util.StringToUint(text)
+	if err != nil || (limit >= 0 && value > uint64(limit)) || value > 1<<31 {
+		return 0, exprErrorf(pos, "invalid value %q", text)
+	}
+	return int(value), nil
+}
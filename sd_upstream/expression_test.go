@@ -0,0 +1,131 @@
+package sd_upstream
+
+import (
+	"github.com/near-notfaraway/stevedore/sd_config"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+	"math/rand"
+	"testing"
+)
+
+// Expression should compile into condition tree evaluated without allocation
+func TestParseExpression(t *testing.T) {
+	cond, err := ParseExpression("u8[4:6] == 0x0002 && (u8[0] & 0x80) != 0 && len > 24")
+	assert.Nil(t, err)
+	assert.Equal(t, "(4:6 == 0x0002 && !0:1 & 0x80 in-set 0 && len >= 25)", cond.String())
+
+	data := make([]byte, 25)
+	data[0], data[5] = 0x81, 0x02
+	assert.True(t, cond.Match(&Packet{Data: data}))
+	assert.False(t, cond.Match(&Packet{Data: data[:24]}))
+	data[0] = 0x01
+	assert.False(t, cond.Match(&Packet{Data: data}))
+
+	pkt := &Packet{Data: data}
+	allocs := testing.AllocsPerRun(100, func() { cond.Match(pkt) })
+	assert.Equal(t, float64(0), allocs)
+}
+
+// Expression should match the same packets as structured condition
+func TestParseExpression_Equivalent(t *testing.T) {
+	expected, err := NewCondition(testConditionConfig())
+	assert.Nil(t, err)
+	cond, err := ParseExpression("u8[4:6] == 0x0002 && u8[0] & 0x80 == 0x80 && !(u8[6] == 0xff)")
+	assert.Nil(t, err)
+
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		data := make([]byte, rnd.Intn(10))
+		rnd.Read(data)
+		if len(data) > 6 && rnd.Intn(2) == 0 {
+			data[4], data[5] = 0, 2
+		}
+		pkt := &Packet{Data: data}
+		assert.Equal(t, expected.Match(pkt), cond.Match(pkt), "%x", data)
+	}
+}
+
+// Fields, operators and literals supported by expression
+func TestParseExpression_Operators(t *testing.T) {
+	for expr, cases := range map[string]map[string]bool{
+		"u16le[0] in {1, 0x0300}":                   {"\x01\x00": true, "\x00\x03": true, "\x00\x01": false},
+		"u32[0] >= 0x10000 || u8[-1] == 0b11111111": {"\x00\x01\x00\x00": true, "\x00\x00\xff": true, "\x00\xff": true, "\x00": false},
+		"u8[0] != 0x01":                             {"\x02": true, "\x01": false, "": false},
+		"u8[1:3] != 5 && u8[0] <= 3":                {"\x03\x00\x06": true, "\x03\x00\x05": false, "\x04\x00\x06": false},
+		"payload contains 0xcafe":                   {"\x00\xca\xfe": true, "\xca\x00\xfe": false},
+		"u8[2:] match `^ab+c`":                      {"..abbc": true, "abbc": false},
+		"!(len in {1, 3})":                          {"": true, "a": false, "ab": true, "abc": false},
+		"len in {:1, 3:4, 0x6:}":                    {"": true, "a": true, "ab": false, "abc": true, "abcd": true, "abcde": false, "abcdef": true},
+		"len in 2:3":                                {"a": false, "ab": true, "abc": true, "abcd": false},
+	} {
+		cond, err := ParseExpression(expr)
+		assert.Nil(t, err, expr)
+		for data, expected := range cases {
+			assert.Equal(t, expected, cond.Match(&Packet{Data: []byte(data)}), "%s: %x", expr, data)
+		}
+	}
+
+	cond, err := ParseExpression("sport in {53, 1024:, :9}")
+	assert.Nil(t, err)
+	assert.Equal(t, "(sport == 53 || sport in 1024:65535 || sport in 0:9)", cond.String())
+	assert.True(t, cond.Match(&Packet{Sockaddr: &unix.SockaddrInet4{Port: 65535}}))
+	assert.False(t, cond.Match(&Packet{Sockaddr: &unix.SockaddrInet4{Port: 1023}}))
+
+	cond, err = ParseExpression("src in {10.0.0.0/8, fd00::/8} && sport < 1024 || src == 192.168.0.1")
+	assert.Nil(t, err)
+	assert.Equal(t, "((src in 10.0.0.0/8,fd00::/8 && sport in 0:1023) || src in 192.168.0.1/32)", cond.String())
+	assert.True(t, cond.Match(&Packet{Sockaddr: &unix.SockaddrInet4{Addr: [4]byte{10, 1, 2, 3}, Port: 53}}))
+	assert.True(t, cond.Match(&Packet{Sockaddr: &unix.SockaddrInet6{Addr: [16]byte{0xfd, 15: 1}, Port: 1023}}))
+	assert.True(t, cond.Match(&Packet{Sockaddr: &unix.SockaddrInet4{Addr: [4]byte{192, 168, 0, 1}, Port: 5353}}))
+	assert.False(t, cond.Match(&Packet{Sockaddr: &unix.SockaddrInet4{Addr: [4]byte{10, 1, 2, 3}, Port: 1024}}))
+}
+
+// Errors should point at the column of expression
+func TestParseExpression_Error(t *testing.T) {
+	for expr, msg := range map[string]string{
+		"":                      "column 1: unexpected end of expression",
+		"u8[0]":                 "column 1: expected condition, got value",
+		"u8[0] == 1 &&":         "column 14: unexpected end of expression",
+		"(u8[0] == 1":           `column 12: expected ")", got "end of expression"`,
+		"u8[0] == 1 $":          `column 12: unexpected '$'`,
+		"u8[4:6] == 0x02":       "column 12: value 0x02 length 1 is not equal to bytes length 2",
+		"u8[0] == 256":          "column 10: value 256 overflows bytes length 1",
+		"u8[0:9] > 1":           "column 1: bytes length 9 exceeds 8 for numeric operator",
+		"u16[1:2] == 1":         `column 5: offset "1:2" of u16 should be a non-negative integer`,
+		"u8[4:2] == 1":          "column 4: bytes start 4 is not less than bytes end 2",
+		"u8 == 1":               "column 4: expected [ after u8",
+		"len & 1 == 0":          "column 5: mask only works with u8, u16, u32 and u64 fields",
+		"u8[0] & 0x100 == 0":    "column 9: mask 0x100 overflows bytes length 1",
+		"1 == u8[0]":            "column 1: left side of == should be a field",
+		"src < 1.2.3.4":         "column 5: src only works with ==, != and in",
+		"src in 1.2.3.4/33":     `column 8: invalid cidr "1.2.3.4/33"`,
+		"sport > 65535":         "column 9: > 65535 never matches",
+		"payload == 0x01":       "column 9: payload only works with contains and match",
+		"payload match `(`":     "column 15: error parsing regexp: missing closing ): `(`",
+		"payload match 0x01":    "column 15: match expects a quoted regular expression",
+		"len in :":              `column 8: invalid range ":"`,
+		"len in 9:3":            `column 8: min of range "9:3" is greater than max`,
+		"sport in 1:65536":      `column 12: invalid value "65536"`,
+		"sport <= 1:2":          `column 10: invalid value "1:2"`,
+		"u16[0] contains 0x01":  "column 8: contains only works with payload and u8 fields",
+		"u8[0] == 1 || u8[0] ^": `column 21: unexpected '^'`,
+	} {
+		_, err := ParseExpression(expr)
+		if assert.NotNil(t, err, expr) {
+			assert.Equal(t, msg, err.Error(), expr)
+		}
+	}
+}
+
+// Route with expression should be indexed by route table, and not be mixed with other conditions
+func TestNewRoute_Match(t *testing.T) {
+	route, err := NewRoute(0, sd_config.RouteConfig{Match: "u8[4:6] == 0x0002 && len > 8", Upstream: "ups"})
+	assert.Nil(t, err)
+	table := newRouteTable([]*Route{route})
+	assert.Equal(t, 1, len(table.indexes))
+
+	_, err = NewRoute(0, sd_config.RouteConfig{Match: "len > 8", KeyBytes: "0:1", Upstream: "ups"})
+	assert.Equal(t, "Match", err.(sd_config.ErrorList)[0].(*sd_config.FieldError).Path)
+	_, err = NewRoute(0, sd_config.RouteConfig{Match: "len >", Upstream: "ups"})
+	assert.Equal(t, "Match: column 6: expected literal, got \"end of expression\"", err.Error())
+}
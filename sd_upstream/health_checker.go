@@ -1,6 +1,8 @@
 package sd_upstream
 
 import (
+	"context"
+	"fmt"
 	"github.com/near-notfaraway/stevedore/sd_config"
 	"github.com/near-notfaraway/stevedore/sd_socket"
 	"github.com/sirupsen/logrus"
@@ -13,136 +15,218 @@ import (
 // HealthChecker: Used to update peer's health state
 //------------------------------------------------------------------------------
 
+// Check target of a peer
+type checkTarget struct {
+	fd             int // used to send check packet
+	succeedCounter int // succeed times counter
+	failedCounter  int // failed times counter
+}
+
 type HealthChecker struct {
-	peers             []*Peer       // all peers
-	heartbeatInterval time.Duration // check interval
-	heartbeatTimeout  time.Duration // check timeout
-	successTimes      int           // set peer alive if exceeds it
-	failedTimes       int           // set peer dead if exceeds it
-	succeedCounter    []int         // succeed times counter for peers
-	failedCounter     []int         // failed times counter for peers
-	checkFds          []int         // used to send check packet
-	counterMu         sync.Mutex    // counter lock
-	changedFlag       bool          // if has a peer state changed in a check
+	heartbeatInterval time.Duration          // check interval
+	heartbeatTimeout  time.Duration          // check timeout
+	successTimes      int                    // set peer alive if exceeds it
+	failedTimes       int                    // set peer dead if exceeds it
+	targets           map[*Peer]*checkTarget // check targets of all peers
+	closingFds        []int                  // fds of removed peers, closed before next check
+	targetsMu         sync.Mutex             // targets and counter lock
+	changedFlag       bool                   // if has a peer state changed in a check
 }
 
-func NewHealthChecker(config *sd_config.HealthCheckerConfig, peers []*Peer) *HealthChecker {
-	// init counter
-	succeedCounter := make([]int, len(peers))
-	failedCounter := make([]int, len(peers))
+// Check config of health checker
+// Returns ErrorList contains all invalid fields
+func checkHealthCheckerConfig(config *sd_config.HealthCheckerConfig) error {
+	if config == nil {
+		return sd_config.NewFieldError("", "is missing")
+	}
 
-	// init check fd
-	checkFds := make([]int, len(peers))
-	for _, peer := range peers {
-		fd, err := sd_socket.UDPSocket(unix.AF_INET, false, false, false)
-		if err != nil {
-			logrus.Panicf("init fd for health checker failed: %v", err)
-		}
-		if err := unix.Connect(fd, peer.sockaddr); err != nil {
-			logrus.Errorf("connect upstream %s failed: %v", peer.addr, err)
-		}
-		checkFds[peer.id] = fd
+	var errs sd_config.ErrorList
+	if config.HeartbeatIntervalSec < 1 {
+		errs = append(errs, sd_config.NewFieldError("HeartbeatIntervalSec", "should be greater than 0"))
+	}
+	if config.HeartbeatTimeoutSec < 1 {
+		errs = append(errs, sd_config.NewFieldError("HeartbeatTimeoutSec", "should be greater than 0"))
+	}
+	if config.SuccessTimes < 1 {
+		errs = append(errs, sd_config.NewFieldError("SuccessTimes", "should be greater than 0"))
+	}
+	if config.FailedTimes < 1 {
+		errs = append(errs, sd_config.NewFieldError("FailedTimes", "should be greater than 0"))
+	}
+	return errs.Err()
+}
+
+func NewHealthChecker(config *sd_config.HealthCheckerConfig, peers []*Peer) (*HealthChecker, error) {
+	if err := checkHealthCheckerConfig(config); err != nil {
+		return nil, err
 	}
 
-	return &HealthChecker{
-		peers:             peers,
+	c := &HealthChecker{
 		heartbeatInterval: time.Second * time.Duration(config.HeartbeatIntervalSec),
 		heartbeatTimeout:  time.Second * time.Duration(config.HeartbeatTimeoutSec),
 		successTimes:      config.SuccessTimes,
 		failedTimes:       config.FailedTimes,
-		failedCounter:     failedCounter,
-		succeedCounter:    succeedCounter,
-		checkFds:          checkFds,
+		targets:           make(map[*Peer]*checkTarget, len(peers)),
+	}
+
+	// init check target
+	for _, peer := range peers {
+		if err := c.AddPeer(peer); err != nil {
+			c.close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// Start checking peer from next check
+func (c *HealthChecker) AddPeer(peer *Peer) error {
+	fd, err := sd_socket.UDPSocket(unix.AF_INET, false, false, false)
+	if err != nil {
+		return fmt.Errorf("init fd for health checker failed: %w", err)
+	}
+	if err := unix.Connect(fd, peer.sockaddr); err != nil {
+		logrus.Errorf("connect upstream %s failed: %v", peer.addr, err)
+	}
+
+	c.targetsMu.Lock()
+	defer c.targetsMu.Unlock()
+	c.targets[peer] = &checkTarget{fd: fd}
+	return nil
+}
+
+// Stop checking peer, its fd is closed before next check
+func (c *HealthChecker) RemovePeer(peer *Peer) {
+	c.targetsMu.Lock()
+	defer c.targetsMu.Unlock()
+	if target, ok := c.targets[peer]; ok {
+		delete(c.targets, peer)
+		c.closingFds = append(c.closingFds, target.fd)
 	}
 }
 
-func (c *HealthChecker) Check(changedCh chan<- struct{}) {
+func (c *HealthChecker) Check(ctx context.Context, changedCh chan<- struct{}) {
+	defer c.close()
+
 	// check first time immediately
-	c.checkPeers(changedCh)
+	c.checkPeers(ctx, changedCh)
 	tick := time.NewTicker(c.heartbeatInterval)
 	defer tick.Stop()
 
-	// check periodically
-	for range tick.C {
-		c.checkPeers(changedCh)
+	// check periodically until ctx canceled
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			c.checkPeers(ctx, changedCh)
+		}
 	}
 }
 
-func (c *HealthChecker) checkPeers(changedCh chan<- struct{}) {
-	// check peers one by one concurrently
+func (c *HealthChecker) close() {
+	c.targetsMu.Lock()
+	defer c.targetsMu.Unlock()
+	for peer, target := range c.targets {
+		delete(c.targets, peer)
+		c.closingFds = append(c.closingFds, target.fd)
+	}
+	c.closeRemovedFds()
+}
+
+// Close fds of removed peers, should be called with lock held and no check running
+func (c *HealthChecker) closeRemovedFds() {
+	for _, fd := range c.closingFds {
+		if err := unix.Close(fd); err != nil {
+			logrus.Errorf("close fd of health checker failed: %v", err)
+		}
+	}
+	c.closingFds = nil
+}
+
+func (c *HealthChecker) checkPeers(ctx context.Context, changedCh chan<- struct{}) {
+	// snapshot targets, fds of removed peers are no longer used by last check
+	c.targetsMu.Lock()
+	c.closeRemovedFds()
 	c.changedFlag = false
+	targets := make(map[*Peer]*checkTarget, len(c.targets))
+	for peer, target := range c.targets {
+		targets[peer] = target
+	}
+	c.targetsMu.Unlock()
+
+	// check peers one by one concurrently
 	wg := &sync.WaitGroup{}
-	for _, peer := range c.peers {
+	for peer, target := range targets {
 		wg.Add(1)
-		go c.checkOnePeer(peer, wg)
+		go c.checkOnePeer(peer, target, wg)
 	}
 	wg.Wait()
 
 	// if has a peer state changed
-	if c.changedFlag {
-		changedCh <- struct{}{}
+	c.targetsMu.Lock()
+	changed := c.changedFlag
+	c.targetsMu.Unlock()
+	if changed {
+		select {
+		case changedCh <- struct{}{}:
+		case <-ctx.Done():
+		}
 	}
 }
 
-func (c *HealthChecker) checkOnePeer(peer *Peer, wg *sync.WaitGroup) {
+func (c *HealthChecker) checkOnePeer(peer *Peer, target *checkTarget, wg *sync.WaitGroup) {
 	defer wg.Done()
 	checkBuf := []byte("heartbeat")
-	checkFd := c.checkFds[peer.id]
 	timer := time.NewTimer(c.heartbeatTimeout)
+	defer timer.Stop()
 
 	// send heartbeat packet
-	err := unix.Send(checkFd, checkBuf, 0)
+	err := unix.Send(target.fd, checkBuf, 0)
 	if err != nil {
 		logrus.Debugf("result of check on upstream %s is failed ", peer.addr)
-		if c.handleFailedCheck(peer) {
-			c.changedFlag = true
-		}
+		c.handleFailedCheck(peer, target)
 		return
 	}
 
 	// after heartbeat timeout, determining failure based on fd error
 	<-timer.C
-	v, err := unix.GetsockoptInt(checkFd, unix.SOL_SOCKET, unix.SO_ERROR)
+	v, err := unix.GetsockoptInt(target.fd, unix.SOL_SOCKET, unix.SO_ERROR)
 	if err != nil || v != 0 {
 		logrus.Debugf("result of check on upstream %s is failed ", peer.addr)
-		if c.handleFailedCheck(peer) {
-			c.changedFlag = true
-		}
+		c.handleFailedCheck(peer, target)
 		return
 	}
 
 	logrus.Debugf("result of check on upstream %s is succeed ", peer.addr)
-	if c.handleSuccessCheck(peer) {
-		c.changedFlag = true
-	}
+	c.handleSuccessCheck(peer, target)
 }
 
-func (c *HealthChecker) handleFailedCheck(peer *Peer) bool {
+func (c *HealthChecker) handleFailedCheck(peer *Peer, target *checkTarget) {
 	// update counter
-	c.counterMu.Lock()
-	defer c.counterMu.Unlock()
-	c.failedCounter[peer.id] += 1
-	c.succeedCounter[peer.id] = 0
-
-	// if peer is alive and exceeds failed times
-	if peer.isAlive() && c.failedCounter[peer.id] >= c.failedTimes {
-		peer.SetState(PeerDead)
-		return true
+	c.targetsMu.Lock()
+	defer c.targetsMu.Unlock()
+	target.failedCounter += 1
+	target.succeedCounter = 0
+
+	// if peer is alive or draining and exceeds failed times, flows on draining peer leave it
+	if (peer.isAlive() || peer.IsDraining()) && target.failedCounter >= c.failedTimes {
+		peer.MarkDead()
+		c.changedFlag = true
 	}
-	return false
 }
 
-func (c *HealthChecker) handleSuccessCheck(peer *Peer) bool {
+func (c *HealthChecker) handleSuccessCheck(peer *Peer, target *checkTarget) {
 	// update counter
-	c.counterMu.Lock()
-	defer c.counterMu.Unlock()
-	c.succeedCounter[peer.id] += 1
-	c.failedCounter[peer.id] = 0
-
-	// if peer is not alive and exceeds succeed times
-	if !peer.isAlive() && c.succeedCounter[peer.id] >= c.successTimes {
-		peer.SetState(PeerAlive)
-		return true
+	c.targetsMu.Lock()
+	defer c.targetsMu.Unlock()
+	target.succeedCounter += 1
+	target.failedCounter = 0
+
+	// if peer is not alive and exceeds succeed times, draining peer keeps draining
+	if !peer.isAlive() && !peer.IsDraining() && target.succeedCounter >= c.successTimes {
+		peer.recover()
+		c.changedFlag = true
 	}
-	return false
 }
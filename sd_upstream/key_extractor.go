@@ -0,0 +1,204 @@
+package sd_upstream
+
+import (
+	"fmt"
+	"github.com/near-notfaraway/stevedore/sd_config"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//------------------------------------------------------------------------------
+// KeyExtractor: Used to extract key by parsing protocol header instead of key bytes
+//------------------------------------------------------------------------------
+
+// Key extractor returns key extracted from data, ok is false if data is too short or malformed
+// Key is a sub slice of data or buf which has MaxExtractKeyLen bytes at least, Extract should not allocate
+// Key extractors are shared by workers, so Extract should be safe for concurrent use
+type KeyExtractor interface {
+	Extract(data, buf []byte) ([]byte, bool)
+	String() string
+}
+
+// Create key extractor by argument after colon of name[:arg], arg is empty if not given
+type KeyExtractorFactory func(arg string) (KeyExtractor, error)
+
+const (
+	KeyExtractorQUICDCID       = "quic-dcid"       // destination connection id of quic long or short header
+	KeyExtractorDNSQName       = "dns-qname"       // lowercase qname of dns query
+	KeyExtractorKCPConv        = "kcp-conv"        // conv of kcp segment
+	KeyExtractorWireGuardIndex = "wireguard-index" // receiver index of wireguard message sent by client
+	KeyExtractorSTUNTxID       = "stun-txid"       // transaction id of stun message
+	KeyExtractorRTPSSRC        = "rtp-ssrc"        // ssrc of rtp packet or sender ssrc of rtcp packet
+
+	// Max length of key written into buf by key extractor
+	MaxExtractKeyLen = maxDNSNameLen
+
+	// DCID length of quic short header if not configured
+	defaultQUICShortDCIDLen = 8
+	// Max DCID length of quic v1, 20 bytes
+	maxQUICDCIDLen = 20
+)
+
+// Buffers of keys written by key extractors, so that extracting allocates nothing
+var keyBufPool = sync.Pool{
+	New: func() interface{} {
+		return new([MaxExtractKeyLen]byte)
+	},
+}
+
+// Registered key extractor factories by name
+var (
+	keyExtractorsMu sync.RWMutex
+	keyExtractors   = make(map[string]KeyExtractorFactory)
+)
+
+func init() {
+	RegisterKeyExtractor(KeyExtractorQUICDCID, newQUICDCIDExtractor)
+	RegisterKeyExtractor(KeyExtractorDNSQName, noArgKeyExtractor(&dnsQNameExtractor{}))
+	RegisterKeyExtractor(KeyExtractorKCPConv, noArgKeyExtractor(&kcpConvExtractor{}))
+	RegisterKeyExtractor(KeyExtractorWireGuardIndex, noArgKeyExtractor(&wireGuardIndexExtractor{}))
+	RegisterKeyExtractor(KeyExtractorSTUNTxID, noArgKeyExtractor(&stunTxIDExtractor{}))
+	RegisterKeyExtractor(KeyExtractorRTPSSRC, noArgKeyExtractor(&rtpSSRCExtractor{}))
+}
+
+// Register factory of key extractor, so that KeyExtractor of config can refer to it as name[:arg]
+// It should be called before config is loaded, such as in init of package embedding stevedore
+// Panics if name is empty, contains colon or is already registered
+func RegisterKeyExtractor(name string, factory KeyExtractorFactory) {
+	if name == "" || strings.Contains(name, ":") || factory == nil {
+		panic(fmt.Sprintf("invalid key extractor %q", name))
+	}
+
+	keyExtractorsMu.Lock()
+	defer keyExtractorsMu.Unlock()
+	if _, ok := keyExtractors[name]; ok {
+		panic(fmt.Sprintf("key extractor %q is already registered", name))
+	}
+	keyExtractors[name] = factory
+}
+
+// Return factory of key extractor which takes no argument
+func noArgKeyExtractor(e KeyExtractor) KeyExtractorFactory {
+	return func(arg string) (KeyExtractor, error) {
+		if arg != "" {
+			return nil, fmt.Errorf("%s takes no argument", e)
+		}
+		return e, nil
+	}
+}
+
+// Return length of key if it is fixed, ok is false if it depends on data or is unknown
+func keyFixedLen(key KeyExtractor) (int, bool) {
+	if k, ok := key.(interface{ fixedLen() (int, bool) }); ok {
+		return k.fixedLen()
+	}
+	return 0, false
+}
+
+// Key extractor parsing packet, which reuses result cached in packet instead of parsing data again
+type packetKeyExtractor interface {
+	extractPacket(pkt *Packet) ([]byte, bool)
+}
+
+// Extract key from packet, key is written into buffer of packet
+func extractKey(key KeyExtractor, pkt *Packet) ([]byte, bool) {
+	if k, ok := key.(packetKeyExtractor); ok {
+		return k.extractPacket(pkt)
+	}
+	return key.Extract(pkt.Data, pkt.keyBuf[:])
+}
+
+// Return config field of key, used as path of error about key
+func keyField(key KeyExtractor) string {
+	if _, ok := key.(*keySpec); ok {
+		return "KeyBytes"
+	}
+	return "KeyExtractor"
+}
+
+// Return key spec or key extractor of upstream, only one of them is not nil
+// Returns err with path of invalid field
+func parseUpstreamKey(config *sd_config.UpstreamConfig) (*keySpec, KeyExtractor, error) {
+	if config.KeyExtractor == "" {
+		key, err := parseKeySpec(config.KeyBytes)
+		if err != nil {
+			return nil, nil, sd_config.WithPath("KeyBytes", err)
+		}
+		return key, nil, nil
+	}
+
+	if config.KeyBytes != "" {
+		return nil, nil, sd_config.NewFieldError("KeyBytes", "should not be set with KeyExtractor")
+	}
+	extractor, err := parseKeyExtractor(config.KeyExtractor)
+	if err != nil {
+		return nil, nil, sd_config.WithPath("KeyExtractor", err)
+	}
+	return nil, extractor, nil
+}
+
+// Parse key extractor in form name[:arg] by registered factory, returns error if it is invalid
+func parseKeyExtractor(spec string) (KeyExtractor, error) {
+	name, arg := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		name, arg = spec[:i], spec[i+1:]
+	}
+
+	keyExtractorsMu.RLock()
+	factory, ok := keyExtractors[name]
+	keyExtractorsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown key extractor %q", name)
+	}
+	return factory(arg)
+}
+
+// Extract destination connection id of quic packet, see RFC 8999
+//   - long header: flags(1) version(4) dcid len(1) dcid(len)
+//   - short header: flags(1) dcid(shortLen), length of dcid is chosen by server
+//
+// Long header with zero length dcid has no key, and chash upstream selects peer by client address instead
+type quicDCIDExtractor struct {
+	spec     string // origin spec
+	shortLen int    // dcid length of short header
+}
+
+func newQUICDCIDExtractor(arg string) (KeyExtractor, error) {
+	e := &quicDCIDExtractor{spec: KeyExtractorQUICDCID, shortLen: defaultQUICShortDCIDLen}
+	if arg != "" {
+		var err error
+		if e.shortLen, err = strconv.Atoi(arg); err != nil || e.shortLen < 1 || e.shortLen > maxQUICDCIDLen {
+			return nil, fmt.Errorf("short header dcid length %q should be 1 to %d", arg, maxQUICDCIDLen)
+		}
+		e.spec += ":" + arg
+	}
+	return e, nil
+}
+
+func (e *quicDCIDExtractor) Extract(data, buf []byte) ([]byte, bool) {
+	if len(data) == 0 {
+		return nil, false
+	}
+
+	// long header, the highest bit of flags is set
+	if data[0]&0x80 != 0 {
+		if len(data) < 6 {
+			return nil, false
+		}
+		n := int(data[5])
+		if n == 0 || len(data) < 6+n {
+			return nil, false
+		}
+		return data[6 : 6+n], true
+	}
+
+	if len(data) < 1+e.shortLen {
+		return nil, false
+	}
+	return data[1 : 1+e.shortLen], true
+}
+
+func (e *quicDCIDExtractor) String() string {
+	return e.spec
+}
@@ -0,0 +1,142 @@
+package sd_upstream
+
+import (
+	"fmt"
+	"github.com/near-notfaraway/stevedore/sd_config"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+)
+
+// DCID of quic long and short header
+func TestQUICDCIDExtractor(t *testing.T) {
+	key, err := parseKeyExtractor("quic-dcid:4")
+	assert.Nil(t, err)
+
+	dcid := []byte{0xde, 0xad, 0xbe, 0xef}
+	for data, expect := range map[string][]byte{
+		"\xc3\x00\x00\x00\x01\x04\xde\xad\xbe\xef\x08": dcid, // long header
+		"\x43\xde\xad\xbe\xef\x01\x02":                 dcid, // short header
+		"\xc3\x00\x00\x00\x01\x00\x08":                 nil,  // empty dcid
+		"\xc3\x00\x00\x00\x01\x05\xde\xad\xbe\xef":     nil,  // too short
+		"\x43\xde\xad\xbe":                             nil,
+		"":                                             nil,
+	} {
+		rst, ok := key.Extract([]byte(data), make([]byte, MaxExtractKeyLen))
+		assert.Equal(t, expect != nil, ok, "%x", data)
+		assert.Equal(t, expect, rst, "%x", data)
+	}
+
+	for spec, msg := range map[string]string{
+		"quic-dcid:0":  `short header dcid length "0" should be 1 to 20`,
+		"quic-dcid:ab": `short header dcid length "ab" should be 1 to 20`,
+		"quic":         `unknown key extractor "quic"`,
+	} {
+		_, err = parseKeyExtractor(spec)
+		if assert.NotNil(t, err, spec) {
+			assert.Equal(t, msg, err.Error(), spec)
+		}
+	}
+}
+
+// Handshake and 1-RTT packets of the same connection should select the same peer, packets without dcid by client address
+func TestCHashUpstream_QUICDCID(t *testing.T) {
+	config := &sd_config.UpstreamConfig{
+		Name:          "quic",
+		Type:          UpstreamTypeCHash,
+		KeyExtractor:  "quic-dcid",
+		HealthChecker: testHealthCheckerConfig(),
+		Peers: []*sd_config.PeerConfig{
+			{IP: "127.0.0.1", Port: 2345, Weight: 1, Backup: true},
+			{IP: "127.0.0.1", Port: 2346, Weight: 1},
+			{IP: "127.0.0.1", Port: 2347, Weight: 1},
+		},
+	}
+	ups, err := NewCHashUpstream(config)
+	assert.Nil(t, err)
+	defer ups.Close()
+	assert.Equal(t, "quic-dcid", ups.Status().KeyExtractor)
+
+	for i := 0; i < 256; i++ {
+		dcid := []byte{byte(i), 1, 2, 3, 4, 5, 6, byte(i)}
+		handshake := append([]byte{0xe0, 0, 0, 0, 1, 8}, dcid...)
+		oneRTT := append([]byte{0x40}, dcid...)
+		peer := ups.SelectPeer(append(handshake, 0, 0x40), 0, nil)
+		assert.NotNil(t, peer)
+		assert.Equal(t, peer, ups.SelectPeer(append(oneRTT, 0xff, 0xff), 0, nil))
+	}
+
+	// long header with zero length dcid selects peer by client address
+	initial := []byte{0xc0, 0, 0, 0, 1, 0, 8, 1, 2, 3, 4, 5, 6, 7, 8}
+	for i := 0; i < 256; i++ {
+		client := uint32(i) * 0x01010101
+		peer := ups.SelectPeer(initial, client, nil)
+		assert.NotNil(t, peer)
+		assert.Equal(t, ups.cHash.SelectPeer([]byte{byte(i), byte(i), byte(i), byte(i)}), peer)
+	}
+
+	data := []byte{0x40, 1, 2, 3, 4, 5, 6, 7, 8}
+	allocs := testing.AllocsPerRun(100, func() { ups.SelectPeer(data, 0, nil) })
+	assert.Equal(t, float64(0), allocs)
+
+	// key bytes and key extractor are exclusive
+	config.KeyBytes = "0:4"
+	err = CheckUpstreamConfig(config)
+	assert.Equal(t, "KeyBytes", err.(sd_config.ErrorList)[0].(*sd_config.FieldError).Path)
+}
+
+// Extractor of custom protocol, key is the byte after tag
+type testTagExtractor struct {
+	tag byte
+}
+
+func (e *testTagExtractor) Extract(data, buf []byte) ([]byte, bool) {
+	for i := 0; i+1 < len(data); i++ {
+		if data[i] == e.tag {
+			return data[i+1 : i+2], true
+		}
+	}
+	return nil, false
+}
+
+func (e *testTagExtractor) String() string {
+	return fmt.Sprintf("test-tag:%d", e.tag)
+}
+
+// Registered key extractor can be referred by upstreams and routes
+func TestRegisterKeyExtractor(t *testing.T) {
+	RegisterKeyExtractor("test-tag", func(arg string) (KeyExtractor, error) {
+		tag, err := strconv.ParseUint(arg, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag %q", arg)
+		}
+		return &testTagExtractor{tag: byte(tag)}, nil
+	})
+	assert.Panics(t, func() { RegisterKeyExtractor("test-tag", nil) })
+	assert.Panics(t, func() { RegisterKeyExtractor("kcp-conv", func(string) (KeyExtractor, error) { return nil, nil }) })
+	assert.Panics(t, func() { RegisterKeyExtractor("a:b", func(string) (KeyExtractor, error) { return nil, nil }) })
+
+	ups, err := NewCHashUpstream(&sd_config.UpstreamConfig{
+		Name:          "tag",
+		Type:          UpstreamTypeCHash,
+		KeyExtractor:  "test-tag:255",
+		HealthChecker: testHealthCheckerConfig(),
+		Peers: []*sd_config.PeerConfig{
+			{IP: "127.0.0.1", Port: 2345, Weight: 1},
+			{IP: "127.0.0.1", Port: 2346, Weight: 1},
+		},
+	})
+	assert.Nil(t, err)
+	defer ups.Close()
+	assert.Equal(t, "test-tag:255", ups.Status().KeyExtractor)
+	assert.Equal(t, ups.SelectPeer([]byte{1, 0xff, 7}, 0, nil), ups.SelectPeer([]byte{2, 3, 0xff, 7, 9}, 0, nil))
+	assert.Equal(t, ups.cHash.SelectPeer([]byte{0, 0, 0, 7}), ups.SelectPeer([]byte{1, 2, 3}, 7, nil))
+
+	cond, err := NewCondition(&sd_config.ConditionConfig{KeyExtractor: "test-tag:1", Operator: "==", Value: "0x07"})
+	assert.Nil(t, err)
+	assert.True(t, cond.Match(&Packet{Data: []byte{0, 1, 7}}))
+	assert.False(t, cond.Match(&Packet{Data: []byte{0, 1, 8}}))
+
+	_, err = parseKeyExtractor("test-tag:x")
+	assert.Equal(t, `invalid tag "x"`, err.Error())
+}
@@ -0,0 +1,116 @@
+package sd_upstream
+
+import (
+	"encoding/binary"
+)
+
+//------------------------------------------------------------------------------
+// KeyPreset: Key extractors of common protocols, keys of them have fixed length
+//------------------------------------------------------------------------------
+
+const (
+	kcpOverhead   = 24 // conv(4) cmd(1) frg(1) wnd(2) ts(4) sn(4) una(4) len(4)
+	kcpCmdPush    = 81
+	kcpCmdWins    = 84
+	stunHeaderLen = 20
+	stunCookie    = 0x2112a442
+	rtpHeaderLen  = 12
+	rtcpHeaderLen = 8
+)
+
+// Extract conv of kcp segment, see ikcp.c
+// Conv is little-endian uint32 on wire, and key is its big-endian bytes so it reads as the same integer by default
+type kcpConvExtractor struct{}
+
+func (e *kcpConvExtractor) Extract(data, buf []byte) ([]byte, bool) {
+	if len(data) < kcpOverhead || data[4] < kcpCmdPush || data[4] > kcpCmdWins {
+		return nil, false
+	}
+	binary.BigEndian.PutUint32(buf, binary.LittleEndian.Uint32(data))
+	return buf[:4], true
+}
+
+func (e *kcpConvExtractor) fixedLen() (int, bool) {
+	return 4, true
+}
+
+func (e *kcpConvExtractor) String() string {
+	return KeyExtractorKCPConv
+}
+
+// Extract receiver index of wireguard message sent by client, which is the index chosen by server for the tunnel
+//   - initiation: type(1) reserved(3) sender(4) ephemeral(32) static(48) timestamp(28) macs(32), 148 bytes
+//   - response: type(1) reserved(3) sender(4) receiver(4), 92 bytes
+//   - cookie reply: type(1) reserved(3) receiver(4), 64 bytes
+//   - transport data: type(1) reserved(3) receiver(4) counter(8) packet, 32 bytes at least
+//
+// Initiation only carries index chosen by client, it has no key and chash upstream selects peer by client address,
+// so that tunnel keeps on the same peer after handshake even if client roams, but handshake may go to another peer
+type wireGuardIndexExtractor struct{}
+
+func (e *wireGuardIndexExtractor) Extract(data, buf []byte) ([]byte, bool) {
+	if len(data) < 4 || data[1] != 0 || data[2] != 0 || data[3] != 0 {
+		return nil, false
+	}
+
+	switch {
+	case data[0] == 2 && len(data) == 92:
+		return data[8:12], true
+	case data[0] == 3 && len(data) == 64, data[0] == 4 && len(data) >= 32:
+		return data[4:8], true
+	}
+	return nil, false
+}
+
+func (e *wireGuardIndexExtractor) fixedLen() (int, bool) {
+	return 4, true
+}
+
+func (e *wireGuardIndexExtractor) String() string {
+	return KeyExtractorWireGuardIndex
+}
+
+// Extract transaction id of stun message, see RFC 5389
+//   - header: type(2) length(2) magic cookie(4) transaction id(12), the highest two bits are zero
+type stunTxIDExtractor struct{}
+
+func (e *stunTxIDExtractor) Extract(data, buf []byte) ([]byte, bool) {
+	if len(data) < stunHeaderLen || data[0]&0xc0 != 0 || binary.BigEndian.Uint32(data[4:]) != stunCookie {
+		return nil, false
+	}
+	return data[8:20], true
+}
+
+func (e *stunTxIDExtractor) fixedLen() (int, bool) {
+	return 12, true
+}
+
+func (e *stunTxIDExtractor) String() string {
+	return KeyExtractorSTUNTxID
+}
+
+// Extract ssrc of rtp packet, or sender ssrc of rtcp packet multiplexed on the same port, see RFC 3550 and 5761
+//   - rtp: flags(1) marker and payload type(1) sequence(2) timestamp(4) ssrc(4)
+//   - rtcp: flags(1) packet type(1) length(2) ssrc(4), packet type is 192 to 223
+type rtpSSRCExtractor struct{}
+
+func (e *rtpSSRCExtractor) Extract(data, buf []byte) ([]byte, bool) {
+	if len(data) < rtcpHeaderLen || data[0]>>6 != 2 {
+		return nil, false
+	}
+	if data[1] >= 192 && data[1] <= 223 {
+		return data[4:8], true
+	}
+	if len(data) < rtpHeaderLen {
+		return nil, false
+	}
+	return data[8:12], true
+}
+
+func (e *rtpSSRCExtractor) fixedLen() (int, bool) {
+	return 4, true
+}
+
+func (e *rtpSSRCExtractor) String() string {
+	return KeyExtractorRTPSSRC
+}
@@ -0,0 +1,126 @@
+package sd_upstream
+
+import (
+	"github.com/near-notfaraway/stevedore/sd_config"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+// Keys of protocol presets, malformed packets are not extracted
+func TestKeyPresets(t *testing.T) {
+	kcp := "\x78\x56\x34\x12\x51" + strings.Repeat("\x00", 19)
+	wgInitiation := "\x01\x00\x00\x00\xde\xad\xbe\xef" + strings.Repeat("\x00", 140)
+	wgData := "\x04\x00\x00\x00\xde\xad\xbe\xef" + strings.Repeat("\x00", 24)
+	wgResponse := "\x02\x00\x00\x00\x01\x02\x03\x04\xde\xad\xbe\xef" + strings.Repeat("\x00", 80)
+	wgCookie := "\x03\x00\x00\x00\xde\xad\xbe\xef" + strings.Repeat("\x00", 56)
+	stun := "\x00\x01\x00\x00\x21\x12\xa4\x42" + "0123456789ab"
+	rtp := "\x80\x60\x00\x01\x00\x00\x00\x02\xde\xad\xbe\xef"
+	rtcp := "\x81\xc9\x00\x07\xde\xad\xbe\xef"
+
+	for spec, cases := range map[string]map[string][]byte{
+		"kcp-conv": {
+			kcp:                        {0x12, 0x34, 0x56, 0x78},
+			kcp[:23]:                   nil, // too short
+			kcp[:4] + "\x50" + kcp[5:]: nil, // unknown command
+		},
+		"wireguard-index": {
+			wgInitiation:                    nil, // index chosen by client
+			wgData:                          {0xde, 0xad, 0xbe, 0xef},
+			wgResponse:                      {0xde, 0xad, 0xbe, 0xef},
+			wgCookie:                        {0xde, 0xad, 0xbe, 0xef},
+			wgData[:31]:                     nil,
+			"\x04\x01\x00\x00" + wgData[4:]: nil, // reserved bytes
+		},
+		"stun-txid": {
+			stun:      []byte("0123456789ab"),
+			stun[:19]: nil,
+			"\x00\x01\x00\x00\x21\x12\xa4\x43" + stun[8:]: nil, // bad magic cookie
+			"\x40" + stun[1:]: nil, // channel data
+		},
+		"rtp-ssrc": {
+			rtp:              {0xde, 0xad, 0xbe, 0xef},
+			rtcp:             {0xde, 0xad, 0xbe, 0xef},
+			rtp[:11]:         nil,
+			"\x40" + rtp[1:]: nil, // version 1
+		},
+	} {
+		key, err := parseKeyExtractor(spec)
+		assert.Nil(t, err)
+		assert.Equal(t, spec, key.String())
+		for data, expect := range cases {
+			rst, ok := key.Extract([]byte(data), make([]byte, MaxExtractKeyLen))
+			assert.Equal(t, expect != nil, ok, "%s: %x", spec, data)
+			assert.Equal(t, expect, rst, "%s: %x", spec, data)
+		}
+	}
+
+	_, err := parseKeyExtractor("kcp-conv:1")
+	assert.Equal(t, "kcp-conv takes no argument", err.Error())
+}
+
+// Route condition can operate with key extracted by preset, length of value is checked by key length
+func TestRoute_KeyExtractor(t *testing.T) {
+	route, err := NewRoute(0, sd_config.RouteConfig{
+		KeyExtractor: "kcp-conv",
+		Operator:     "in-range",
+		Value:        "0x12345600:0x123456ff",
+		Upstream:     "kcp",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "kcp-conv in-range 305419776:305420031", route.condition.String())
+
+	pkt := &Packet{Data: []byte("\x78\x56\x34\x12\x51" + strings.Repeat("\x00", 19))}
+	assert.True(t, route.condition.Match(pkt))
+	pkt.Data[1] = 0x57
+	assert.False(t, route.condition.Match(pkt))
+	allocs := testing.AllocsPerRun(100, func() { route.condition.Match(pkt) })
+	assert.Equal(t, float64(0), allocs)
+
+	cond, err := NewCondition(&sd_config.ConditionConfig{KeyExtractor: "stun-txid", Operator: "==", Value: "0x00"})
+	assert.Nil(t, cond)
+	assert.Equal(t, "Value", err.(sd_config.ErrorList)[0].(*sd_config.FieldError).Path)
+
+	for _, c := range []struct {
+		config *sd_config.ConditionConfig
+		path   string
+	}{
+		{&sd_config.ConditionConfig{KeyExtractor: "stun-txid", Operator: ">", Value: "1"}, "KeyExtractor"},
+		{&sd_config.ConditionConfig{KeyExtractor: "bogus", Operator: "==", Value: "1"}, "KeyExtractor"},
+		{&sd_config.ConditionConfig{KeyExtractor: "rtp-ssrc", KeyBytes: "0:4", Operator: "==", Value: "1"}, "KeyBytes"},
+	} {
+		_, err := NewCondition(c.config)
+		assert.Equal(t, c.path, err.(sd_config.ErrorList)[0].(*sd_config.FieldError).Path, "%+v", c.config)
+	}
+}
+
+// Initiation of tunnel selects peer by client address, and transport data keeps on peer of server index after roaming
+func TestCHashUpstream_WireGuardIndex(t *testing.T) {
+	ups, err := NewCHashUpstream(&sd_config.UpstreamConfig{
+		Name:          "wireguard",
+		Type:          UpstreamTypeCHash,
+		KeyExtractor:  "wireguard-index",
+		HealthChecker: testHealthCheckerConfig(),
+		Peers: []*sd_config.PeerConfig{
+			{IP: "127.0.0.1", Port: 2345, Weight: 1, Backup: true},
+			{IP: "127.0.0.1", Port: 2346, Weight: 1},
+			{IP: "127.0.0.1", Port: 2347, Weight: 1},
+		},
+	})
+	assert.Nil(t, err)
+	defer ups.Close()
+
+	for i := 0; i < 256; i++ {
+		client, roamed := uint32(i)*0x01010101, uint32(255-i)*0x01010101
+		initiation := append([]byte{1, 0, 0, 0, 0xbe, 0xef, byte(i), 0}, make([]byte, 140)...)
+		data := append([]byte{4, 0, 0, 0, 0xde, 0xad, 0xbe, byte(i)}, make([]byte, 24)...)
+
+		// sender index of initiation is not used
+		peer := ups.SelectPeer(initiation, client, nil)
+		assert.Equal(t, ups.cHash.SelectPeer([]byte{byte(i), byte(i), byte(i), byte(i)}), peer)
+
+		peer = ups.SelectPeer(data, client, peer)
+		assert.Equal(t, ups.cHash.SelectPeer([]byte{0xde, 0xad, 0xbe, byte(i)}), peer)
+		assert.Equal(t, peer, ups.SelectPeer(data, roamed, nil))
+	}
+}
@@ -0,0 +1,216 @@
+package sd_upstream
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//------------------------------------------------------------------------------
+// KeySpec: Used to extract key from data
+//------------------------------------------------------------------------------
+
+// Key spec is one of forms:
+//   - `start:end`: data[start:end], negative index counts from the end of data,
+//     omitted start means 0 and omitted end means the end of data, such as `-4:` and `2:-4`
+//   - `off#n`: read n-byte big-endian length field at off, key is the field following it
+//   - `off#n+start:end`: key is data[start:end] relative to the end of the field above
+//
+// Start and end with suffix b are bit indices, such as `3b:15b`, bit 0 is the highest bit of byte 0,
+// bit field is right-aligned into ceil(n/8) bytes, it can be relative to length field but not to the end
+type keySpec struct {
+	spec         string // origin spec
+	start        int    // start index, relative to base
+	end          int    // end index, relative to base
+	startFromEnd bool   // if start counts from the end of data
+	endFromEnd   bool   // if end counts from the end of data
+	lenOffset    int    // offset of length field
+	lenSize      int    // size of length field, 0 means no length field
+	bits         bool   // if start and end are bit indices
+}
+
+// Max number of bits of bit field, so that it can be extracted into 8 bytes
+const maxKeyBits = 64
+
+// Parse key spec, returns error if it is invalid
+func parseKeySpec(spec string) (*keySpec, error) {
+	k := &keySpec{spec: spec}
+
+	// parse length field
+	rangeSpec := spec
+	if i := strings.Index(spec, "#"); i >= 0 {
+		lenSpec := spec[i+1:]
+		rangeSpec = ""
+		if j := strings.Index(lenSpec, "+"); j >= 0 {
+			lenSpec, rangeSpec = lenSpec[:j], lenSpec[j+1:]
+			if rangeSpec == "" {
+				return nil, fmt.Errorf("key bytes %q should be in form off#n+start:end", spec)
+			}
+		}
+
+		var err error
+		if k.lenOffset, err = strconv.Atoi(spec[:i]); err != nil || k.lenOffset < 0 {
+			return nil, fmt.Errorf("length field offset %q is invalid", spec[:i])
+		}
+		if k.lenSize, err = strconv.Atoi(lenSpec); err != nil ||
+			(k.lenSize != 1 && k.lenSize != 2 && k.lenSize != 4) {
+			return nil, fmt.Errorf("length field size %q should be 1, 2 or 4", lenSpec)
+		}
+		if rangeSpec == "" {
+			return k, nil
+		}
+	}
+
+	// parse range
+	bytesIdx := strings.Split(rangeSpec, ":")
+	if len(bytesIdx) != 2 {
+		return nil, fmt.Errorf("key bytes %q should be in form start:end", spec)
+	}
+	if strings.HasSuffix(bytesIdx[0], "b") || strings.HasSuffix(bytesIdx[1], "b") {
+		return parseKeyBits(k, bytesIdx)
+	}
+	start, startFromEnd, err := parseKeyIndex(bytesIdx[0], false)
+	if err != nil || (k.lenSize > 0 && startFromEnd) {
+		return nil, fmt.Errorf("bytes start %q is invalid", bytesIdx[0])
+	}
+	end, endFromEnd, err := parseKeyIndex(bytesIdx[1], true)
+	if err != nil || (k.lenSize > 0 && endFromEnd) {
+		return nil, fmt.Errorf("bytes end %q is invalid", bytesIdx[1])
+	}
+	if startFromEnd == endFromEnd && start >= end {
+		return nil, fmt.Errorf("bytes start %s is not less than bytes end %s", bytesIdx[0], bytesIdx[1])
+	}
+
+	k.start, k.startFromEnd = start, startFromEnd
+	k.end, k.endFromEnd = end, endFromEnd
+	return k, nil
+}
+
+// Parse bit indices in form `startb:endb`
+func parseKeyBits(k *keySpec, bitsIdx []string) (*keySpec, error) {
+	k.bits = true
+	var err error
+	if !strings.HasSuffix(bitsIdx[0], "b") {
+		return nil, fmt.Errorf("bits start %q should end with b", bitsIdx[0])
+	}
+	if k.start, err = parseBitIndex(bitsIdx[0]); err != nil {
+		return nil, fmt.Errorf("bits start %q is invalid", bitsIdx[0])
+	}
+	if !strings.HasSuffix(bitsIdx[1], "b") {
+		return nil, fmt.Errorf("bits end %q should end with b", bitsIdx[1])
+	}
+	if k.end, err = parseBitIndex(bitsIdx[1]); err != nil {
+		return nil, fmt.Errorf("bits end %q is invalid", bitsIdx[1])
+	}
+	if k.start >= k.end {
+		return nil, fmt.Errorf("bits start %s is not less than bits end %s", bitsIdx[0], bitsIdx[1])
+	}
+	if k.end-k.start > maxKeyBits {
+		return nil, fmt.Errorf("bits length %d exceeds %d", k.end-k.start, maxKeyBits)
+	}
+	return k, nil
+}
+
+// Parse non-negative bit index with suffix b
+func parseBitIndex(s string) (int, error) {
+	idx, err := strconv.ParseUint(strings.TrimSuffix(s, "b"), 10, 16)
+	return int(idx), err
+}
+
+// Parse index of key bytes, negative index or omitted end counts from the end of data
+func parseKeyIndex(s string, isEnd bool) (int, bool, error) {
+	if s == "" {
+		return 0, isEnd, nil
+	}
+	idx, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, false, err
+	}
+	if strings.HasPrefix(s, "-") {
+		if idx == 0 {
+			return 0, false, fmt.Errorf("invalid index -0")
+		}
+		return idx, true, nil
+	}
+	return idx, false, nil
+}
+
+// Return length of key if it is fixed, ok is false if it depends on data
+func (k *keySpec) fixedLen() (int, bool) {
+	if k.lenSize > 0 && k.start == 0 && k.end == 0 {
+		return 0, false
+	}
+	if k.bits {
+		return (k.end - k.start + 7) / 8, true
+	}
+	if k.startFromEnd != k.endFromEnd {
+		return 0, false
+	}
+	return k.end - k.start, true
+}
+
+// Return key extracted from data, ok is false if data is too short
+// Key is a sub slice of data, except that bit field is written into buf which has 8 bytes at least
+func (k *keySpec) Extract(data, buf []byte) ([]byte, bool) {
+	base := 0
+
+	// read length field
+	if k.lenSize > 0 {
+		lenEnd := k.lenOffset + k.lenSize
+		if len(data) < lenEnd {
+			return nil, false
+		}
+		length := 0
+		for _, b := range data[k.lenOffset:lenEnd] {
+			length = (length << 8) | int(b)
+		}
+
+		// key is the field following length field
+		if k.start == 0 && k.end == 0 {
+			if len(data) < lenEnd+length {
+				return nil, false
+			}
+			return data[lenEnd : lenEnd+length], true
+		}
+		base = lenEnd + length
+	}
+
+	if k.bits {
+		return k.extractBits(data, base*8, buf)
+	}
+
+	start, end := base+k.start, base+k.end
+	if k.startFromEnd {
+		start = len(data) + k.start
+	}
+	if k.endFromEnd {
+		end = len(data) + k.end
+	}
+	if start < 0 || start >= end || end > len(data) {
+		return nil, false
+	}
+	return data[start:end], true
+}
+
+// Extract bit field right-aligned into buf, bit indices are relative to base
+func (k *keySpec) extractBits(data []byte, base int, buf []byte) ([]byte, bool) {
+	start, end := base+k.start, base+k.end
+	if end > len(data)*8 {
+		return nil, false
+	}
+
+	var v uint64
+	for i := start; i < end; i++ {
+		v = (v << 1) | uint64((data[i/8]>>(7-i%8))&1)
+	}
+	n := (end - start + 7) / 8
+	for i := n - 1; i >= 0; i-- {
+		buf[i] = byte(v)
+		v >>= 8
+	}
+	return buf[:n], true
+}
+
+func (k *keySpec) String() string {
+	return k.spec
+}
@@ -0,0 +1,94 @@
+package sd_upstream
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// Key relative to start or end of data
+func TestKeySpec_Extract1(t *testing.T) {
+	data := []byte{0, 1, 2, 3, 4, 5, 6, 7}
+	for spec, expect := range map[string][]byte{
+		"0:4":   {0, 1, 2, 3},
+		"-4:":   {4, 5, 6, 7},
+		"2:-4":  {2, 3},
+		"-3:-1": {5, 6},
+		":2":    {0, 1},
+		"6:":    {6, 7},
+	} {
+		key, err := parseKeySpec(spec)
+		assert.Nil(t, err, spec)
+		rst, ok := key.Extract(data, make([]byte, 8))
+		assert.True(t, ok, spec)
+		assert.Equal(t, expect, rst, spec)
+	}
+
+	// data too short
+	for _, spec := range []string{"4:9", "-9:", "5:-4"} {
+		key, err := parseKeySpec(spec)
+		assert.Nil(t, err, spec)
+		_, ok := key.Extract(data, make([]byte, 8))
+		assert.False(t, ok, spec)
+	}
+}
+
+// Key relative to length-prefixed field
+func TestKeySpec_Extract2(t *testing.T) {
+	data := []byte{0xff, 2, 0xaa, 0xbb, 1, 2, 3, 4}
+	key, err := parseKeySpec("1#1")
+	assert.Nil(t, err)
+	rst, ok := key.Extract(data, make([]byte, 8))
+	assert.True(t, ok)
+	assert.Equal(t, []byte{0xaa, 0xbb}, rst)
+
+	key, err = parseKeySpec("1#1+0:4")
+	assert.Nil(t, err)
+	rst, ok = key.Extract(data, make([]byte, 8))
+	assert.True(t, ok)
+	assert.Equal(t, []byte{1, 2, 3, 4}, rst)
+
+	key, err = parseKeySpec("0#2+1:2")
+	assert.Nil(t, err)
+	_, ok = key.Extract(data, make([]byte, 8))
+	assert.False(t, ok)
+}
+
+// Bit field right-aligned into bytes
+func TestKeySpec_Extract3(t *testing.T) {
+	data := []byte{0xab, 0xcd, 0xef}
+	for spec, expect := range map[string][]byte{
+		"4b:16b":     {0x0b, 0xcd},
+		"2b:3b":      {0x01},
+		"0b:24b":     {0xab, 0xcd, 0xef},
+		"0b:8b":      {0xab},
+		"0#1+-0b:4b": nil,
+	} {
+		key, err := parseKeySpec(spec)
+		if expect == nil {
+			assert.NotNil(t, err, spec)
+			continue
+		}
+		assert.Nil(t, err, spec)
+		rst, ok := key.Extract(data, make([]byte, 8))
+		assert.True(t, ok, spec)
+		assert.Equal(t, expect, rst, spec)
+	}
+
+	// relative to length field
+	key, err := parseKeySpec("0#1+4b:12b")
+	assert.Nil(t, err)
+	rst, ok := key.Extract([]byte{1, 0xff, 0x12, 0x34}, make([]byte, 8))
+	assert.True(t, ok)
+	assert.Equal(t, []byte{0x23}, rst)
+	_, ok = key.Extract([]byte{1, 0xff, 0x12}, make([]byte, 8))
+	assert.False(t, ok)
+}
+
+// Invalid key specs
+func TestParseKeySpec(t *testing.T) {
+	for _, spec := range []string{"", "4", "4:2", "-2:-4", "-0:", "a:4", "1#3", "-1#1", "1#1+", "1#1+-4:", "1#1+0:",
+		"3b:15", "3:15b", "15b:3b", "0b:65b", "-8b:"} {
+		_, err := parseKeySpec(spec)
+		assert.NotNil(t, err, spec)
+	}
+}
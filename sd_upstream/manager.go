@@ -1,57 +1,134 @@
 package sd_upstream
 
 import (
+	"fmt"
 	"github.com/near-notfaraway/stevedore/sd_config"
 )
 
 //------------------------------------------------------------------------------
 // Manager: Used to manager routes and upstreams
-// - choose upstream according to matched route
+// - each listener has a router choosing upstream according to matched route
+// - upstreams are shared by all routers
 //------------------------------------------------------------------------------
 
 type Manager struct {
-	defaultUpstream Upstream            // use it when no route match
-	upstreams       map[string]Upstream // manage upstreams which decide how to choose peer
-	routes          []*Route            // manage routes which  decide how to choose upstream
+	upstreamNames []string            // upstream names in config order
+	upstreams     map[string]Upstream // manage upstreams which decide how to choose peer
+	routerNames   []string            // listener names of routers in added order
+	routers       map[string]*Router  // map listener name to router which decides how to choose upstream
 }
 
-func NewManager(config *sd_config.UploadConfig) *Manager {
-	// init upstreams
-	upstreams := make(map[string]Upstream)
-	for _, upsConfig := range config.Upstreams {
-		upstreams[upsConfig.Name] = NewUpstream(upsConfig)
+// Check upload config without creating upstreams
+// Routes of upload config are checked, which are used by default listener
+// Returns ErrorList contains all invalid fields
+func CheckConfig(config *sd_config.UploadConfig) error {
+	var errs sd_config.ErrorList
+
+	// check upstreams
+	upstreamNames := make(map[string]struct{})
+	for i, upsConfig := range config.Upstreams {
+		path := fmt.Sprintf("Upstreams[%d]", i)
+		if _, dup := upstreamNames[upsConfig.Name]; dup {
+			errs = append(errs, sd_config.NewFieldError(path+".Name", "duplicated upstream %q", upsConfig.Name))
+		}
+		upstreamNames[upsConfig.Name] = struct{}{}
+		errs.Add(path, CheckUpstreamConfig(upsConfig))
 	}
 
-	// init default upstream
-	defaultUpstream, ok := upstreams[config.DefaultUpstream]
-	if !ok {
-		defaultUpstream = nil
+	// check default action and routes
+	errs.Add("", checkRoutes(config.DefaultAction, config.DefaultUpstream, config.DefaultReply,
+		config.Routes, upstreamNames))
+	errs.Add("DNS", checkDNSConfig(config.DNS))
+
+	return errs.Err()
+}
+
+// Check routes of listener, which can only target upstreams of upload config
+// Returns ErrorList contains all invalid fields
+func CheckListenerConfig(config *sd_config.ListenerConfig, upload *sd_config.UploadConfig) error {
+	upstreamNames := make(map[string]struct{})
+	for _, upsConfig := range upload.Upstreams {
+		upstreamNames[upsConfig.Name] = struct{}{}
 	}
+	var errs sd_config.ErrorList
+	errs.Add("", checkRoutes(config.DefaultAction, config.DefaultUpstream, config.DefaultReply,
+		config.Routes, upstreamNames))
+	errs.Add("DNS", checkDNSConfig(config.DNS))
+	return errs.Err()
+}
 
-	// init routes
-	routes := make([]*Route, 0, len(config.Routes))
-	for id, routeConfig := range config.Routes {
-		route := NewRoute(id, routeConfig)
-		routes = append(routes, route)
+// Create upstreams of upload config, routers of listeners should be added before using
+func NewManager(config *sd_config.UploadConfig) (*Manager, error) {
+	m := &Manager{
+		upstreamNames: make([]string, 0, len(config.Upstreams)),
+		upstreams:     make(map[string]Upstream),
+		routers:       make(map[string]*Router),
 	}
 
-	return &Manager{
-		defaultUpstream: defaultUpstream,
-		upstreams:       upstreams,
-		routes:          routes,
+	// init upstreams
+	for i, upsConfig := range config.Upstreams {
+		path := fmt.Sprintf("Upstreams[%d]", i)
+		if _, dup := m.upstreams[upsConfig.Name]; dup {
+			m.Close()
+			return nil, sd_config.NewFieldError(path+".Name", "duplicated upstream %q", upsConfig.Name)
+		}
+
+		upstream, err := NewUpstream(upsConfig)
+		if err != nil {
+			m.Close()
+			return nil, sd_config.WithPath(path, err)
+		}
+		m.upstreams[upsConfig.Name] = upstream
+		m.upstreamNames = append(m.upstreamNames, upsConfig.Name)
 	}
+
+	return m, nil
 }
 
-func (m *Manager) RouteUpstream(data []byte) Upstream {
-	// iterate over all routes in order
-	for _, route := range m.routes {
-		if route.Match(data) {
-			if v, ok := m.upstreams[route.upstream]; ok {
-				return v
-			}
-		}
+// Create router for listener, routes can target upstreams of manager
+// Should be called before manager is used, returns ErrorList contains all invalid fields
+func (m *Manager) AddRouter(config *sd_config.ListenerConfig) error {
+	if _, dup := m.routers[config.Name]; dup {
+		return sd_config.NewFieldError("Name", "duplicated listener %q", config.Name)
 	}
 
-	// use default upstream when not match
-	return m.defaultUpstream
+	router, err := newRouter(config, m.upstreams)
+	if err != nil {
+		return err
+	}
+	m.routers[config.Name] = router
+	m.routerNames = append(m.routerNames, config.Name)
+	return nil
+}
+
+// Return router of listener, returns nil if not exists
+func (m *Manager) GetRouter(listener string) *Router {
+	return m.routers[listener]
+}
+
+// Return upstream by name, returns nil if not exists
+func (m *Manager) GetUpstream(name string) Upstream {
+	return m.upstreams[name]
+}
+
+// Return snapshot of upstreams and routers
+func (m *Manager) Status() *ManagerStatus {
+	status := &ManagerStatus{
+		Upstreams: make([]*UpstreamStatus, 0, len(m.upstreamNames)),
+		Routers:   make([]*RouterStatus, 0, len(m.routerNames)),
+	}
+	for _, name := range m.upstreamNames {
+		status.Upstreams = append(status.Upstreams, m.upstreams[name].Status())
+	}
+	for _, name := range m.routerNames {
+		status.Routers = append(status.Routers, m.routers[name].Status())
+	}
+	return status
+}
+
+// Stop health check of all upstreams, should not use manager after close
+func (m *Manager) Close() {
+	for _, upstream := range m.upstreams {
+		upstream.Close()
+	}
 }
@@ -0,0 +1,304 @@
+package sd_upstream
+
+import (
+	"github.com/near-notfaraway/stevedore/sd_config"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+	"testing"
+)
+
+func testHealthCheckerConfig() *sd_config.HealthCheckerConfig {
+	return &sd_config.HealthCheckerConfig{
+		HeartbeatIntervalSec: 5,
+		HeartbeatTimeoutSec:  3,
+		SuccessTimes:         1,
+		FailedTimes:          1,
+	}
+}
+
+// Valid config should pass check
+func TestCheckConfig1(t *testing.T) {
+	config := &sd_config.UploadConfig{
+		DefaultAction: "drop",
+		Routes: []sd_config.RouteConfig{
+			{KeyBytes: "0:1", Operator: "==", Value: "0x69", Upstream: "rr"},
+		},
+		Upstreams: []*sd_config.UpstreamConfig{{
+			Name:          "rr",
+			Type:          UpstreamTypeRR,
+			HealthChecker: testHealthCheckerConfig(),
+			Peers: []*sd_config.PeerConfig{
+				{IP: "127.0.0.1", Port: 2345, Weight: 1, Backup: true},
+				{IP: "127.0.0.1", Port: 2346, Weight: 1},
+			},
+		}},
+	}
+	assert.Nil(t, CheckConfig(config))
+}
+
+// All errors should be reported with json path
+func TestCheckConfig2(t *testing.T) {
+	config := &sd_config.UploadConfig{
+		DefaultUpstream: "deny",
+		Routes: []sd_config.RouteConfig{
+			{KeyBytes: "4", Operator: "==", Value: "0x01", Upstream: "rr"},
+			{KeyBytes: "0:2", Operator: "=", Value: "0x01", Upstream: "ghost"},
+		},
+		Upstreams: []*sd_config.UpstreamConfig{{
+			Name: "rr",
+			Type: UpstreamTypeRR,
+			Peers: []*sd_config.PeerConfig{
+				{IP: "127.0.0.1", Port: 2345, Weight: 1},
+			},
+		}},
+	}
+
+	err := CheckConfig(config)
+	errs, ok := err.(sd_config.ErrorList)
+	assert.True(t, ok)
+
+	paths := make([]string, 0, len(errs))
+	for _, e := range errs {
+		paths = append(paths, e.(*sd_config.FieldError).Path)
+	}
+	assert.Equal(t, []string{
+		"Upstreams[0].Peers",
+		"Upstreams[0].HealthChecker",
+		"DefaultUpstream",
+		"Routes[0].KeyBytes",
+		"Routes[1].Operator",
+		"Routes[1].Value",
+		"Routes[1].Upstream",
+	}, paths)
+}
+
+// Unknown default upstream should be reported when router is created
+func TestRouter_UnknownDefaultUpstream(t *testing.T) {
+	_, err := newRouter(&sd_config.ListenerConfig{DefaultUpstream: "deny"}, map[string]Upstream{"rr": nil})
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "DefaultUpstream", err.(*sd_config.FieldError).Path)
+	}
+	_, err = newRouter(&sd_config.ListenerConfig{DefaultUpstream: "rr"}, map[string]Upstream{"rr": nil})
+	assert.Nil(t, err)
+}
+
+// Routes drop or reject packets, default action is used when no route matches
+func TestRouter_Match(t *testing.T) {
+	router, err := newRouter(&sd_config.ListenerConfig{
+		DefaultAction: "reject",
+		DefaultReply:  "0xff01{0:1}",
+		Routes: []sd_config.RouteConfig{
+			{KeyBytes: "0:1", Operator: "==", Value: "0x00", Action: "drop"},
+			{KeyBytes: "0:1", Operator: "==", Value: "0x01", Upstream: "rr", Sticky: true},
+		},
+	}, map[string]Upstream{"rr": nil})
+	assert.Nil(t, err)
+
+	assert.Equal(t, RouteActionDrop, router.Match(&Packet{Data: []byte{0x00}}).GetAction())
+	assert.Equal(t, RouteActionForward, router.Match(&Packet{Data: []byte{0x01}}).GetAction())
+	assert.Equal(t, "rr", router.Match(&Packet{Data: []byte{0x01}}).GetUpstream())
+
+	pkt := &Packet{Data: []byte{0x02}}
+	route := router.Match(pkt)
+	assert.Equal(t, RouteActionReject, route.GetAction())
+	reply, ok := route.Reply(pkt)
+	assert.True(t, ok)
+	assert.Equal(t, []byte{0xff, 0x01, 0x02}, reply)
+	assert.Nil(t, router.RouteUpstream(pkt))
+
+	status := router.Status()
+	assert.Equal(t, "reject", status.DefaultAction)
+	assert.Equal(t, "0xff01{0:1}", status.DefaultReply)
+	assert.Equal(t, "drop", status.Routes[0].Action)
+	assert.Equal(t, "forward", status.Routes[1].Action)
+	assert.False(t, router.Match(&Packet{Data: []byte{0x00}}).IsSticky())
+	assert.True(t, status.Routes[1].Sticky)
+}
+
+// Packets of sampled sessions are copied to shadow upstream
+func TestRouter_Mirror(t *testing.T) {
+	router, err := newRouter(&sd_config.ListenerConfig{Routes: []sd_config.RouteConfig{
+		{KeyBytes: "0:1", Operator: "==", Value: "0x01", Upstream: "rr",
+			Mirror: &sd_config.MirrorConfig{Upstream: "shadow", Percent: 10}},
+		{KeyBytes: "0:1", Operator: "==", Value: "0x02", Upstream: "rr"},
+	}}, map[string]Upstream{"rr": nil, "shadow": &RRUpstream{}})
+	assert.Nil(t, err)
+
+	route := router.Match(&Packet{Data: []byte{0x01}})
+	assert.NotNil(t, router.GetMirrorUpstream(route))
+	sampled := 0
+	for hash := uint32(0); hash < 1000; hash++ {
+		if route.MirrorSampled(hash) {
+			sampled++
+		}
+	}
+	assert.Equal(t, 100, sampled)
+	assert.Equal(t, "shadow", route.Status().MirrorUpstream)
+	assert.Equal(t, 10, route.Status().MirrorPercent)
+
+	route = router.Match(&Packet{Data: []byte{0x02}})
+	assert.Nil(t, router.GetMirrorUpstream(route))
+	assert.False(t, route.MirrorSampled(0))
+
+	_, err = newRouter(&sd_config.ListenerConfig{Routes: []sd_config.RouteConfig{
+		{KeyBytes: "0:1", Operator: "==", Value: "0x01", Upstream: "rr",
+			Mirror: &sd_config.MirrorConfig{Upstream: "ghost", Percent: 10}},
+	}}, map[string]Upstream{"rr": nil})
+	assert.Equal(t, "Routes[0].Mirror.Upstream", err.(*sd_config.FieldError).Path)
+}
+
+// Split should be sticky by client address or key bytes, and follow weights changed at runtime
+func TestRouter_Split(t *testing.T) {
+	stable, canary := &RRUpstream{}, &RRUpstream{}
+	router, err := newRouter(&sd_config.ListenerConfig{Routes: []sd_config.RouteConfig{
+		{KeyBytes: "0:1", Operator: "==", Value: "0x01", Split: []*sd_config.SplitConfig{
+			{Upstream: "stable", Weight: 95}, {Upstream: "canary", Weight: 5}}},
+		{KeyBytes: "0:1", Operator: "==", Value: "0x02", SplitKey: "1:3", Split: []*sd_config.SplitConfig{
+			{Upstream: "stable", Weight: 1}, {Upstream: "canary", Weight: 1}}},
+	}}, map[string]Upstream{"stable": stable, "canary": canary})
+	assert.Nil(t, err)
+
+	// by client address
+	route := router.Match(&Packet{Data: []byte{0x01}})
+	counts := make(map[Upstream]int)
+	for port := 0; port < 10000; port++ {
+		pkt := &Packet{Data: []byte{0x01}, Sockaddr: &unix.SockaddrInet4{Addr: [4]byte{10, 0, 0, 1}, Port: port}}
+		upstream := router.GetUpstream(route, pkt)
+		assert.Equal(t, upstream, router.GetUpstream(route, pkt))
+		counts[upstream]++
+	}
+	assert.InDelta(t, 500, counts[canary], 100)
+	assert.Equal(t, 10000, counts[stable]+counts[canary])
+
+	status := route.Status().Split
+	assert.Equal(t, 2, len(status))
+	assert.Equal(t, uint64(2*counts[canary]), status[1].Packets)
+	assert.Equal(t, uint64(2*counts[canary]), status[1].Bytes)
+
+	// by key bytes, client address is ignored
+	route = router.Match(&Packet{Data: []byte{0x02}})
+	pkt := &Packet{Data: []byte{0x02, 0xab, 0xcd}, Sockaddr: &unix.SockaddrInet4{Port: 1}}
+	upstream := router.GetUpstream(route, pkt)
+	pkt.Sockaddr = &unix.SockaddrInet4{Port: 2}
+	assert.Equal(t, upstream, router.GetUpstream(route, pkt))
+	assert.Equal(t, "1:3", route.Status().SplitKey)
+
+	// packet too short for key bytes is not routed by client address
+	assert.Nil(t, router.GetUpstream(route, &Packet{Data: []byte{0x02, 0xab}, Sockaddr: &unix.SockaddrInet4{Port: 1}}))
+	assert.Equal(t, uint64(2), route.Status().Split[0].Packets+route.Status().Split[1].Packets)
+
+	// change weights
+	assert.Nil(t, route.SetSplitWeights(map[string]int{"stable": 0}))
+	assert.Equal(t, canary, router.GetUpstream(route, pkt))
+	assert.NotNil(t, route.SetSplitWeights(map[string]int{"canary": 0}))
+	assert.NotNil(t, route.SetSplitWeights(map[string]int{"ghost": 1}))
+	assert.NotNil(t, router.GetRoute(0).SetSplitWeights(map[string]int{"stable": -1}))
+	assert.Equal(t, []int{0, 1}, []int{route.Status().Split[0].Weight, route.Status().Split[1].Weight})
+
+	// chosen without allocation
+	allocs := testing.AllocsPerRun(100, func() { router.GetUpstream(route, pkt) })
+	assert.Equal(t, float64(0), allocs)
+
+	_, err = newRouter(&sd_config.ListenerConfig{Routes: []sd_config.RouteConfig{
+		{KeyBytes: "0:1", Operator: "==", Value: "0x01", Split: []*sd_config.SplitConfig{
+			{Upstream: "stable", Weight: 1}, {Upstream: "ghost", Weight: 1}}},
+	}}, map[string]Upstream{"stable": stable})
+	assert.Equal(t, "Routes[0].Split[1].Upstream", err.(*sd_config.FieldError).Path)
+}
+
+// Action errors should be reported with json path
+func TestCheckConfig3(t *testing.T) {
+	config := &sd_config.UploadConfig{
+		DefaultAction:   "drop",
+		DefaultUpstream: "rr",
+		Routes: []sd_config.RouteConfig{
+			{KeyBytes: "0:1", Operator: "==", Value: "0x01", Action: "deny"},
+			{KeyBytes: "0:1", Operator: "==", Value: "0x01", Action: "drop", Reply: "0xff"},
+			{KeyBytes: "0:1", Operator: "==", Value: "0x01", Action: "reject", Upstream: "rr"},
+			{KeyBytes: "0:1", Operator: "==", Value: "0x01", Action: "reject", Reply: "0xff{9}"},
+			{KeyBytes: "0:1", Operator: "==", Value: "0x01", Reply: "0xff"},
+			{KeyBytes: "0:1", Operator: "==", Value: "0x01", Action: "drop",
+				Mirror: &sd_config.MirrorConfig{Percent: 101}},
+			{KeyBytes: "0:1", Operator: "==", Value: "0x01", Action: "drop", SplitKey: "x",
+				Split: []*sd_config.SplitConfig{{Upstream: "rr", Weight: 1}}},
+			{KeyBytes: "0:1", Operator: "==", Value: "0x01", Action: "drop", SplitKey: "0:2"},
+			{KeyBytes: "0:1", Operator: "==", Value: "0x01", Split: []*sd_config.SplitConfig{
+				{Upstream: "ghost", Weight: 1}, {Upstream: "ghost"}, {Weight: -1}}},
+			{KeyBytes: "0:1", Operator: "==", Value: "0x01", Action: "drop", Sticky: true},
+		},
+	}
+
+	err := CheckConfig(config)
+	errs, ok := err.(sd_config.ErrorList)
+	assert.True(t, ok)
+
+	paths := make([]string, 0, len(errs))
+	for _, e := range errs {
+		paths = append(paths, e.(*sd_config.FieldError).Path)
+	}
+	assert.Equal(t, []string{
+		"DefaultUpstream",
+		"Routes[0].Action",
+		"Routes[1].Reply",
+		"Routes[2].Upstream",
+		"Routes[2].Reply",
+		"Routes[3].Reply",
+		"Routes[4].Reply",
+		"Routes[4].Upstream",
+		"Routes[5].Mirror",
+		"Routes[5].Mirror.Upstream",
+		"Routes[5].Mirror.Percent",
+		"Routes[6].Split",
+		"Routes[6].SplitKey",
+		"Routes[7].SplitKey",
+		"Routes[8].Split[1].Upstream",
+		"Routes[8].Split[2].Upstream",
+		"Routes[8].Split[2].Weight",
+		"Routes[8].Split[0].Upstream",
+		"Routes[8].Split[1].Upstream",
+		"Routes[9].Sticky",
+	}, paths)
+}
+
+// Each listener routes packets by its own routes, upstreams are shared
+func TestManager_AddRouter(t *testing.T) {
+	mgr, err := NewManager(&sd_config.UploadConfig{
+		Upstreams: []*sd_config.UpstreamConfig{
+			{Name: "game", Type: UpstreamTypeRR, HealthChecker: testHealthCheckerConfig(), Peers: []*sd_config.PeerConfig{
+				{IP: "127.0.0.1", Port: 2345, Weight: 1, Backup: true},
+				{IP: "127.0.0.1", Port: 2346, Weight: 1},
+			}},
+			{Name: "voice", Type: UpstreamTypeRR, HealthChecker: testHealthCheckerConfig(), Peers: []*sd_config.PeerConfig{
+				{IP: "127.0.0.1", Port: 3478, Weight: 1, Backup: true},
+				{IP: "127.0.0.1", Port: 3479, Weight: 1},
+			}},
+		},
+	})
+	assert.Nil(t, err)
+	defer mgr.Close()
+
+	assert.Nil(t, mgr.AddRouter(&sd_config.ListenerConfig{Name: "game", DefaultUpstream: "game"}))
+	assert.Nil(t, mgr.AddRouter(&sd_config.ListenerConfig{Name: "voice", Routes: []sd_config.RouteConfig{
+		{KeyBytes: "0:1", Operator: "==", Value: "0x01", Upstream: "voice"},
+	}}))
+
+	pkt := &Packet{Data: []byte{0x01}}
+	assert.Equal(t, mgr.GetUpstream("game"), mgr.GetRouter("game").RouteUpstream(pkt))
+	assert.Equal(t, mgr.GetUpstream("voice"), mgr.GetRouter("voice").RouteUpstream(pkt))
+	assert.Nil(t, mgr.GetRouter("voice").RouteUpstream(&Packet{Data: []byte{0x02}}))
+	assert.Nil(t, mgr.GetRouter("ghost"))
+
+	status := mgr.Status()
+	assert.Equal(t, 2, len(status.Routers))
+	assert.Equal(t, "voice", status.Routers[1].Listener)
+	assert.Equal(t, "0:1 == 0x01", status.Routers[1].Routes[0].Condition)
+
+	// invalid routers are not added
+	err = mgr.AddRouter(&sd_config.ListenerConfig{Name: "game"})
+	assert.Equal(t, "Name", err.(*sd_config.FieldError).Path)
+	err = mgr.AddRouter(&sd_config.ListenerConfig{Name: "chat", Routes: []sd_config.RouteConfig{
+		{KeyBytes: "0:1", Operator: "==", Value: "0x01", Upstream: "ghost"},
+	}})
+	assert.Equal(t, "Routes[0].Upstream", err.(*sd_config.FieldError).Path)
+	assert.Equal(t, 2, len(mgr.Status().Routers))
+}
@@ -0,0 +1,6 @@
+//go:build !race
+// +build !race
+
+package sd_upstream
+
+const raceEnabled = false
@@ -0,0 +1,51 @@
+package sd_upstream
+
+import (
+	"github.com/near-notfaraway/stevedore/sd_util"
+	"golang.org/x/sys/unix"
+)
+
+//------------------------------------------------------------------------------
+// Packet: Used to route a packet according to its data and source address
+//------------------------------------------------------------------------------
+
+// Packet can be reused for every packet to avoid allocation, Set should be used to change data of reused packet
+type Packet struct {
+	Data      []byte                 // payload of packet
+	Sockaddr  unix.Sockaddr          // source address of packet, maybe nil
+	keyBuf    [MaxExtractKeyLen]byte // used to extract key written into buffer
+	routeSet  []uint64               // used to find candidate routes
+	latin1    sd_util.Latin1Reader   // used to match regular expression on data
+	replyBuf  []byte                 // used to build reply of rejected packet
+	dns       dnsQuery               // dns query parsed from data, valid if dnsOk
+	dnsParsed bool                   // if data is parsed as dns query
+	dnsOk     bool                   // if data is a valid dns query
+}
+
+// Set data and source address of packet, results parsed from last data are dropped
+func (p *Packet) Set(data []byte, sa unix.Sockaddr) {
+	p.Data, p.Sockaddr = data, sa
+	p.dnsParsed = false
+}
+
+// Return dns query of data, data is parsed only once until it is set
+func (p *Packet) dnsQuery() (dnsQuery, bool) {
+	if !p.dnsParsed {
+		p.dns, p.dnsOk = parseDNSQuery(p.Data)
+		p.dnsParsed = true
+	}
+	return p.dns, p.dnsOk
+}
+
+// Return source ip in 16-byte form and source port, ok is false if no source address
+func (p *Packet) srcAddr() (ip [16]byte, port int, ok bool) {
+	switch sa := p.Sockaddr.(type) {
+	case *unix.SockaddrInet4:
+		ip[10], ip[11] = 0xff, 0xff
+		copy(ip[12:], sa.Addr[:])
+		return ip, sa.Port, true
+	case *unix.SockaddrInet6:
+		return sa.Addr, sa.Port, true
+	}
+	return ip, 0, false
+}
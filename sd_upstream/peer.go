@@ -6,6 +6,7 @@ import (
 	"github.com/near-notfaraway/stevedore/sd_socket"
 	"golang.org/x/sys/unix"
 	"sync"
+	"time"
 )
 
 type PeerState int
@@ -15,8 +16,23 @@ const (
 	PeerAlive
 	PeerTemp
 	PeerDead
+	PeerDraining
 )
 
+func (s PeerState) String() string {
+	switch s {
+	case PeerAlive:
+		return "alive"
+	case PeerTemp:
+		return "temp"
+	case PeerDead:
+		return "dead"
+	case PeerDraining:
+		return "draining"
+	}
+	return "unknown"
+}
+
 //------------------------------------------------------------------------------
 // Peer: Used to upload packet
 //------------------------------------------------------------------------------
@@ -27,13 +43,16 @@ type Peer struct {
 	addr     string        // humane addr
 	sockaddr unix.Sockaddr // sockaddr for send packet
 	weight   int           // selected ratio
+	backup   bool          // if peer is backup
 	state    PeerState     // define if peer is available
+	deadline time.Time     // deadline of draining, zero means no deadline
+	drained  bool          // if dead peer was draining, it returns to draining when recovered
 }
 
-func NewPeer(id int, addr string, config *sd_config.PeerConfig) *Peer {
+func NewPeer(id int, addr string, config *sd_config.PeerConfig) (*Peer, error) {
 	sockaddr := sd_socket.ResolveUDPSockaddr(addr)
 	if sockaddr == nil {
-		panic(fmt.Errorf("resolve peer addr %s failed", addr))
+		return nil, fmt.Errorf("resolve peer addr %s failed", addr)
 	}
 
 	return &Peer{
@@ -41,8 +60,9 @@ func NewPeer(id int, addr string, config *sd_config.PeerConfig) *Peer {
 		addr:     addr,
 		sockaddr: sockaddr,
 		weight:   config.Weight,
+		backup:   config.Backup,
 		state:    PeerAlive,
-	}
+	}, nil
 }
 
 func (p *Peer) Send(fd int, data []byte) error {
@@ -57,12 +77,117 @@ func (p *Peer) SetState(state PeerState) {
 	p.state = state
 }
 
+// Set peer draining, it gets no new flows but keeps existing flows until deadline
+// Zero deadline means keeping existing flows until they go idle
+func (p *Peer) Drain(deadline time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.deadline = deadline
+	if p.state == PeerDead {
+		p.drained = true
+		return
+	}
+	p.state = PeerDraining
+}
+
+// Set peer dead because of failed checks or send errors, draining peer is set dead too so that its flows leave
+// Returns false if peer is already dead
+func (p *Peer) MarkDead() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state == PeerDead {
+		return false
+	}
+	p.drained = p.state == PeerDraining
+	p.state = PeerDead
+	return true
+}
+
+// Set dead peer recovered, which returns to draining if it was draining, otherwise alive
+func (p *Peer) recover() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.drained {
+		p.state = PeerDraining
+	} else {
+		p.state = PeerAlive
+	}
+	p.drained = false
+}
+
+// Stop draining, dead peer which was draining is set alive when recovered
+func (p *Peer) undrain() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state == PeerDraining {
+		p.state = PeerAlive
+	}
+	p.drained = false
+}
+
+func (p *Peer) IsDraining() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.state == PeerDraining
+}
+
+// Return if peer is draining and still keeps existing flows at now
+func (p *Peer) inDrain(now time.Time) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.state == PeerDraining && (p.deadline.IsZero() || now.Before(p.deadline))
+}
+
+func (p *Peer) SetWeight(weight int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.weight = weight
+}
+
+func (p *Peer) getWeight() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.weight
+}
+
+// Return deadline of draining peer, zero if peer is not draining or keeps flows until drain is canceled
+func (p *Peer) getDrainDeadline() time.Time {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.state != PeerDraining {
+		return time.Time{}
+	}
+	return p.deadline
+}
+
 func (p *Peer) isAlive() bool {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 	return p.state == PeerAlive
 }
 
+// Return if peer can keep existing flows, which is alive, used as backup or draining before deadline
+func (p *Peer) IsAvailable() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.state == PeerAlive || p.state == PeerTemp || (p.state == PeerDraining && (p.deadline.IsZero() || time.Now().Before(p.deadline)))
+}
+
 func (p *Peer) GetAddr() string {
 	return p.addr
 }
+
+func (p *Peer) Status() *PeerStatus {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	status := &PeerStatus{
+		Addr:   p.addr,
+		State:  p.state.String(),
+		Weight: p.weight,
+		Backup: p.backup,
+	}
+	if p.state == PeerDraining && !p.deadline.IsZero() {
+		status.DrainDeadline = p.deadline.Format(time.RFC3339)
+	}
+	return status
+}
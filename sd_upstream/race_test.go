@@ -0,0 +1,7 @@
+//go:build race
+// +build race
+
+package sd_upstream
+
+// Race detector makes regexp allocate, so allocation of it is only checked without race detector
+const raceEnabled = true
@@ -0,0 +1,85 @@
+package sd_upstream
+
+import (
+	"fmt"
+	"github.com/near-notfaraway/stevedore/sd_util"
+	"strings"
+)
+
+//------------------------------------------------------------------------------
+// ReplyTemplate: Used to build reply payload of rejected packet
+//------------------------------------------------------------------------------
+
+// Template is a sequence of literal bytes in form 0x or 0b, and key specs in braces
+// which are replaced by key bytes of request, such as `0xff00{4:6}0x0d0a`
+type replyTemplate struct {
+	spec  string       // origin template
+	parts []*replyPart // parts in order
+}
+
+// One of literal and key is set
+type replyPart struct {
+	literal []byte   // literal bytes
+	key     *keySpec // used to echo key bytes of request
+}
+
+// Parse reply template, returns error if it is invalid
+func parseReplyTemplate(spec string) (*replyTemplate, error) {
+	if spec == "" {
+		return nil, fmt.Errorf("should not be empty")
+	}
+
+	t := &replyTemplate{spec: spec}
+	for rest := spec; rest != ""; {
+		// key spec in braces
+		if rest[0] == '{' {
+			end := strings.Index(rest, "}")
+			if end < 0 {
+				return nil, fmt.Errorf("brace at %d is not closed", len(spec)-len(rest))
+			}
+			key, err := parseKeySpec(rest[1:end])
+			if err != nil {
+				return nil, err
+			}
+			t.parts = append(t.parts, &replyPart{key: key})
+			rest = rest[end+1:]
+			continue
+		}
+
+		// literal bytes until next brace
+		end := strings.Index(rest, "{")
+		if end < 0 {
+			end = len(rest)
+		}
+		literal, err := sd_util.StringToBytes(rest[:end])
+		if err != nil {
+			return nil, err
+		}
+		t.parts = append(t.parts, &replyPart{literal: literal})
+		rest = rest[end:]
+	}
+	return t, nil
+}
+
+// Build reply of packet into buffer of packet, returns slice valid until packet reused
+// ok is false if key can not be extracted from packet
+func (t *replyTemplate) Build(pkt *Packet) ([]byte, bool) {
+	reply := pkt.replyBuf[:0]
+	for _, part := range t.parts {
+		if part.key == nil {
+			reply = append(reply, part.literal...)
+			continue
+		}
+		key, ok := part.key.Extract(pkt.Data, pkt.keyBuf[:])
+		if !ok {
+			return nil, false
+		}
+		reply = append(reply, key...)
+	}
+	pkt.replyBuf = reply
+	return reply, true
+}
+
+func (t *replyTemplate) String() string {
+	return t.spec
+}
@@ -0,0 +1,37 @@
+package sd_upstream
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// Literal bytes and key bytes of request are joined in order
+func TestReplyTemplate_Build(t *testing.T) {
+	tpl, err := parseReplyTemplate("0xff00{4:6}0x0d0a{0b:4b}")
+	assert.Nil(t, err)
+	assert.Equal(t, "0xff00{4:6}0x0d0a{0b:4b}", tpl.String())
+
+	pkt := &Packet{Data: []byte{0xab, 0, 0, 0, 0x12, 0x34}}
+	reply, ok := tpl.Build(pkt)
+	assert.True(t, ok)
+	assert.Equal(t, []byte{0xff, 0x00, 0x12, 0x34, 0x0d, 0x0a, 0x0a}, reply)
+
+	// key can not be extracted from short packet
+	_, ok = tpl.Build(&Packet{Data: []byte{0xab, 0}})
+	assert.False(t, ok)
+
+	// built without allocation once buffer grown
+	allocs := testing.AllocsPerRun(100, func() { tpl.Build(pkt) })
+	assert.Equal(t, float64(0), allocs)
+
+	tpl, err = parseReplyTemplate("{0:2}")
+	assert.Nil(t, err)
+	reply, ok = tpl.Build(pkt)
+	assert.True(t, ok)
+	assert.Equal(t, []byte{0xab, 0}, reply)
+
+	for _, spec := range []string{"", "ff00", "0xff0", "0xff{4:6", "0xff{6:4}", "0xff{}"} {
+		_, err = parseReplyTemplate(spec)
+		assert.NotNil(t, err, spec)
+	}
+}
@@ -1,72 +1,263 @@
 package sd_upstream
 
 import (
+	"fmt"
 	"github.com/near-notfaraway/stevedore/sd_config"
-	"github.com/near-notfaraway/stevedore/sd_util"
-	"github.com/sirupsen/logrus"
-	"strconv"
-	"strings"
 )
 
 //------------------------------------------------------------------------------
 // Route: Used to choose upstream according to data
 //------------------------------------------------------------------------------
 
+// Actions taken on matched packet
+const (
+	RouteActionForward = "forward" // forward to upstream
+	RouteActionDrop    = "drop"    // drop silently
+	RouteActionReject  = "reject"  // drop and send reply to client
+)
+
 type Route struct {
-	id         int    // unique id
-	operator   string // bytes operation type
-	bytesStart int    // start index used to extract data
-	bytesEnd   int    // end index used to extract data
-	bytesValue []byte // bytes used to operate with data
-	upstream   string // target upstream
+	id        int            // unique id
+	condition Condition      // decide if data matches route, nil means always match
+	action    string         // action taken on matched packet
+	upstream  string         // target upstream of forward action
+	split     *routeSplit    // weighted upstreams of forward action, nil means upstream is used
+	reply     *replyTemplate // reply template of reject action
+	mirror    *routeMirror   // copy packets to shadow upstream, nil means no mirror
+	sticky    bool           // if session keeps upstream and peer chosen for its first packet
 }
 
-func NewRoute(id int, config sd_config.RouteConfig) *Route {
-	// init bytes start and bytes end
-	bytesIdx := strings.Split(config.KeyBytes, ":")
-	bytesStart, err := strconv.Atoi(bytesIdx[0])
-	if err != nil {
-		logrus.Panicf("bytes start %s is invalid in route %d", bytesIdx[0], id)
+// Packets of sampled sessions are copied to shadow upstream
+type routeMirror struct {
+	upstream string // shadow upstream
+	percent  uint32 // percent of sessions sampled
+}
+
+// Create route from config, which not check if upstream exists
+// Match or Condition is used if set, otherwise KeyBytes or KeyExtractor, Operator and Value form a single condition
+// Returns ErrorList contains all invalid fields
+func NewRoute(id int, config sd_config.RouteConfig) (*Route, error) {
+	var errs sd_config.ErrorList
+
+	// init condition
+	var condition Condition
+	var err error
+	leaf := &sd_config.ConditionConfig{
+		KeyBytes:     config.KeyBytes,
+		KeyExtractor: config.KeyExtractor,
+		Operator:     config.Operator,
+		Value:        config.Value,
+		Endian:       config.Endian,
+		ScanLimit:    config.ScanLimit,
 	}
-	bytesEnd, err := strconv.Atoi(bytesIdx[1])
-	if err != nil {
-		logrus.Panicf("bytes end %s is invalid in route %d", bytesIdx[1], id)
+	if config.Match != "" {
+		if config.Condition != nil || isLeafConditionConfig(leaf) {
+			errs = append(errs, sd_config.NewFieldError("Match",
+				"should not be set with Condition, KeyBytes, KeyExtractor, Operator or Value"))
+		} else if condition, err = ParseExpression(config.Match); err != nil {
+			errs.Add("Match", err)
+		}
+	} else if config.Condition != nil {
+		if isLeafConditionConfig(leaf) {
+			errs = append(errs, sd_config.NewFieldError("Condition",
+				"should not be set with KeyBytes, KeyExtractor, Operator or Value"))
+		} else if condition, err = NewCondition(config.Condition); err != nil {
+			errs.Add("Condition", err)
+		}
+	} else if condition, err = newLeafCondition(leaf); err != nil {
+		errs.Add("", err)
 	}
-	if bytesStart >= bytesEnd {
-		logrus.Panicf("bytes start %s is not less than bytes end %s in route %d", bytesIdx[0], bytesIdx[1], id)
+
+	// init action
+	route, err := newActionRoute("", config.Action, config.Upstream, config.Reply)
+	errs.Add("", err)
+	isForward := route != nil && route.action == RouteActionForward
+	if isForward && config.Upstream == "" && len(config.Split) == 0 {
+		errs = append(errs, sd_config.NewFieldError("Upstream", "should not be empty"))
+	}
+
+	// init split
+	var split *routeSplit
+	if len(config.Split) > 0 {
+		if route != nil && !isForward {
+			errs = append(errs, sd_config.NewFieldError("Split", "only works with forward action"))
+		}
+		if config.Upstream != "" {
+			errs = append(errs, sd_config.NewFieldError("Upstream", "should not be set with Split"))
+		}
+		if split, err = newRouteSplit(config.Split, config.SplitKey); err != nil {
+			errs.Add("", err)
+		}
+	} else if config.SplitKey != "" {
+		errs = append(errs, sd_config.NewFieldError("SplitKey", "only works with Split"))
 	}
 
-	// init bytes value
-	bytesValue, err := sd_util.StringToBytes(config.Value)
+	// init mirror
+	if config.Mirror != nil {
+		if route != nil && route.action != RouteActionForward {
+			errs = append(errs, sd_config.NewFieldError("Mirror", "only works with forward action"))
+		}
+		if config.Mirror.Upstream == "" {
+			errs = append(errs, sd_config.NewFieldError("Mirror.Upstream", "should not be empty"))
+		}
+		if config.Mirror.Percent < 1 || config.Mirror.Percent > 100 {
+			errs = append(errs, sd_config.NewFieldError("Mirror.Percent", "should be in range 1 to 100"))
+		}
+	}
+
+	if config.Sticky && route != nil && route.action != RouteActionForward {
+		errs = append(errs, sd_config.NewFieldError("Sticky", "only works with forward action"))
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	route.id = id
+	route.sticky = config.Sticky
+	route.condition = condition
+	route.split = split
+	if config.Mirror != nil {
+		route.mirror = &routeMirror{upstream: config.Mirror.Upstream, percent: uint32(config.Mirror.Percent)}
+	}
+	return route, nil
+}
+
+// Create route without condition, used as default route when no route matches
+// Packets are dropped if action is forward but default upstream is empty
+func newDefaultRoute(action, upstream, reply string) (*Route, error) {
+	route, err := newActionRoute("Default", action, upstream, reply)
 	if err != nil {
-		logrus.Panicf("value %s invalid in route %d: %v", config.Value, id, err)
+		return nil, err
+	}
+	route.id = -1
+	return route, nil
+}
+
+// Create route with action, which is forward if empty
+// Field names of action, upstream and reply are prefixed with prefix
+// Returns ErrorList contains all invalid fields, the route is returned if action is valid
+func newActionRoute(prefix, action, upstream, reply string) (*Route, error) {
+	var errs sd_config.ErrorList
+	route := &Route{action: action, upstream: upstream}
+	if route.action == "" {
+		route.action = RouteActionForward
+	}
+
+	switch route.action {
+	case RouteActionForward, RouteActionDrop, RouteActionReject:
+	default:
+		errs = append(errs, sd_config.NewFieldError(prefix+"Action", "invalid action %q", action))
+		route = nil
+	}
+
+	if upstream != "" && route != nil && route.action != RouteActionForward {
+		errs = append(errs, sd_config.NewFieldError(prefix+"Upstream", "only works with forward action"))
 	}
-	if len(bytesValue) != (bytesEnd - bytesStart) {
-		logrus.Panicf("value %s length is not equal to bytes length in route %d", config.Value, id)
+
+	if route != nil && route.action == RouteActionReject {
+		var err error
+		if route.reply, err = parseReplyTemplate(reply); err != nil {
+			errs.Add(prefix+"Reply", err)
+		}
+	} else if reply != "" {
+		errs = append(errs, sd_config.NewFieldError(prefix+"Reply", "only works with reject action"))
 	}
 
-	return &Route{
-		id:         id,
-		operator:   config.Operator,
-		bytesStart: bytesStart,
-		bytesEnd:   bytesEnd,
-		bytesValue: bytesValue,
-		upstream:   config.Upstream,
+	if len(errs) > 0 {
+		return route, errs
 	}
+	return route, nil
+}
+
+func (r *Route) Match(pkt *Packet) bool {
+	return r.condition == nil || r.condition.Match(pkt)
 }
 
-func (r *Route) Match(data []byte) bool {
-	// data too short
-	if len(data) < r.bytesEnd {
-		return false
+// Return action taken on matched packet
+func (r *Route) GetAction() string {
+	return r.action
+}
+
+// Return name of target upstream of forward action, returns empty if route splits between upstreams
+func (r *Route) GetUpstream() string {
+	return r.upstream
+}
+
+// Return if session keeps upstream and peer chosen for its first packet matched this route
+func (r *Route) IsSticky() bool {
+	return r.sticky
+}
+
+// Return id of route, which is -1 for default route
+func (r *Route) GetId() int {
+	return r.id
+}
+
+// Change weights of split by upstream name, weights of upstreams not given are kept
+// Returns error if route has no split or upstream is not an arm of split
+func (r *Route) SetSplitWeights(weights map[string]int) error {
+	if r.split == nil {
+		return fmt.Errorf("route %d has no split", r.id)
 	}
 
-	// extract bytes and operate
-	bytes := data[r.bytesStart:r.bytesEnd]
-	matched, err := sd_util.BytesOperate(r.operator, bytes, r.bytesValue)
-	if err != nil {
-		logrus.Errorf("route match operation failed: %v", err)
+	// copy current weights, then override them
+	t := r.split.table.Load().(*splitTable)
+	newWeights := make([]int, len(r.split.arms))
+	for i := range r.split.arms {
+		newWeights[i] = int(t.weights[i])
 	}
+	for name, weight := range weights {
+		found := false
+		for i, arm := range r.split.arms {
+			if arm.upstream == name {
+				newWeights[i], found = weight, true
+			}
+		}
+		if !found {
+			return fmt.Errorf("upstream %q is not in split of route %d", name, r.id)
+		}
+	}
+	return r.split.setWeights(newWeights)
+}
+
+// Return if packets of session should be copied to shadow upstream
+// hash is hash of session, so that all packets of sampled session are copied
+func (r *Route) MirrorSampled(hash uint32) bool {
+	return r.mirror != nil && hash%100 < r.mirror.percent
+}
+
+// Build reply of rejected packet, returns slice valid until packet reused
+// ok is false if route is not reject or key can not be extracted
+func (r *Route) Reply(pkt *Packet) ([]byte, bool) {
+	if r.reply == nil {
+		return nil, false
+	}
+	return r.reply.Build(pkt)
+}
 
-	return matched
+func (r *Route) Status() *RouteStatus {
+	status := &RouteStatus{
+		Id:       r.id,
+		Action:   r.action,
+		Upstream: r.upstream,
+	}
+	if r.condition != nil {
+		status.Condition = r.condition.String()
+	}
+	if r.reply != nil {
+		status.Reply = r.reply.String()
+	}
+	if r.split != nil {
+		status.Split = r.split.status()
+		if r.split.key != nil {
+			status.SplitKey = r.split.key.String()
+		}
+	}
+	if r.mirror != nil {
+		status.MirrorUpstream = r.mirror.upstream
+		status.MirrorPercent = int(r.mirror.percent)
+	}
+	status.Sticky = r.sticky
+	return status
 }
@@ -0,0 +1,168 @@
+package sd_upstream
+
+import (
+	"github.com/near-notfaraway/stevedore/sd_util"
+	"math/bits"
+	"sort"
+)
+
+//------------------------------------------------------------------------------
+// RouteTable: Used to find the first matched route without checking all routes
+//------------------------------------------------------------------------------
+
+// Max number of byte ranges indexed, the most used ranges are chosen
+const maxRouteIndexes = 8
+
+// Routes are compiled into indexes on byte ranges, each index maps key value to routes
+// requiring key equal to it, candidates of a packet are intersection of matched routes
+// of all indexes, then candidates are checked in order to keep first-match semantics
+type routeTable struct {
+	routes  []*Route      // all routes in order
+	all     []uint64      // bitset of all routes
+	indexes []*routeIndex // indexes on byte ranges
+}
+
+type routeIndex struct {
+	start  int                 // start index of byte range
+	end    int                 // end index of byte range
+	values map[uint64][]uint64 // key value to bitset of routes requiring key equal to it
+	free   []uint64            // bitset of routes not requiring anything on byte range
+}
+
+// Equality required by route on a byte range
+type routeConstraint struct {
+	start int    // start index of byte range
+	end   int    // end index of byte range
+	value uint64 // value of key in big endian
+}
+
+func newRouteTable(routes []*Route) *routeTable {
+	words := (len(routes) + 63) / 64
+	t := &routeTable{routes: routes, all: make([]uint64, words)}
+	for i := range routes {
+		t.all[i/64] |= 1 << (i % 64)
+	}
+
+	// collect constraints of routes, and count routes using each byte range
+	type byteRange struct{ start, end int }
+	counts := make(map[byteRange]int)
+	constraints := make([][]routeConstraint, len(routes))
+	for i, route := range routes {
+		constraints[i] = equalConstraints(route.condition)
+		for _, c := range constraints[i] {
+			counts[byteRange{c.start, c.end}]++
+		}
+	}
+
+	// index the most used byte ranges
+	ranges := make([]byteRange, 0, len(counts))
+	for r := range counts {
+		ranges = append(ranges, r)
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		if counts[ranges[i]] != counts[ranges[j]] {
+			return counts[ranges[i]] > counts[ranges[j]]
+		}
+		if ranges[i].start != ranges[j].start {
+			return ranges[i].start < ranges[j].start
+		}
+		return ranges[i].end < ranges[j].end
+	})
+	if len(ranges) > maxRouteIndexes {
+		ranges = ranges[:maxRouteIndexes]
+	}
+
+	for _, r := range ranges {
+		idx := &routeIndex{
+			start:  r.start,
+			end:    r.end,
+			values: make(map[uint64][]uint64),
+			free:   make([]uint64, words),
+		}
+		copy(idx.free, t.all)
+		for i := range routes {
+			for _, c := range constraints[i] {
+				if c.start != r.start || c.end != r.end {
+					continue
+				}
+				set, ok := idx.values[c.value]
+				if !ok {
+					set = make([]uint64, words)
+					idx.values[c.value] = set
+				}
+				set[i/64] |= 1 << (i % 64)
+				idx.free[i/64] &^= 1 << (i % 64)
+				break
+			}
+		}
+		t.indexes = append(t.indexes, idx)
+	}
+
+	return t
+}
+
+// Return equality constraints which are necessary for condition to match
+func equalConstraints(cond Condition) []routeConstraint {
+	switch c := cond.(type) {
+	case *bytesCondition:
+		key, ok := c.key.(*keySpec)
+		if !ok || c.operator != sd_util.BytesOpEqual || key.lenSize > 0 || key.bits ||
+			key.startFromEnd || key.endFromEnd || key.end-key.start > 8 {
+			return nil
+		}
+		return []routeConstraint{{
+			start: key.start,
+			end:   key.end,
+			value: sd_util.BytesToUint(c.bytesValue, false),
+		}}
+
+	case andCondition:
+		var rst []routeConstraint
+		for _, sub := range c {
+			rst = append(rst, equalConstraints(sub)...)
+		}
+		return rst
+	}
+
+	return nil
+}
+
+// Return the first route matches packet, returns nil if no route matches
+func (t *routeTable) Match(pkt *Packet) *Route {
+	if len(t.routes) == 0 {
+		return nil
+	}
+
+	// candidates are routes matched by all indexes
+	words := len(t.all)
+	if cap(pkt.routeSet) < words {
+		pkt.routeSet = make([]uint64, words)
+	}
+	set := pkt.routeSet[:words]
+	copy(set, t.all)
+	for _, idx := range t.indexes {
+		var hit []uint64
+		if len(pkt.Data) >= idx.end {
+			hit = idx.values[sd_util.BytesToUint(pkt.Data[idx.start:idx.end], false)]
+		}
+		for w := range set {
+			mask := idx.free[w]
+			if hit != nil {
+				mask |= hit[w]
+			}
+			set[w] &= mask
+		}
+	}
+
+	// check candidates in order
+	for w, word := range set {
+		for word != 0 {
+			i := w*64 + bits.TrailingZeros64(word)
+			if t.routes[i].Match(pkt) {
+				return t.routes[i]
+			}
+			word &= word - 1
+		}
+	}
+	return nil
+}
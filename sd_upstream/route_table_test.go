@@ -0,0 +1,105 @@
+package sd_upstream
+
+import (
+	"fmt"
+	"github.com/near-notfaraway/stevedore/sd_config"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"testing"
+)
+
+// Return first matched route by checking all routes in order
+func linearMatch(routes []*Route, pkt *Packet) *Route {
+	for _, route := range routes {
+		if route.Match(pkt) {
+			return route
+		}
+	}
+	return nil
+}
+
+// Routes on version and tenant, the last route is a catch-all on length
+// Some routes can not be indexed if mixed
+func testRoutes(t testing.TB, n int, mixed bool) []*Route {
+	routes := make([]*Route, 0, n+1)
+	for i := 0; i < n; i++ {
+		var config sd_config.RouteConfig
+		switch i % 3 {
+		case 0:
+			config = sd_config.RouteConfig{KeyBytes: "4:6", Operator: "==", Value: fmt.Sprintf("0x%04x", i)}
+		case 1:
+			config = sd_config.RouteConfig{Condition: &sd_config.ConditionConfig{And: []*sd_config.ConditionConfig{
+				{KeyBytes: "4:6", Operator: "==", Value: fmt.Sprintf("0x%04x", i%16)},
+				{KeyBytes: "8:12", Operator: "==", Value: fmt.Sprintf("0x%08x", i)},
+			}}}
+		case 2:
+			config = sd_config.RouteConfig{Condition: &sd_config.ConditionConfig{And: []*sd_config.ConditionConfig{
+				{KeyBytes: "0:1", Operator: "==", Value: fmt.Sprintf("0x%02x", i%256)},
+				{KeyBytes: "8:12", Operator: "==", Value: fmt.Sprintf("0x%08x", i)},
+			}}}
+			if mixed {
+				config.Condition.And[1] = &sd_config.ConditionConfig{KeyBytes: "1:2", Operator: ">", Value: "250"}
+				config.Condition = &sd_config.ConditionConfig{Or: config.Condition.And}
+			}
+		}
+		config.Upstream = "ups"
+		route, err := NewRoute(i, config)
+		assert.Nil(t, err)
+		routes = append(routes, route)
+	}
+
+	route, err := NewRoute(n, sd_config.RouteConfig{Condition: &sd_config.ConditionConfig{Length: "64:"}, Upstream: "ups"})
+	assert.Nil(t, err)
+	return append(routes, route)
+}
+
+// Compiled route table should keep first-match semantics
+func TestRouteTable_Match(t *testing.T) {
+	routes := testRoutes(t, 300, true)
+	table := newRouteTable(routes)
+	assert.Equal(t, 2, len(table.indexes))
+
+	rnd := rand.New(rand.NewSource(1))
+	pkt := &Packet{}
+	for i := 0; i < 100000; i++ {
+		data := make([]byte, rnd.Intn(80))
+		rnd.Read(data)
+		if len(data) > 12 && rnd.Intn(2) == 0 {
+			v := rnd.Intn(300)
+			data[4], data[5] = byte(v>>8), byte(v)
+			data[8], data[9], data[10], data[11] = 0, 0, byte(v>>8), byte(v)
+			if rnd.Intn(2) == 0 {
+				data[4], data[5] = 0, byte(v%16)
+			}
+		}
+		pkt.Data = data
+		assert.Equal(t, linearMatch(routes, pkt), table.Match(pkt))
+	}
+
+	pkt.Data = make([]byte, 64)
+	pkt.Data[5] = 0x02
+	allocs := testing.AllocsPerRun(100, func() { table.Match(pkt) })
+	assert.Equal(t, float64(0), allocs)
+}
+
+// Cost per packet should be near-constant as routes grow
+func BenchmarkRouteTable_Match(b *testing.B) {
+	for _, n := range []int{10, 100, 1000} {
+		routes := testRoutes(b, n, false)
+		table := newRouteTable(routes)
+
+		// matches the last route
+		pkt := &Packet{Data: make([]byte, 64)}
+		pkt.Data[4] = 0xff
+		b.Run(fmt.Sprintf("compiled-%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				table.Match(pkt)
+			}
+		})
+		b.Run(fmt.Sprintf("linear-%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				linearMatch(routes, pkt)
+			}
+		})
+	}
+}
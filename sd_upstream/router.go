@@ -0,0 +1,187 @@
+package sd_upstream
+
+import (
+	"fmt"
+	"github.com/near-notfaraway/stevedore/sd_config"
+	"sync/atomic"
+)
+
+//------------------------------------------------------------------------------
+// Router: Used to choose route for packets recv by a listener
+//------------------------------------------------------------------------------
+
+type Router struct {
+	dnsMalformed uint64               // packets which are not valid dns queries in dns mode, accessed atomically
+	dns          *sd_config.DNSConfig // dns mode, packets are not parsed as dns queries if nil
+	dnsDrop      *Route               // route of malformed queries if they are dropped
+	listener     string               // name of listener
+	defaultRoute *Route               // use it when no route match
+	routes       []*Route             // manage routes which decide how to choose upstream
+	routeTable   *routeTable          // compiled from routes, used to find matched route
+	upstreams    map[string]Upstream  // upstreams of manager, shared by all routers
+}
+
+// Check default action and routes without creating them, upstreamNames is set of existing upstreams
+// Returns ErrorList contains all invalid fields
+func checkRoutes(defaultAction, defaultUpstream, defaultReply string, routes []sd_config.RouteConfig,
+	upstreamNames map[string]struct{}) error {
+	var errs sd_config.ErrorList
+	defaultRoute, err := newDefaultRoute(defaultAction, defaultUpstream, defaultReply)
+	errs.Add("", err)
+	if _, ok := upstreamNames[defaultUpstream]; !ok && defaultUpstream != "" &&
+		defaultRoute != nil && defaultRoute.action == RouteActionForward {
+		errs = append(errs, sd_config.NewFieldError("DefaultUpstream", "unknown upstream %q", defaultUpstream))
+	}
+
+	for id, routeConfig := range routes {
+		path := fmt.Sprintf("Routes[%d]", id)
+		_, err := NewRoute(id, routeConfig)
+		errs.Add(path, err)
+		isForward := routeConfig.Action == "" || routeConfig.Action == RouteActionForward
+		if _, ok := upstreamNames[routeConfig.Upstream]; !ok && routeConfig.Upstream != "" && isForward {
+			errs = append(errs, sd_config.NewFieldError(path+".Upstream", "unknown upstream %q", routeConfig.Upstream))
+		}
+		for i, arm := range routeConfig.Split {
+			if _, ok := upstreamNames[arm.Upstream]; !ok && arm.Upstream != "" && isForward {
+				errs = append(errs, sd_config.NewFieldError(fmt.Sprintf("%s.Split[%d].Upstream", path, i),
+					"unknown upstream %q", arm.Upstream))
+			}
+		}
+		if mirror := routeConfig.Mirror; mirror != nil && mirror.Upstream != "" {
+			if _, ok := upstreamNames[mirror.Upstream]; !ok {
+				errs = append(errs, sd_config.NewFieldError(path+".Mirror.Upstream", "unknown upstream %q", mirror.Upstream))
+			}
+		}
+	}
+	return errs.Err()
+}
+
+// Create router of listener, routes can only target upstreams given
+func newRouter(config *sd_config.ListenerConfig, upstreams map[string]Upstream) (*Router, error) {
+	r := &Router{
+		listener:  config.Name,
+		routes:    make([]*Route, 0, len(config.Routes)),
+		upstreams: upstreams,
+	}
+
+	// init default route, packets are dropped if default upstream is not set
+	var err error
+	if r.defaultRoute, err = newDefaultRoute(config.DefaultAction, config.DefaultUpstream, config.DefaultReply); err != nil {
+		return nil, err
+	}
+	if _, ok := upstreams[config.DefaultUpstream]; !ok && config.DefaultUpstream != "" &&
+		r.defaultRoute.action == RouteActionForward {
+		return nil, sd_config.NewFieldError("DefaultUpstream", "unknown upstream %q", config.DefaultUpstream)
+	}
+
+	// init dns mode
+	if err = checkDNSConfig(config.DNS); err != nil {
+		return nil, sd_config.WithPath("DNS", err)
+	}
+	if r.dns = config.DNS; r.dns != nil && r.dns.Malformed != DNSMalformedForward {
+		r.dnsDrop, _ = newDefaultRoute(RouteActionDrop, "", "")
+	}
+
+	// init routes
+	for id, routeConfig := range config.Routes {
+		path := fmt.Sprintf("Routes[%d]", id)
+		route, err := NewRoute(id, routeConfig)
+		if err != nil {
+			return nil, sd_config.WithPath(path, err)
+		}
+		if _, ok := upstreams[route.upstream]; !ok && route.action == RouteActionForward && route.split == nil {
+			return nil, sd_config.NewFieldError(path+".Upstream", "unknown upstream %q", route.upstream)
+		}
+		if route.split != nil {
+			for i, arm := range route.split.arms {
+				if _, ok := upstreams[arm.upstream]; !ok {
+					return nil, sd_config.NewFieldError(fmt.Sprintf("%s.Split[%d].Upstream", path, i),
+						"unknown upstream %q", arm.upstream)
+				}
+			}
+		}
+		if route.mirror != nil {
+			if _, ok := upstreams[route.mirror.upstream]; !ok {
+				return nil, sd_config.NewFieldError(path+".Mirror.Upstream", "unknown upstream %q", route.mirror.upstream)
+			}
+		}
+		r.routes = append(r.routes, route)
+	}
+	r.routeTable = newRouteTable(r.routes)
+
+	return r, nil
+}
+
+// Return the first matched route, or default route if no route matches
+// In dns mode, malformed query is counted, and matches a drop route unless it should be forwarded
+func (r *Router) Match(pkt *Packet) *Route {
+	if r.dns != nil {
+		if _, ok := pkt.dnsQuery(); !ok {
+			atomic.AddUint64(&r.dnsMalformed, 1)
+			if r.dnsDrop != nil {
+				return r.dnsDrop
+			}
+		}
+	}
+
+	if route := r.routeTable.Match(pkt); route != nil {
+		return route
+	}
+	return r.defaultRoute
+}
+
+// Return target upstream of route for packet, returns nil if route is not forward, upstream not exists
+// or split chooses no upstream
+// Upstream of split is chosen by packet, and counted into the chosen arm
+func (r *Router) GetUpstream(route *Route, pkt *Packet) Upstream {
+	if route.action != RouteActionForward {
+		return nil
+	}
+	if route.split != nil {
+		return r.upstreams[route.split.choose(pkt)]
+	}
+	return r.upstreams[route.upstream]
+}
+
+// Return route by id, returns nil if not exists
+func (r *Router) GetRoute(id int) *Route {
+	if id < 0 || id >= len(r.routes) {
+		return nil
+	}
+	return r.routes[id]
+}
+
+// Return shadow upstream of route, returns nil if route has no mirror
+func (r *Router) GetMirrorUpstream(route *Route) Upstream {
+	if route.mirror == nil {
+		return nil
+	}
+	return r.upstreams[route.mirror.upstream]
+}
+
+// Return upstream of matched route, returns nil if packet should not be forwarded
+func (r *Router) RouteUpstream(pkt *Packet) Upstream {
+	return r.GetUpstream(r.Match(pkt), pkt)
+}
+
+// Return snapshot of routes
+func (r *Router) Status() *RouterStatus {
+	defaultStatus := r.defaultRoute.Status()
+	status := &RouterStatus{
+		Listener:        r.listener,
+		DefaultAction:   defaultStatus.Action,
+		DefaultUpstream: defaultStatus.Upstream,
+		DefaultReply:    defaultStatus.Reply,
+		Routes:          make([]*RouteStatus, 0, len(r.routes)),
+	}
+	if r.dns != nil {
+		status.DNS = &DNSStatus{Malformed: DNSMalformedForward, MalformedPackets: atomic.LoadUint64(&r.dnsMalformed)}
+		if r.dnsDrop != nil {
+			status.DNS.Malformed = DNSMalformedDrop
+		}
+	}
+	for _, route := range r.routes {
+		status.Routes = append(status.Routes, route.Status())
+	}
+	return status
+}
@@ -0,0 +1,135 @@
+package sd_upstream
+
+import (
+	"fmt"
+	"github.com/near-notfaraway/stevedore/sd_config"
+	"github.com/near-notfaraway/stevedore/sd_util"
+	"sync/atomic"
+)
+
+//------------------------------------------------------------------------------
+// Split: Used to split packets of a route between upstreams by weights
+//------------------------------------------------------------------------------
+
+// Arm is chosen by hash of split key if it is set, otherwise by hash of client address,
+// so that a client sticks to the same arm until weights changed
+// Max weight of an arm, so that sum of weights fits in uint32
+const maxSplitWeight = 1000000
+
+type routeSplit struct {
+	arms  []*splitArm  // arms in config order
+	key   *keySpec     // used to extract key bytes, nil means by client address
+	table atomic.Value // *splitTable: cumulative weights, swapped when weights changed
+}
+
+type splitArm struct {
+	packets  uint64 // packets chosen this arm, accessed atomically
+	bytes    uint64 // bytes chosen this arm, accessed atomically
+	upstream string // target upstream
+}
+
+type splitTable struct {
+	weights []uint32 // weight of each arm
+	bounds  []uint32 // cumulative weights, arm i is chosen if hash % total < bounds[i]
+	total   uint32   // sum of weights
+}
+
+// Create split from config, returns ErrorList contains all invalid fields
+func newRouteSplit(configs []*sd_config.SplitConfig, splitKey string) (*routeSplit, error) {
+	var errs sd_config.ErrorList
+	s := &routeSplit{arms: make([]*splitArm, 0, len(configs))}
+	if splitKey != "" {
+		var err error
+		if s.key, err = parseKeySpec(splitKey); err != nil {
+			errs.Add("SplitKey", err)
+		}
+	}
+
+	names := make(map[string]struct{})
+	weights := make([]int, 0, len(configs))
+	for i, config := range configs {
+		path := fmt.Sprintf("Split[%d]", i)
+		if config.Upstream == "" {
+			errs = append(errs, sd_config.NewFieldError(path+".Upstream", "should not be empty"))
+		} else if _, dup := names[config.Upstream]; dup {
+			errs = append(errs, sd_config.NewFieldError(path+".Upstream", "duplicated upstream %q", config.Upstream))
+		}
+		if config.Weight < 0 || config.Weight > maxSplitWeight {
+			errs = append(errs, sd_config.NewFieldError(path+".Weight", "should be in range 0 to %d", maxSplitWeight))
+		}
+		names[config.Upstream] = struct{}{}
+		s.arms = append(s.arms, &splitArm{upstream: config.Upstream})
+		weights = append(weights, config.Weight)
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	if err := s.setWeights(weights); err != nil {
+		return nil, sd_config.NewFieldError("Split", "%v", err)
+	}
+	return s, nil
+}
+
+// Swap weights of arms, returns err if any weight is negative or all weights are 0
+func (s *routeSplit) setWeights(weights []int) error {
+	t := &splitTable{weights: make([]uint32, len(weights)), bounds: make([]uint32, len(weights))}
+	for i, weight := range weights {
+		if weight < 0 || weight > maxSplitWeight {
+			return fmt.Errorf("weight %d of %s should be in range 0 to %d", weight, s.arms[i].upstream, maxSplitWeight)
+		}
+		t.total += uint32(weight)
+		t.weights[i] = uint32(weight)
+		t.bounds[i] = t.total
+	}
+	if t.total == 0 {
+		return fmt.Errorf("sum of weights should be greater than 0")
+	}
+	s.table.Store(t)
+	return nil
+}
+
+// Return upstream of arm chosen for packet, and count packet
+// Returns empty if split key is set but packet is too short to extract it, and packet is dropped,
+// so that packets of a client never move between arms by their lengths
+func (s *routeSplit) choose(pkt *Packet) string {
+	var hash uint32
+	if s.key != nil {
+		key, ok := s.key.Extract(pkt.Data, pkt.keyBuf[:])
+		if !ok {
+			return ""
+		}
+		hash = sd_util.FNVHash(key)
+	} else {
+		var addr [18]byte
+		ip, port, _ := pkt.srcAddr()
+		copy(addr[:], ip[:])
+		addr[16], addr[17] = byte(port>>8), byte(port)
+		hash = sd_util.FNVHash(addr[:])
+	}
+
+	t := s.table.Load().(*splitTable)
+	v := hash % t.total
+	for i, bound := range t.bounds {
+		if v < bound {
+			arm := s.arms[i]
+			atomic.AddUint64(&arm.packets, 1)
+			atomic.AddUint64(&arm.bytes, uint64(len(pkt.Data)))
+			return arm.upstream
+		}
+	}
+	return ""
+}
+
+func (s *routeSplit) status() []*SplitArmStatus {
+	t := s.table.Load().(*splitTable)
+	status := make([]*SplitArmStatus, 0, len(s.arms))
+	for i, arm := range s.arms {
+		status = append(status, &SplitArmStatus{
+			Upstream: arm.upstream,
+			Weight:   int(t.weights[i]),
+			Packets:  atomic.LoadUint64(&arm.packets),
+			Bytes:    atomic.LoadUint64(&arm.bytes),
+		})
+	}
+	return status
+}
@@ -0,0 +1,62 @@
+package sd_upstream
+
+//------------------------------------------------------------------------------
+// Status: snapshot of live state, used to expose by admin api
+//------------------------------------------------------------------------------
+
+type PeerStatus struct {
+	Addr          string // humane addr
+	State         string // alive, temp, dead or draining
+	Weight        int    // selected ratio
+	Backup        bool   // if peer is backup
+	DrainDeadline string `json:",omitempty"` // deadline of draining peer
+}
+
+type UpstreamStatus struct {
+	Name         string         // unique name
+	Type         string         // rr or chash
+	KeyBytes     string         `json:",omitempty"` // key bytes of chash upstream
+	KeyExtractor string         `json:",omitempty"` // key extractor of chash upstream
+	Peers        []*PeerStatus  // all peers
+	RRList       []string       `json:",omitempty"` // peer addrs in round robin list of rr upstream
+	TableShare   map[string]int `json:",omitempty"` // slots owned by each peer in lookup table of chash upstream
+}
+
+type RouteStatus struct {
+	Id             int               // unique id
+	Condition      string            `json:",omitempty"` // readable expression of condition
+	Action         string            // forward, drop or reject
+	Upstream       string            `json:",omitempty"` // target upstream of forward action
+	Reply          string            `json:",omitempty"` // reply template of reject action
+	Split          []*SplitArmStatus `json:",omitempty"` // weighted upstreams of split
+	SplitKey       string            `json:",omitempty"` // key bytes used to choose upstream of split
+	MirrorUpstream string            `json:",omitempty"` // shadow upstream which packets are copied to
+	MirrorPercent  int               `json:",omitempty"` // percent of sessions whose packets are copied
+	Sticky         bool              `json:",omitempty"` // if session keeps upstream and peer of its first packet
+}
+
+type SplitArmStatus struct {
+	Upstream string // target upstream
+	Weight   int    // ratio of clients choosing this upstream
+	Packets  uint64 // packets forwarded to this upstream
+	Bytes    uint64 // bytes forwarded to this upstream
+}
+
+type RouterStatus struct {
+	Listener        string         // name of listener
+	DefaultAction   string         // action taken when no route match
+	DefaultUpstream string         `json:",omitempty"` // use it when no route match
+	DefaultReply    string         `json:",omitempty"` // reply template when no route match
+	DNS             *DNSStatus     `json:",omitempty"` // dns mode of listener
+	Routes          []*RouteStatus // routes in match order
+}
+
+type DNSStatus struct {
+	Malformed        string // action on malformed queries, drop or forward
+	MalformedPackets uint64 // packets which are not valid dns queries
+}
+
+type ManagerStatus struct {
+	Upstreams []*UpstreamStatus // upstreams in config order
+	Routers   []*RouterStatus   // routers in listener order
+}
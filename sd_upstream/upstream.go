@@ -1,12 +1,14 @@
 package sd_upstream
 
 import (
+	"context"
+	"encoding/binary"
 	"fmt"
 	"github.com/near-notfaraway/stevedore/sd_config"
 	"github.com/sirupsen/logrus"
-	"strconv"
-	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const (
@@ -15,11 +17,19 @@ const (
 )
 
 type Upstream interface {
-	SelectPeer(data []byte) *Peer
+	GetName() string
+	GetPeer(addr string) *Peer
+	SelectPeer(data []byte, client uint32, last *Peer) *Peer
 	ResetPeers()
+	AddPeer(config *sd_config.PeerConfig) error
+	RemovePeer(addr string) error
+	SetPeerWeight(addr string, weight int) error
+	SetPeerDrain(addr string, drain bool, timeout time.Duration) error
+	Status() *UpstreamStatus
+	Close()
 }
 
-func NewUpstream(config *sd_config.UpstreamConfig) Upstream {
+func NewUpstream(config *sd_config.UpstreamConfig) (Upstream, error) {
 	switch config.Type {
 	case UpstreamTypeRR:
 		return NewRRUpstream(config)
@@ -28,26 +38,93 @@ func NewUpstream(config *sd_config.UpstreamConfig) Upstream {
 		return NewCHashUpstream(config)
 
 	default:
-		panic(fmt.Errorf("invalid upstream type: %s", config.Type))
+		return nil, sd_config.NewFieldError("Type", "invalid upstream type %q", config.Type)
 	}
 }
 
+// Check config of upstream without creating it
+// Returns ErrorList contains all invalid fields
+func CheckUpstreamConfig(config *sd_config.UpstreamConfig) error {
+	var errs sd_config.ErrorList
+	if config.Name == "" {
+		errs = append(errs, sd_config.NewFieldError("Name", "should not be empty"))
+	}
+
+	switch config.Type {
+	case UpstreamTypeRR:
+	case UpstreamTypeCHash:
+		if _, _, err := parseUpstreamKey(config); err != nil {
+			errs.Add("", err)
+		}
+	default:
+		errs = append(errs, sd_config.NewFieldError("Type", "invalid upstream type %q", config.Type))
+	}
+
+	_, backup, err := InitUpstreamPeers(config)
+	errs.Add("", err)
+	if err == nil && backup == nil && config.Type == UpstreamTypeRR {
+		errs = append(errs, sd_config.NewFieldError("Peers", "no backup peer in rr upstream"))
+	}
+
+	if config.DrainTimeoutSec < 0 {
+		errs = append(errs, sd_config.NewFieldError("DrainTimeoutSec", "should not be negative"))
+	}
+
+	errs.Add("HealthChecker", checkHealthCheckerConfig(config.HealthChecker))
+	return errs.Err()
+}
+
+// Check config of peer
+// Returns ErrorList contains all invalid fields
+func checkPeerConfig(config *sd_config.PeerConfig) error {
+	var errs sd_config.ErrorList
+	if config.Port < 1 || config.Port > 65535 {
+		errs = append(errs, sd_config.NewFieldError("Port", "invalid port %d", config.Port))
+	}
+	if config.Weight < 1 {
+		errs = append(errs, sd_config.NewFieldError("Weight", "should be greater than 0"))
+	}
+	if config.Drain && config.Backup {
+		errs = append(errs, sd_config.NewFieldError("Drain", "backup peer can not be drain"))
+	}
+	return errs.Err()
+}
+
+func peerConfigAddr(config *sd_config.PeerConfig) string {
+	return fmt.Sprintf("%s:%d", config.IP, config.Port)
+}
+
 // Init Peers in Upstream, avoid duplication peers and extract backup peer
-// Return peer slice and backup peer
-func InitUpstreamPeers(config *sd_config.UpstreamConfig) (peers []*Peer, backup *Peer) {
+// Return peer slice, backup peer and ErrorList contains all invalid peers
+func InitUpstreamPeers(config *sd_config.UpstreamConfig) (peers []*Peer, backup *Peer, err error) {
+	var errs sd_config.ErrorList
+	if len(config.Peers) == 0 {
+		return nil, nil, sd_config.NewFieldError("Peers", "should not be empty")
+	}
+
 	peers = make([]*Peer, 0, len(config.Peers))
 	uniqueMap := make(map[string]struct{})
-
 	for id, peerConfig := range config.Peers {
+		path := fmt.Sprintf("Peers[%d]", id)
+		if err := checkPeerConfig(peerConfig); err != nil {
+			errs.Add(path, err)
+			continue
+		}
+
 		// check upstream addr duplication
-		peerAddr := fmt.Sprintf("%s:%d", peerConfig.IP, peerConfig.Port)
+		peerAddr := peerConfigAddr(peerConfig)
 		if _, dup := uniqueMap[peerAddr]; dup {
-			logrus.Panicf("duplicated peer %s in upstream %s", peerAddr, config.Name)
+			errs = append(errs, sd_config.NewFieldError(path, "duplicated peer %s", peerAddr))
+			continue
 		}
 		uniqueMap[peerAddr] = struct{}{}
 
 		// create peer
-		peer := NewPeer(id, peerAddr, peerConfig)
+		peer, err := NewPeer(id, peerAddr, peerConfig)
+		if err != nil {
+			errs.Add(path+".IP", err)
+			continue
+		}
 		peers = append(peers, peer)
 
 		// set backup
@@ -55,11 +132,253 @@ func InitUpstreamPeers(config *sd_config.UpstreamConfig) (peers []*Peer, backup
 			if backup == nil {
 				backup = peer
 			} else {
-				logrus.Panicf("two peer %s and %s is backup", backup.addr, peer.addr)
+				errs = append(errs, sd_config.NewFieldError(path+".Backup",
+					"two peer %s and %s is backup", backup.addr, peer.addr))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, nil, errs
+	}
+	return peers, backup, nil
+}
+
+// Return status of peers in order
+func peersStatus(peers []*Peer) []*PeerStatus {
+	status := make([]*PeerStatus, 0, len(peers))
+	for _, peer := range peers {
+		status = append(status, peer.Status())
+	}
+	return status
+}
+
+// Start health check for upstream, reset peers of upstream when a peer state changed
+// Return a function used to stop health check
+func startHealthCheck(checker *HealthChecker, ups Upstream) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	changedCh := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-changedCh:
+				ups.ResetPeers()
 			}
 		}
+	}()
+	go checker.Check(ctx, changedCh)
+
+	return cancel
+}
+
+//------------------------------------------------------------------------------
+// PeerSet: Used to manage peers of upstream, which can be changed at runtime
+// - all methods should be called with mu held
+//------------------------------------------------------------------------------
+
+type peerSet struct {
+	mu            sync.Mutex     // lock for peers changing
+	peers         []*Peer        // all peers
+	backup        *Peer          // backup peer
+	needBackup    bool           // if backup can not be removed
+	nextId        int            // id of next added peer
+	drainTimeout  time.Duration  // default deadline of draining peer
+	draining      atomic.Value   // map[string]*Peer: draining peers by addr, read without lock
+	healthChecker *HealthChecker // health checker
+}
+
+func newPeerSet(config *sd_config.UpstreamConfig, needBackup bool) (*peerSet, error) {
+	peers, backup, err := InitUpstreamPeers(config)
+	if err != nil {
+		return nil, err
+	}
+	if needBackup && backup == nil {
+		return nil, sd_config.NewFieldError("Peers", "no backup peer in %s upstream", config.Type)
+	}
+
+	healthChecker, err := NewHealthChecker(config.HealthChecker, peers)
+	if err != nil {
+		return nil, sd_config.WithPath("HealthChecker", err)
+	}
+
+	s := &peerSet{
+		peers:         peers,
+		backup:        backup,
+		needBackup:    needBackup,
+		nextId:        len(peers),
+		drainTimeout:  time.Second * time.Duration(config.DrainTimeoutSec),
+		healthChecker: healthChecker,
+	}
+
+	// drain peers from config
+	for i, peerConfig := range config.Peers {
+		if peerConfig.Drain {
+			peers[i].Drain(s.drainDeadline(0))
+		}
+	}
+	s.refreshDraining()
+
+	return s, nil
+}
+
+// Return deadline of draining begin from now, use default timeout if timeout is not positive
+func (s *peerSet) drainDeadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		timeout = s.drainTimeout
+	}
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+// Rebuild draining peers map after peers or drain state changed
+func (s *peerSet) refreshDraining() {
+	draining := make(map[string]*Peer)
+	for _, peer := range s.peers {
+		if peer.IsDraining() {
+			draining[peer.addr] = peer
+		}
+	}
+	s.draining.Store(draining)
+}
+
+// Return the draining peer which has the same addr with last peer of flow
+// Returns nil if no such peer or its drain deadline passed, should select a new peer
+// Compare by addr so that flows can keep on draining peer after reload
+func (s *peerSet) keepDraining(last *Peer) *Peer {
+	if last == nil {
+		return nil
+	}
+
+	draining := s.draining.Load().(map[string]*Peer)
+	if len(draining) == 0 {
+		return nil
+	}
+	if peer, ok := draining[last.addr]; ok && peer.inDrain(time.Now()) {
+		return peer
+	}
+	return nil
+}
+
+// Return healthy peers, return backup peer if all peers dead
+// Returns empty slice if all peers dead and no backup
+func (s *peerSet) healthyPeers() []*Peer {
+	healthyPeers := make([]*Peer, 0, len(s.peers))
+	for _, peer := range s.peers {
+		if peer.isAlive() {
+			healthyPeers = append(healthyPeers, peer)
+		}
+	}
+
+	// set backup
+	if len(healthyPeers) == 0 && s.backup != nil && !s.backup.IsDraining() {
+		logrus.Error("use backup peer because of all peers dead")
+		s.backup.SetState(PeerTemp)
+		healthyPeers = append(healthyPeers, s.backup)
+	}
+	return healthyPeers
+}
+
+func (s *peerSet) find(addr string) (int, *Peer) {
+	for i, peer := range s.peers {
+		if peer.addr == addr {
+			return i, peer
+		}
+	}
+	return -1, nil
+}
+
+// Add peer and start health check for it
+func (s *peerSet) add(config *sd_config.PeerConfig) error {
+	if err := checkPeerConfig(config); err != nil {
+		return err
+	}
+
+	addr := peerConfigAddr(config)
+	if _, peer := s.find(addr); peer != nil {
+		return fmt.Errorf("duplicated peer %s", addr)
+	}
+	if config.Backup && s.backup != nil {
+		return fmt.Errorf("two peer %s and %s is backup", s.backup.addr, addr)
+	}
+
+	peer, err := NewPeer(s.nextId, addr, config)
+	if err != nil {
+		return err
+	}
+	if err := s.healthChecker.AddPeer(peer); err != nil {
+		return err
+	}
+
+	s.nextId += 1
+	s.peers = append(s.peers, peer)
+	if config.Backup {
+		s.backup = peer
+	}
+	if config.Drain {
+		peer.Drain(s.drainDeadline(0))
+		s.refreshDraining()
+	}
+	return nil
+}
+
+// Remove peer and stop health check for it
+func (s *peerSet) remove(addr string) error {
+	i, peer := s.find(addr)
+	if peer == nil {
+		return fmt.Errorf("peer %s not found", addr)
+	}
+	if peer == s.backup && s.needBackup {
+		return fmt.Errorf("backup peer %s can not be removed", addr)
+	}
+	if len(s.peers) == 1 {
+		return fmt.Errorf("last peer %s can not be removed", addr)
+	}
+
+	// set removed peer dead, so that sessions sticking to it choose another peer
+	s.healthChecker.RemovePeer(peer)
+	peer.SetState(PeerDead)
+	s.peers = append(s.peers[:i:i], s.peers[i+1:]...)
+	if peer == s.backup {
+		s.backup = nil
+	}
+	s.refreshDraining()
+	return nil
+}
+
+// Set peer draining or not, the peer is set alive and rechecked by health checker if not drain
+func (s *peerSet) setDrain(addr string, drain bool, timeout time.Duration) error {
+	_, peer := s.find(addr)
+	if peer == nil {
+		return fmt.Errorf("peer %s not found", addr)
+	}
+
+	if drain {
+		if peer == s.backup {
+			return fmt.Errorf("backup peer %s can not be drain", addr)
+		}
+		peer.Drain(s.drainDeadline(timeout))
+	} else {
+		peer.undrain()
+	}
+	s.refreshDraining()
+	return nil
+}
+
+func (s *peerSet) setWeight(addr string, weight int) error {
+	if weight < 1 {
+		return fmt.Errorf("weight should be greater than 0")
 	}
-	return
+
+	_, peer := s.find(addr)
+	if peer == nil {
+		return fmt.Errorf("peer %s not found", addr)
+	}
+	peer.SetWeight(weight)
+	return nil
 }
 
 //------------------------------------------------------------------------------
@@ -69,90 +388,156 @@ func InitUpstreamPeers(config *sd_config.UpstreamConfig) (peers []*Peer, backup
 const MaxUint64 = 18446744073709551615
 
 type RRUpstream struct {
-	name          string         // unique name
-	peers         []*Peer        // all peers
-	healthyPeers  []*Peer        // healthy peers slice
-	backup        *Peer          // backup peer
-	healthChecker *HealthChecker // health checker
-	rrList        []*Peer        // round robin peers list
-	cur           uint64         // mod it for get peer
+	*peerSet
+	name   string       // unique name
+	rrList atomic.Value // []*Peer: round robin peers list
+	cur    uint64       // mod it for get peer
+	cancel func()       // stop health check
 }
 
-func NewRRUpstream(config *sd_config.UpstreamConfig) *RRUpstream {
+func NewRRUpstream(config *sd_config.UpstreamConfig) (*RRUpstream, error) {
+	// init peers, backup is necessary because rr list can not be empty
+	peers, err := newPeerSet(config, true)
+	if err != nil {
+		return nil, err
+	}
+
 	// init upstream
-	peers, backup := InitUpstreamPeers(config)
 	ups := &RRUpstream{
-		name:          config.Name,
-		peers:         peers,
-		healthyPeers:  make([]*Peer, len(peers)),
-		backup:        backup,
-		healthChecker: NewHealthChecker(config.HealthChecker, peers),
-		cur:           MaxUint64,
+		peerSet: peers,
+		name:    config.Name,
+		cur:     MaxUint64,
 	}
 
 	// init rrList and start health check
-	ups.rrList = ups.buildRRList(peers)
-	changedCh := make(chan struct{})
-	go func() {
-		for {
-			select {
-			case <-changedCh:
-				ups.ResetPeers()
-			}
-		}
-	}()
-	go ups.healthChecker.Check(changedCh)
+	ups.rrList.Store(ups.buildRRList(peers.healthyPeers()))
+	ups.cancel = startHealthCheck(ups.healthChecker, ups)
 
-	return ups
+	return ups, nil
 }
 
-func (u *RRUpstream) SelectPeer(data []byte) *Peer {
+func (u *RRUpstream) GetName() string {
+	return u.name
+}
+
+// Return peer by addr, returns nil if not exists
+func (u *RRUpstream) GetPeer(addr string) *Peer {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	_, peer := u.find(addr)
+	return peer
+}
+
+func (u *RRUpstream) SelectPeer(data []byte, client uint32, last *Peer) *Peer {
+	// keep existing flow on draining peer
+	if peer := u.keepDraining(last); peer != nil {
+		return peer
+	}
+
+	// all peers are draining
+	rrList := u.rrList.Load().([]*Peer)
+	if len(rrList) == 0 {
+		return nil
+	}
+
 	cur := atomic.AddUint64(&u.cur, 1)
 	if cur == MaxUint64 {
 		// avoid max uint64 and 0, mod someone is 0
 		cur = atomic.AddUint64(&u.cur, 1)
 	}
-	return u.rrList[cur%uint64(len(u.rrList))]
+	return rrList[cur%uint64(len(rrList))]
 }
 
 func (u *RRUpstream) ResetPeers() {
-	// get healthy peers
-	num := 0
-	for _, peer := range u.peers {
-		if peer.isAlive() {
-			u.healthyPeers[num] = peer
-			num += 1
-		}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.resetPeers()
+}
+
+func (u *RRUpstream) resetPeers() {
+	// update rr list
+	logrus.Debugf("rebuild rr list because peers changed")
+	u.rrList.Store(u.buildRRList(u.healthyPeers()))
+}
+
+func (u *RRUpstream) AddPeer(config *sd_config.PeerConfig) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err := u.add(config); err != nil {
+		return err
 	}
+	u.resetPeers()
+	return nil
+}
 
-	// set backup
-	if num == 0 {
-		logrus.Error("use backup peer because of all peers dead")
-		u.backup.SetState(PeerTemp)
-		u.healthyPeers[num] = u.backup
-		num += 1
+func (u *RRUpstream) RemovePeer(addr string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err := u.remove(addr); err != nil {
+		return err
 	}
+	u.resetPeers()
+	return nil
+}
 
-	// update lookup table
-	logrus.Debugf("rehash because a peer state changed")
-	u.rrList = u.buildRRList(u.healthyPeers[:num])
+func (u *RRUpstream) SetPeerWeight(addr string, weight int) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err := u.setWeight(addr, weight); err != nil {
+		return err
+	}
+	u.resetPeers()
+	return nil
+}
+
+func (u *RRUpstream) SetPeerDrain(addr string, drain bool, timeout time.Duration) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err := u.setDrain(addr, drain, timeout); err != nil {
+		return err
+	}
+	u.resetPeers()
+	return nil
+}
+
+func (u *RRUpstream) Status() *UpstreamStatus {
+	u.mu.Lock()
+	status := &UpstreamStatus{
+		Name:  u.name,
+		Type:  UpstreamTypeRR,
+		Peers: peersStatus(u.peers),
+	}
+	u.mu.Unlock()
+
+	rrList := u.rrList.Load().([]*Peer)
+	status.RRList = make([]string, 0, len(rrList))
+	for _, peer := range rrList {
+		status.RRList = append(status.RRList, peer.addr)
+	}
+	return status
+}
+
+func (u *RRUpstream) Close() {
+	u.cancel()
 }
 
 func (u *RRUpstream) buildRRList(peers []*Peer) []*Peer {
 	sumWeight := 0
 	maxWeight := 0
-	for _, peer := range peers {
-		if peer.weight > maxWeight {
-			maxWeight = peer.weight
+	weights := make([]int, len(peers))
+	for i, peer := range peers {
+		weights[i] = peer.getWeight()
+		if weights[i] > maxWeight {
+			maxWeight = weights[i]
 		}
-		sumWeight += peer.weight
+		sumWeight += weights[i]
 	}
 
 	idx := 0
 	rrList := make([]*Peer, sumWeight)
 	for i := 0; i < maxWeight; i++ {
-		for _, peer := range peers {
-			if peer.weight-i > 0 {
+		for j, peer := range peers {
+			if weights[j]-i > 0 {
 				rrList[idx] = peer
 				idx++
 			}
@@ -165,91 +550,253 @@ func (u *RRUpstream) buildRRList(peers []*Peer) []*Peer {
 //------------------------------------------------------------------------------
 // CHashUpstream: Used to select peer through consistent hash
 //------------------------------------------------------------------------------
+
 type CHashUpstream struct {
-	name          string          // unique name
-	peers         []*Peer         // all peers
-	healthyPeers  []*Peer         // healthy peers slice
-	backup        *Peer           // backup peer
-	cHash         *ConsistentHash // chash instant
-	keyStart      int             // start index used to extract key
-	keyEnd        int             // end index used to extract key
-	healthChecker *HealthChecker  // health checker
-}
-
-func NewCHashUpstream(config *sd_config.UpstreamConfig) *CHashUpstream {
-	// init key start and key end
-	keyIdx := strings.Split(config.KeyBytes, ":")
-	keyStart, err := strconv.Atoi(keyIdx[0])
+	*peerSet
+	name      string          // unique name
+	cHash     *ConsistentHash // chash instant
+	key       *keySpec        // used to extract key if key extractor is not set
+	extractor KeyExtractor    // used to extract key by protocol
+	cancel    func()          // stop health check
+
+	// keys of flows on draining peers, so that new flows of the same key keep on them until deadline
+	drainKeysMu sync.RWMutex
+	drainKeys   map[string]*Peer
+	pruneTimer  *time.Timer // prune keys when the earliest drain deadline passes, protected by mu
+	closed      bool        // timer is not armed after closed, protected by mu
+}
+
+// Max number of keys recorded on draining peers, keys of more flows are not recorded
+const maxDrainKeys = 1 << 16
+
+func NewCHashUpstream(config *sd_config.UpstreamConfig) (*CHashUpstream, error) {
+	// init key spec or key extractor
+	key, extractor, err := parseUpstreamKey(config)
 	if err != nil {
-		logrus.Panicf("key start %s is invalid in upstream %s", keyIdx[0], config.Name)
+		return nil, err
 	}
-	keyEnd, err := strconv.Atoi(keyIdx[1])
+
+	// init peers and chash
+	peers, err := newPeerSet(config, false)
 	if err != nil {
-		logrus.Panicf("key end %s is invalid in upstream %s", keyIdx[1], config.Name)
+		return nil, err
 	}
-	if keyStart >= keyEnd {
-		logrus.Panicf("key start %s >= key end %s in upstream %s", keyIdx[0], keyIdx[1], config.Name)
+	cHash, err := NewConsistentHash(peers.peers)
+	if err != nil {
+		peers.healthChecker.close()
+		return nil, sd_config.WithPath("Peers", err)
 	}
 
-	// init peers and chash, build upstream
-	peers, backup := InitUpstreamPeers(config)
-	cHash := NewConsistentHash(peers)
+	// build upstream
 	ups := &CHashUpstream{
-		name:          config.Name,
-		peers:         peers,
-		healthyPeers:  make([]*Peer, len(peers)),
-		backup:        backup,
-		cHash:         cHash,
-		keyStart:      keyStart,
-		keyEnd:        keyEnd,
-		healthChecker: NewHealthChecker(config.HealthChecker, peers),
+		peerSet:   peers,
+		name:      config.Name,
+		cHash:     cHash,
+		key:       key,
+		extractor: extractor,
+		drainKeys: make(map[string]*Peer),
 	}
 
-	// start health check
-	changedCh := make(chan struct{})
-	go func() {
-		for {
-			select {
-			case <-changedCh:
-				ups.ResetPeers()
-			}
-		}
-	}()
-	go ups.healthChecker.Check(changedCh)
+	// exclude draining peers and start health check
+	ups.resetPeers()
+	ups.cancel = startHealthCheck(ups.healthChecker, ups)
+
+	return ups, nil
+}
+
+func (u *CHashUpstream) GetName() string {
+	return u.name
+}
 
-	return ups
+// Return peer by addr, returns nil if not exists
+func (u *CHashUpstream) GetPeer(addr string) *Peer {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	_, peer := u.find(addr)
+	return peer
 }
 
-func (u *CHashUpstream) SelectPeer(data []byte) *Peer {
-	// data too short
-	if len(data) < u.keyEnd {
+// Select peer by key extracted from data, by hash of client address if key is not extracted
+func (u *CHashUpstream) SelectPeer(data []byte, client uint32, last *Peer) *Peer {
+	var key []byte
+	var ok bool
+	buf := keyBufPool.Get().(*[MaxExtractKeyLen]byte)
+	defer keyBufPool.Put(buf)
+	if u.extractor != nil {
+		key, ok = u.extractor.Extract(data, buf[:])
+	} else {
+		key, ok = u.key.Extract(data, buf[:])
+	}
+	if !ok {
+		binary.BigEndian.PutUint32(buf[:], client)
+		key = buf[:4]
+	}
+
+	// keep existing flow on draining peer, and record its key for new flows of the same key
+	if peer := u.keepDraining(last); peer != nil {
+		u.recordDrainKey(key, peer)
+		return peer
+	}
+
+	// new flow of key which is kept by draining peer, such as client rebinding
+	if peer := u.drainKeyPeer(key); peer != nil {
+		return peer
+	}
+	return u.cHash.SelectPeer(key)
+}
+
+// Record key of flow on draining peer, key is copied only if it is not recorded
+// Keys are not recorded if there are too many, so that peers draining without deadline do not grow them unbounded
+func (u *CHashUpstream) recordDrainKey(key []byte, peer *Peer) {
+	u.drainKeysMu.RLock()
+	recorded := u.drainKeys[string(key)] == peer
+	u.drainKeysMu.RUnlock()
+	if recorded {
+		return
+	}
+
+	u.drainKeysMu.Lock()
+	defer u.drainKeysMu.Unlock()
+	if _, ok := u.drainKeys[string(key)]; ok || len(u.drainKeys) < maxDrainKeys {
+		u.drainKeys[string(key)] = peer
+	}
+}
+
+// Return draining peer which keeps flows of key, nil if no such peer or its drain deadline passed
+func (u *CHashUpstream) drainKeyPeer(key []byte) *Peer {
+	if len(u.draining.Load().(map[string]*Peer)) == 0 {
 		return nil
 	}
 
-	return u.cHash.SelectPeer(data[u.keyStart:u.keyEnd])
+	u.drainKeysMu.RLock()
+	peer := u.drainKeys[string(key)]
+	u.drainKeysMu.RUnlock()
+	if peer != nil && peer.inDrain(time.Now()) {
+		return peer
+	}
+	return nil
+}
+
+// Forget keys of peers which are not draining any more
+func (u *CHashUpstream) pruneDrainKeys() {
+	now := time.Now()
+	u.drainKeysMu.Lock()
+	defer u.drainKeysMu.Unlock()
+	for key, peer := range u.drainKeys {
+		if !peer.inDrain(now) {
+			delete(u.drainKeys, key)
+		}
+	}
 }
 
 func (u *CHashUpstream) ResetPeers() {
-	// get healthy peers
-	num := 0
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.resetPeers()
+}
+
+// Arm timer to reset peers when the earliest drain deadline passes, so that keys of drained peers are pruned
+// Should be called with mu held
+func (u *CHashUpstream) schedulePrune() {
+	if u.pruneTimer != nil {
+		u.pruneTimer.Stop()
+		u.pruneTimer = nil
+	}
+	if u.closed {
+		return
+	}
+
+	var next time.Time
+	now := time.Now()
 	for _, peer := range u.peers {
-		if peer.isAlive() {
-			u.healthyPeers[num] = peer
-			num += 1
+		if deadline := peer.getDrainDeadline(); deadline.After(now) && (next.IsZero() || deadline.Before(next)) {
+			next = deadline
 		}
 	}
+	if !next.IsZero() {
+		u.pruneTimer = time.AfterFunc(next.Sub(now), u.ResetPeers)
+	}
+}
 
-	// set backup
-	if num == 0 {
-		logrus.Error("use backup peer because of all peers dead")
-		u.backup.SetState(PeerTemp)
-		u.healthyPeers[num] = u.backup
-		num += 1
+func (u *CHashUpstream) resetPeers() {
+	u.pruneDrainKeys()
+	u.schedulePrune()
+
+	// keep lookup table if all peers dead or draining and no backup
+	healthyPeers := u.healthyPeers()
+	if len(healthyPeers) == 0 {
+		logrus.Error("all peers unavailable and no backup peer, keep lookup table")
+		return
 	}
 
 	// update lookup table
-	logrus.Debugf("rehash because a peer state changed")
-	if err := u.cHash.UpdateLookupTable(u.healthyPeers[:num], false); err != nil {
+	logrus.Debugf("rehash because peers changed")
+	if err := u.cHash.UpdateLookupTable(healthyPeers, false); err != nil {
 		logrus.Errorf("rehash failed: %v", err)
 	}
 }
+
+func (u *CHashUpstream) AddPeer(config *sd_config.PeerConfig) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err := u.add(config); err != nil {
+		return err
+	}
+	u.resetPeers()
+	return nil
+}
+
+func (u *CHashUpstream) RemovePeer(addr string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err := u.remove(addr); err != nil {
+		return err
+	}
+	u.resetPeers()
+	return nil
+}
+
+func (u *CHashUpstream) SetPeerWeight(addr string, weight int) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err := u.setWeight(addr, weight); err != nil {
+		return err
+	}
+	u.resetPeers()
+	return nil
+}
+
+func (u *CHashUpstream) SetPeerDrain(addr string, drain bool, timeout time.Duration) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err := u.setDrain(addr, drain, timeout); err != nil {
+		return err
+	}
+	u.resetPeers()
+	return nil
+}
+
+func (u *CHashUpstream) Status() *UpstreamStatus {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	status := &UpstreamStatus{
+		Name:       u.name,
+		Type:       UpstreamTypeCHash,
+		Peers:      peersStatus(u.peers),
+		TableShare: u.cHash.TableShare(),
+	}
+	if u.extractor != nil {
+		status.KeyExtractor = u.extractor.String()
+	} else {
+		status.KeyBytes = u.key.String()
+	}
+	return status
+}
+
+func (u *CHashUpstream) Close() {
+	u.mu.Lock()
+	u.closed = true
+	u.schedulePrune()
+	u.mu.Unlock()
+	u.cancel()
+}
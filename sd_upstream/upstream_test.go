@@ -0,0 +1,251 @@
+package sd_upstream
+
+import (
+	"github.com/near-notfaraway/stevedore/sd_config"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func testRRUpstreamConfig() *sd_config.UpstreamConfig {
+	return &sd_config.UpstreamConfig{
+		Name:          "rr",
+		Type:          UpstreamTypeRR,
+		HealthChecker: testHealthCheckerConfig(),
+		Peers: []*sd_config.PeerConfig{
+			{IP: "127.0.0.1", Port: 2345, Weight: 1, Backup: true},
+			{IP: "127.0.0.1", Port: 2346, Weight: 1},
+		},
+	}
+}
+
+// Peers of rr upstream should be changed at runtime
+func TestRRUpstream_ChangePeers(t *testing.T) {
+	ups, err := NewRRUpstream(testRRUpstreamConfig())
+	assert.Nil(t, err)
+	defer ups.Close()
+
+	// add peer
+	err = ups.AddPeer(&sd_config.PeerConfig{IP: "127.0.0.1", Port: 2347, Weight: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(ups.Status().RRList))
+	err = ups.AddPeer(&sd_config.PeerConfig{IP: "127.0.0.1", Port: 2347, Weight: 2})
+	assert.NotNil(t, err)
+	err = ups.AddPeer(&sd_config.PeerConfig{IP: "127.0.0.1", Port: 2348, Weight: 1, Backup: true})
+	assert.NotNil(t, err)
+
+	// change weight
+	err = ups.SetPeerWeight("127.0.0.1:2347", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(ups.Status().RRList))
+	err = ups.SetPeerWeight("127.0.0.1:2347", 0)
+	assert.NotNil(t, err)
+
+	// remove peer, flows sticking to it should leave
+	_, removed := ups.find("127.0.0.1:2347")
+	err = ups.RemovePeer("127.0.0.1:2347")
+	assert.Nil(t, err)
+	assert.False(t, removed.IsAvailable())
+	assert.Equal(t, []string{"127.0.0.1:2345", "127.0.0.1:2346"}, ups.Status().RRList)
+	err = ups.RemovePeer("127.0.0.1:2345")
+	assert.NotNil(t, err)
+	err = ups.RemovePeer("127.0.0.1:2347")
+	assert.NotNil(t, err)
+}
+
+// Draining peer should get no new flows but keep existing flows until deadline
+func TestCHashUpstream_DrainPeer(t *testing.T) {
+	config := &sd_config.UpstreamConfig{
+		Name:          "chash",
+		Type:          UpstreamTypeCHash,
+		KeyBytes:      "0:4",
+		HealthChecker: testHealthCheckerConfig(),
+		Peers: []*sd_config.PeerConfig{
+			{IP: "127.0.0.1", Port: 2345, Weight: 1, Backup: true},
+			{IP: "127.0.0.1", Port: 2346, Weight: 1},
+			{IP: "127.0.0.1", Port: 2347, Weight: 1, Drain: true},
+		},
+	}
+	ups, err := NewCHashUpstream(config)
+	assert.Nil(t, err)
+	defer ups.Close()
+
+	// drained from config
+	_, drained := ups.find("127.0.0.1:2347")
+	for i := 0; i < 256; i++ {
+		assert.NotEqual(t, drained, ups.SelectPeer([]byte{byte(i), 1, 2, 3}, 0, nil))
+	}
+	assert.Equal(t, drained, ups.SelectPeer([]byte{0, 0, 0, 0}, 0, drained))
+
+	// drain at runtime
+	_, peer := ups.find("127.0.0.1:2346")
+	err = ups.SetPeerDrain(peer.addr, true, time.Hour)
+	assert.Nil(t, err)
+	for i := 0; i < 256; i++ {
+		assert.Equal(t, ups.backup, ups.SelectPeer([]byte{byte(i), 1, 2, 3}, 0, nil))
+	}
+	assert.Equal(t, peer, ups.SelectPeer([]byte{0, 1, 2, 3}, 0, peer))
+	assert.True(t, peer.IsAvailable())
+
+	// deadline passed
+	peer.Drain(time.Now().Add(-time.Second))
+	assert.Equal(t, ups.backup, ups.SelectPeer([]byte{0, 1, 2, 3}, 0, peer))
+	assert.False(t, peer.IsAvailable())
+
+	// undrain
+	err = ups.SetPeerDrain(peer.addr, false, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "alive", peer.Status().State)
+	err = ups.SetPeerDrain(ups.backup.addr, true, 0)
+	assert.NotNil(t, err)
+}
+
+// Draining peer which fails health checks should be dead, and its flows leave it
+func TestCHashUpstream_DrainPeerDead(t *testing.T) {
+	ups, err := NewCHashUpstream(&sd_config.UpstreamConfig{
+		Name:          "chash",
+		Type:          UpstreamTypeCHash,
+		KeyBytes:      "0:4",
+		HealthChecker: testHealthCheckerConfig(),
+		Peers: []*sd_config.PeerConfig{
+			{IP: "127.0.0.1", Port: 2345, Weight: 1, Backup: true},
+			{IP: "127.0.0.1", Port: 2346, Weight: 1},
+			{IP: "127.0.0.1", Port: 2347, Weight: 1},
+		},
+	})
+	assert.Nil(t, err)
+	defer ups.Close()
+
+	_, peer := ups.find("127.0.0.1:2347")
+	assert.Nil(t, ups.SetPeerDrain(peer.addr, true, 0))
+	data := []byte{0, 1, 2, 3}
+	assert.Equal(t, peer, ups.SelectPeer(data, 0, peer))
+
+	// fail health checks of draining peer
+	target := ups.healthChecker.targets[peer]
+	for i := 0; i < ups.healthChecker.failedTimes; i++ {
+		ups.healthChecker.handleFailedCheck(peer, target)
+	}
+	ups.ResetPeers()
+	assert.Equal(t, "dead", peer.Status().State)
+	assert.False(t, peer.IsAvailable())
+	moved := ups.SelectPeer(data, 0, peer)
+	assert.NotNil(t, moved)
+	assert.NotEqual(t, peer, moved)
+
+	// recovered peer keeps draining
+	for i := 0; i < ups.healthChecker.successTimes; i++ {
+		ups.healthChecker.handleSuccessCheck(peer, target)
+	}
+	assert.Equal(t, "draining", peer.Status().State)
+}
+
+// New flow of key kept by draining peer, such as after client rebinding, should keep on it until deadline
+func TestCHashUpstream_DrainKey(t *testing.T) {
+	ups, err := NewCHashUpstream(&sd_config.UpstreamConfig{
+		Name:          "chash",
+		Type:          UpstreamTypeCHash,
+		KeyBytes:      "0:4",
+		HealthChecker: testHealthCheckerConfig(),
+		Peers: []*sd_config.PeerConfig{
+			{IP: "127.0.0.1", Port: 2345, Weight: 1, Backup: true},
+			{IP: "127.0.0.1", Port: 2346, Weight: 1},
+			{IP: "127.0.0.1", Port: 2347, Weight: 1},
+		},
+	})
+	assert.Nil(t, err)
+	defer ups.Close()
+
+	// find two keys mapped to the same peer which is not backup
+	var keys [][]byte
+	var peer *Peer
+	for i := 0; len(keys) < 2; i++ {
+		key := []byte{byte(i), 1, 2, 3}
+		if p := ups.SelectPeer(key, 0, nil); p != ups.backup && (peer == nil || p == peer) {
+			peer = p
+			keys = append(keys, key)
+		}
+	}
+	assert.Nil(t, ups.SetPeerDrain(peer.addr, true, time.Hour))
+
+	// existing flow of the first key keeps on peer, and so does its second session
+	assert.Equal(t, peer, ups.SelectPeer(keys[0], 0, peer))
+	assert.Equal(t, peer, ups.SelectPeer(keys[0], 0, nil))
+
+	// new key skips draining peer
+	assert.NotEqual(t, peer, ups.SelectPeer(keys[1], 0, nil))
+
+	// deadline passed
+	peer.Drain(time.Now().Add(-time.Second))
+	assert.NotEqual(t, peer, ups.SelectPeer(keys[0], 0, nil))
+	ups.ResetPeers()
+	assert.Equal(t, 0, len(ups.drainKeys))
+}
+
+// Keys of draining peer should be pruned when deadline passes or drain is canceled, and not grow unbounded
+func TestCHashUpstream_DrainKeyPrune(t *testing.T) {
+	ups, err := NewCHashUpstream(&sd_config.UpstreamConfig{
+		Name:          "chash",
+		Type:          UpstreamTypeCHash,
+		KeyBytes:      "0:4",
+		HealthChecker: testHealthCheckerConfig(),
+		Peers: []*sd_config.PeerConfig{
+			{IP: "127.0.0.1", Port: 2345, Weight: 1, Backup: true},
+			{IP: "127.0.0.1", Port: 2346, Weight: 1},
+		},
+	})
+	assert.Nil(t, err)
+	defer ups.Close()
+	peer := ups.peers[1]
+	drainKeys := func() int {
+		ups.drainKeysMu.RLock()
+		defer ups.drainKeysMu.RUnlock()
+		return len(ups.drainKeys)
+	}
+
+	// deadline passes
+	assert.Nil(t, ups.SetPeerDrain(peer.addr, true, 50*time.Millisecond))
+	ups.SelectPeer([]byte{0, 1, 2, 3}, 0, peer)
+	assert.Equal(t, 1, drainKeys())
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, drainKeys())
+
+	// drain without deadline is canceled
+	assert.Nil(t, ups.SetPeerDrain(peer.addr, false, 0))
+	assert.Nil(t, ups.SetPeerDrain(peer.addr, true, 0))
+	for i := 0; i < maxDrainKeys+10; i++ {
+		ups.SelectPeer([]byte{byte(i >> 16), byte(i >> 8), byte(i), 0}, 0, peer)
+	}
+	assert.Equal(t, maxDrainKeys, drainKeys())
+	assert.Equal(t, peer, ups.SelectPeer([]byte{0, 0, 0, 0}, 0, peer))
+	assert.Nil(t, ups.SetPeerDrain(peer.addr, false, 0))
+	assert.Equal(t, 0, drainKeys())
+}
+
+// Bit field as key, unrelated bits should not affect peer selection
+func TestCHashUpstream_BitKey(t *testing.T) {
+	config := &sd_config.UpstreamConfig{
+		Name:          "chash",
+		Type:          UpstreamTypeCHash,
+		KeyBytes:      "4b:24b",
+		HealthChecker: testHealthCheckerConfig(),
+		Peers: []*sd_config.PeerConfig{
+			{IP: "127.0.0.1", Port: 2345, Weight: 1, Backup: true},
+			{IP: "127.0.0.1", Port: 2346, Weight: 1},
+			{IP: "127.0.0.1", Port: 2347, Weight: 1},
+		},
+	}
+	ups, err := NewCHashUpstream(config)
+	assert.Nil(t, err)
+	defer ups.Close()
+
+	for i := 0; i < 256; i++ {
+		peer := ups.SelectPeer([]byte{0x0f, byte(i), 0x12, 0xff}, 0, nil)
+		assert.NotNil(t, peer)
+		assert.Equal(t, peer, ups.SelectPeer([]byte{0xff, byte(i), 0x12, 0x00}, 0, nil))
+	}
+
+	data := []byte{0x0f, 1, 0x12, 0xff}
+	allocs := testing.AllocsPerRun(100, func() { ups.SelectPeer(data, 0, nil) })
+	assert.Equal(t, float64(0), allocs)
+}
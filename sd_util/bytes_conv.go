@@ -4,6 +4,10 @@ import "fmt"
 
 // Converts a hex string or bit string into byte slice and a error
 func StringToBytes(s string) ([]byte, error) {
+	if len(s) < 2 {
+		return nil, fmt.Errorf("invalid string %s", s)
+	}
+
 	flag := s[:2]
 	switch flag {
 	case "0x":
@@ -25,6 +25,10 @@ func TestStringToBytes1(t *testing.T) {
 	s = "1234"
 	_, err = StringToBytes(s)
 	assert.NotNil(t, err)
+
+	s = "4"
+	_, err = StringToBytes(s)
+	assert.NotNil(t, err)
 }
 
 // Bit string should be process succeed
@@ -11,6 +11,16 @@ const (
 	BytesOpAndThenNotEqual = "!&="
 )
 
+// Return if symbol is a valid operator
+func IsBytesOperator(symbol string) bool {
+	switch symbol {
+	case BytesOpEqual, BytesOpNotEqual, BytesOpOrThenEqual, BytesOpOrThenNotEqual,
+		BytesOpAndThenEqual, BytesOpAndThenNotEqual:
+		return true
+	}
+	return false
+}
+
 // Return bytes operate result and a error
 func BytesOperate(symbol string, leftVal, rightVal []byte) (bool, error) {
 	if len(leftVal) != len(rightVal) {
@@ -46,21 +56,23 @@ func bytesEqual(leftVal, rightVal []byte) bool {
 // Return (l | r) == r
 // If a bit of r is 0, then related bit of l must be 0
 func bytesOrThenEqual(leftVal, rightVal []byte) bool {
-	tmp := make([]byte, len(leftVal))
-	for i := 0; i < len(tmp); i++ {
-		tmp[i] = leftVal[i] | rightVal[i]
+	for i := 0; i < len(leftVal); i++ {
+		if leftVal[i]|rightVal[i] != rightVal[i] {
+			return false
+		}
 	}
 
-	return string(tmp) == string(rightVal)
+	return true
 }
 
 // Return (l & r) == r
 // If a bit of r is 1, then related bit of l must be 1
 func bytesAndThenEqual(leftVal, rightVal []byte) bool {
-	tmp := make([]byte, len(leftVal))
-	for i := 0; i < len(tmp); i++ {
-		tmp[i] = leftVal[i] & rightVal[i]
+	for i := 0; i < len(leftVal); i++ {
+		if leftVal[i]&rightVal[i] != rightVal[i] {
+			return false
+		}
 	}
 
-	return string(tmp) == string(rightVal)
+	return true
 }
@@ -55,3 +55,11 @@ func TestBytesOperate4(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, false, rst)
 }
+
+// Operator validation
+func TestIsBytesOperator(t *testing.T) {
+	assert.Equal(t, true, IsBytesOperator("=="))
+	assert.Equal(t, true, IsBytesOperator("!&="))
+	assert.Equal(t, false, IsBytesOperator("!="))
+	assert.Equal(t, false, IsBytesOperator(""))
+}
@@ -0,0 +1,16 @@
+package sd_util
+
+const (
+	fnvOffset32 = 2166136261
+	fnvPrime32  = 16777619
+)
+
+// Return 32-bit FNV-1a hash of bytes, which is stable across processes
+func FNVHash(b []byte) uint32 {
+	h := uint32(fnvOffset32)
+	for _, c := range b {
+		h ^= uint32(c)
+		h *= fnvPrime32
+	}
+	return h
+}
@@ -0,0 +1,13 @@
+package sd_util
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// Known FNV-1a values
+func TestFNVHash(t *testing.T) {
+	assert.Equal(t, uint32(0x811c9dc5), FNVHash(nil))
+	assert.Equal(t, uint32(0xe40c292c), FNVHash([]byte("a")))
+	assert.Equal(t, uint32(0xbf9cf968), FNVHash([]byte("foobar")))
+}
@@ -0,0 +1,104 @@
+package sd_util
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	NumOpLess         = "<"
+	NumOpLessEqual    = "<="
+	NumOpGreater      = ">"
+	NumOpGreaterEqual = ">="
+	NumOpInRange      = "in-range" // operands are [min, max]
+	NumOpInSet        = "in-set"   // operands are members of set
+)
+
+const (
+	EndianBig    = "big"
+	EndianLittle = "little"
+)
+
+// Return if symbol is a valid numeric operator
+func IsNumOperator(symbol string) bool {
+	switch symbol {
+	case NumOpLess, NumOpLessEqual, NumOpGreater, NumOpGreaterEqual, NumOpInRange, NumOpInSet:
+		return true
+	}
+	return false
+}
+
+// Return numeric operate result and a error
+func NumOperate(symbol string, val uint64, operands []uint64) (bool, error) {
+	switch symbol {
+	case NumOpLess, NumOpLessEqual, NumOpGreater, NumOpGreaterEqual:
+		if len(operands) != 1 {
+			return false, fmt.Errorf("should be one operand for operation")
+		}
+	case NumOpInRange:
+		if len(operands) != 2 {
+			return false, fmt.Errorf("should be two operands for operation")
+		}
+	}
+
+	var rst bool
+	switch symbol {
+	case NumOpLess:
+		rst = val < operands[0]
+	case NumOpLessEqual:
+		rst = val <= operands[0]
+	case NumOpGreater:
+		rst = val > operands[0]
+	case NumOpGreaterEqual:
+		rst = val >= operands[0]
+	case NumOpInRange:
+		rst = operands[0] <= val && val <= operands[1]
+	case NumOpInSet:
+		for _, operand := range operands {
+			if val == operand {
+				rst = true
+				break
+			}
+		}
+	default:
+		return false, fmt.Errorf("invalid operator %s", symbol)
+	}
+
+	return rst, nil
+}
+
+// Converts at most 8 bytes into unsigned integer in big or little endian
+func BytesToUint(b []byte, littleEndian bool) uint64 {
+	var v uint64
+	if littleEndian {
+		for i := len(b) - 1; i >= 0; i-- {
+			v = (v << 8) | uint64(b[i])
+		}
+		return v
+	}
+
+	for i := 0; i < len(b); i++ {
+		v = (v << 8) | uint64(b[i])
+	}
+	return v
+}
+
+// Converts a decimal, hex or bit string into unsigned integer and a error
+func StringToUint(s string) (uint64, error) {
+	var v uint64
+	var err error
+	switch {
+	case strings.HasPrefix(s, "0x"):
+		v, err = strconv.ParseUint(s[2:], 16, 64)
+	case strings.HasPrefix(s, "0b"):
+		v, err = strconv.ParseUint(s[2:], 2, 64)
+	default:
+		v, err = strconv.ParseUint(s, 10, 64)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("invalid integer %s", s)
+	}
+
+	return v, nil
+}
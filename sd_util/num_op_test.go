@@ -0,0 +1,63 @@
+package sd_util
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// Comparison and range operation
+func TestNumOperate1(t *testing.T) {
+	rst, err := NumOperate("<", 3, []uint64{4})
+	assert.Nil(t, err)
+	assert.Equal(t, true, rst)
+
+	rst, err = NumOperate(">=", 3, []uint64{4})
+	assert.Nil(t, err)
+	assert.Equal(t, false, rst)
+
+	rst, err = NumOperate("in-range", 7, []uint64{3, 7})
+	assert.Nil(t, err)
+	assert.Equal(t, true, rst)
+
+	rst, err = NumOperate("in-range", 8, []uint64{3, 7})
+	assert.Nil(t, err)
+	assert.Equal(t, false, rst)
+
+	_, err = NumOperate("in-range", 8, []uint64{3})
+	assert.NotNil(t, err)
+
+	_, err = NumOperate("==", 8, []uint64{3})
+	assert.NotNil(t, err)
+}
+
+// Set operation
+func TestNumOperate2(t *testing.T) {
+	rst, err := NumOperate("in-set", 16, []uint64{1, 2, 16})
+	assert.Nil(t, err)
+	assert.Equal(t, true, rst)
+
+	rst, err = NumOperate("in-set", 3, []uint64{1, 2, 16})
+	assert.Nil(t, err)
+	assert.Equal(t, false, rst)
+}
+
+// Bytes in big or little endian
+func TestBytesToUint(t *testing.T) {
+	assert.Equal(t, uint64(0x0102), BytesToUint([]byte{1, 2}, false))
+	assert.Equal(t, uint64(0x0201), BytesToUint([]byte{1, 2}, true))
+	assert.Equal(t, uint64(0x0102030405060708), BytesToUint([]byte{1, 2, 3, 4, 5, 6, 7, 8}, false))
+}
+
+// Decimal, hex and bit string
+func TestStringToUint(t *testing.T) {
+	for s, v := range map[string]uint64{"42": 42, "0x2a": 42, "0b101010": 42} {
+		rst, err := StringToUint(s)
+		assert.Nil(t, err)
+		assert.Equal(t, v, rst)
+	}
+
+	for _, s := range []string{"", "0x", "0x2g", "-1", "18446744073709551616"} {
+		_, err := StringToUint(s)
+		assert.NotNil(t, err)
+	}
+}
@@ -0,0 +1,41 @@
+package sd_util
+
+import (
+	"io"
+	"unicode/utf8"
+)
+
+const (
+	SearchOpContains = "contains" // data contains bytes
+	SearchOpMatch    = "match"    // data matches byte-level regular expression
+)
+
+// Return if symbol is a valid search operator
+func IsSearchOperator(symbol string) bool {
+	switch symbol {
+	case SearchOpContains, SearchOpMatch:
+		return true
+	}
+	return false
+}
+
+// Latin1Reader reads every byte as a rune in [0, 255], so that regular expression matches bytes,
+// such as `\xff` matches byte 0xff instead of invalid utf-8
+type Latin1Reader struct {
+	data []byte
+	pos  int
+}
+
+func (r *Latin1Reader) Reset(data []byte) {
+	r.data = data
+	r.pos = 0
+}
+
+func (r *Latin1Reader) ReadRune() (rune, int, error) {
+	if r.pos >= len(r.data) {
+		return utf8.RuneError, 0, io.EOF
+	}
+	c := r.data[r.pos]
+	r.pos++
+	return rune(c), 1, nil
+}
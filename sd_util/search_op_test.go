@@ -0,0 +1,28 @@
+package sd_util
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"regexp"
+	"testing"
+)
+
+// Every byte is read as a rune, including invalid utf-8
+func TestLatin1Reader(t *testing.T) {
+	r := &Latin1Reader{}
+	r.Reset([]byte{'a', 0xff, 0xe4})
+	for _, expect := range []rune{'a', 0xff, 0xe4} {
+		c, size, err := r.ReadRune()
+		assert.Nil(t, err)
+		assert.Equal(t, expect, c)
+		assert.Equal(t, 1, size)
+	}
+	_, _, err := r.ReadRune()
+	assert.Equal(t, io.EOF, err)
+
+	re := regexp.MustCompile(`^a\xff[\x80-\xff]$`)
+	r.Reset([]byte{'a', 0xff, 0xe4})
+	assert.True(t, re.MatchReader(r))
+	r.Reset([]byte{'a', 0xff, 0x7f})
+	assert.False(t, re.MatchReader(r))
+}